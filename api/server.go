@@ -0,0 +1,535 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"trustify/blockchain"
+	"trustify/config"
+	"trustify/crypto"
+	"trustify/logger"
+	"trustify/network"
+)
+
+// DefaultTokenEnv names the variable holding the API token when the configuration does not
+const DefaultTokenEnv = "TRUSTIFY_API_TOKEN"
+
+// Server answers queries about the node's chain over HTTP, as JSON
+type Server struct {
+	Node       *network.Node
+	httpServer *http.Server
+	token      []byte // bearer token required by POST routes
+}
+
+func NewServer(node *network.Node, cfg *config.ConfigAPI) *Server {
+	s := &Server{Node: node}
+	env := cfg.TokenEnv
+	if env == "" {
+		env = DefaultTokenEnv
+	}
+	s.token = []byte(os.Getenv(env))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /products/{id}/ratings", s.handleProductRatings)
+	mux.HandleFunc("GET /products/{id}/score", s.handleProductScore)
+	mux.HandleFunc("GET /products/{id}/flags", s.handleProductFlags)
+	mux.HandleFunc("GET /flags", s.handleFlags)
+	mux.HandleFunc("GET /sellers/{address}/ratings", s.handleSellerRatings)
+	mux.HandleFunc("GET /reviewers/{address}/reputation", s.handleReputation)
+	mux.HandleFunc("GET /wallet/balance", s.handleWalletBalance)
+	mux.HandleFunc("GET /wallet/history/{address}", s.handleWalletHistory)
+	mux.HandleFunc("GET /wallet/rescan", s.handleWalletRescanProgress)
+
+	// Routes that change the wallet or sign act for the node's owner only, so they
+	// are not served at all without a token
+	if len(s.token) > 0 {
+		mux.Handle("POST /wallet/lock", s.private(s.handleWalletLock))
+		mux.Handle("POST /wallet/unlock", s.private(s.handleWalletUnlock))
+		mux.Handle("POST /wallet/watch", s.private(s.handleWalletWatch))
+		mux.Handle("POST /wallet/rescan", s.private(s.handleWalletRescan))
+		mux.Handle("POST /wallet/psbt", s.private(s.handleWalletPSBT))
+		mux.Handle("POST /psbt/combine", s.private(s.handlePSBTCombine))
+		mux.Handle("POST /psbt/finalize", s.private(s.handlePSBTFinalize))
+	} else {
+		logger.InfoLogger.Printf("API token $%s not set, POST routes disabled\n", env)
+	}
+
+	s.httpServer = &http.Server{
+		Addr:              cfg.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s
+}
+
+// Start serves requests until Stop is called
+func (s *Server) Start() {
+	logger.InfoLogger.Println("API listening on", s.httpServer.Addr)
+	if err := s.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.ErrorLogger.Println("API server failed:", err)
+	}
+}
+
+// private admits requests from the loopback interface that carry the API token
+func (s *Server) private(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			writeError(w, http.StatusForbidden, errors.New("POST routes are served to loopback clients only"))
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), s.token) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("missing or wrong API token"))
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// Stop lets requests in flight finish, for up to five seconds
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.httpServer.Shutdown(ctx)
+}
+
+type ratingSummary struct {
+	Count   int     `json:"count"`
+	Sum     int     `json:"sum"`
+	Average float64 `json:"average"`
+	// Number of ratings of each value, keyed by the rating
+	Distribution map[string]int `json:"distribution"`
+}
+
+type ratingAggregate struct {
+	Confirmed   ratingSummary `json:"confirmed"`
+	Unconfirmed ratingSummary `json:"unconfirmed"`
+}
+
+func newRatingSummary(summary blockchain.RatingSummary) ratingSummary {
+	distribution := make(map[string]int)
+	for rating := blockchain.MinRating; rating <= blockchain.MaxRating; rating++ {
+		distribution[strconv.Itoa(rating)] = summary.Distribution[rating]
+	}
+	return ratingSummary{
+		Count:        summary.Count,
+		Sum:          summary.Sum,
+		Average:      summary.Average(),
+		Distribution: distribution,
+	}
+}
+
+func newRatingAggregate(aggregate blockchain.RatingAggregate) ratingAggregate {
+	return ratingAggregate{
+		Confirmed:   newRatingSummary(aggregate.Confirmed),
+		Unconfirmed: newRatingSummary(aggregate.Unconfirmed),
+	}
+}
+
+func (s *Server) handleProductRatings(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newRatingAggregate(s.Node.ProductRatings(r.PathValue("id"))))
+}
+
+func (s *Server) handleSellerRatings(w http.ResponseWriter, r *http.Request) {
+	address := []byte(r.PathValue("address"))
+	if !crypto.ValidateAddress(address) {
+		writeError(w, http.StatusBadRequest, crypto.ErrInvalidAddress)
+		return
+	}
+	writeJSON(w, http.StatusOK, newRatingAggregate(s.Node.SellerRatings(address)))
+}
+
+type productScore struct {
+	Reviews     int     `json:"reviews"`
+	Excluded    int     `json:"excluded"`
+	WeightedSum int64   `json:"weighted_sum"`
+	TotalWeight int64   `json:"total_weight"`
+	Score       float64 `json:"score"`
+}
+
+// Flagged reviews are excluded as configured, unless the exclude_flagged query
+// parameter says otherwise
+func (s *Server) handleProductScore(w http.ResponseWriter, r *http.Request) {
+	exclude := s.Node.Config.BlockchainSettings.Sybil.ExcludeFlagged
+	if value := r.URL.Query().Get("exclude_flagged"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		exclude = parsed
+	}
+	score := s.Node.ProductScore(r.PathValue("id"), exclude)
+	writeJSON(w, http.StatusOK, productScore{
+		Reviews:     score.Reviews,
+		Excluded:    score.Excluded,
+		WeightedSum: score.WeightedSum,
+		TotalWeight: score.TotalWeight,
+		Score:       score.Score,
+	})
+}
+
+type sybilFlag struct {
+	Kind      string   `json:"kind"`
+	ProductID string   `json:"product_id"`
+	ReviewIDs []string `json:"review_ids"`
+	Detail    string   `json:"detail"`
+}
+
+func newSybilFlags(flags []blockchain.SybilFlag) []sybilFlag {
+	out := make([]sybilFlag, 0, len(flags))
+	for _, flag := range flags {
+		ids := make([]string, len(flag.ReviewIDs))
+		for i, id := range flag.ReviewIDs {
+			ids[i] = hex.EncodeToString(id)
+		}
+		out = append(out, sybilFlag{
+			Kind:      string(flag.Kind),
+			ProductID: flag.ProductID,
+			ReviewIDs: ids,
+			Detail:    flag.Detail,
+		})
+	}
+	return out
+}
+
+func (s *Server) handleProductFlags(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newSybilFlags(s.Node.SybilReport(r.PathValue("id"))))
+}
+
+func (s *Server) handleFlags(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newSybilFlags(s.Node.SybilReport("")))
+}
+
+type reputation struct {
+	Age        int `json:"age"`
+	Purchases  int `json:"purchases"`
+	Spend      int `json:"spend"`
+	Reviews    int `json:"reviews"`
+	Deviation  int `json:"deviation"`
+	Reputation int `json:"reputation"`
+}
+
+func (s *Server) handleReputation(w http.ResponseWriter, r *http.Request) {
+	address := []byte(r.PathValue("address"))
+	if !crypto.ValidateAddress(address) {
+		writeError(w, http.StatusBadRequest, crypto.ErrInvalidAddress)
+		return
+	}
+	stats, weight := s.Node.Reputation(address)
+	writeJSON(w, http.StatusOK, reputation{
+		Age:        stats.Age,
+		Purchases:  stats.Purchases,
+		Spend:      stats.Spend,
+		Reviews:    stats.Reviews,
+		Deviation:  stats.Deviation,
+		Reputation: weight,
+	})
+}
+
+type walletBalance struct {
+	Confirmed       int `json:"confirmed"`
+	Unconfirmed     int `json:"unconfirmed"`
+	Immature        int `json:"immature"`
+	PendingOutgoing int `json:"pending_outgoing"`
+}
+
+func newWalletBalance(balance blockchain.WalletBalance) walletBalance {
+	return walletBalance{
+		Confirmed:       balance.Confirmed,
+		Unconfirmed:     balance.Unconfirmed,
+		Immature:        balance.Immature,
+		PendingOutgoing: balance.PendingOutgoing,
+	}
+}
+
+func (s *Server) handleWalletBalance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, newWalletBalance(s.Node.WalletBalance()))
+}
+
+type walletTransaction struct {
+	TxID          string `json:"txid"`
+	Type          string `json:"type"`
+	Height        int    `json:"height"`
+	Confirmations int    `json:"confirmations"`
+	Received      int    `json:"received"`
+	Sent          int    `json:"sent"`
+}
+
+func (s *Server) handleWalletHistory(w http.ResponseWriter, r *http.Request) {
+	address := []byte(r.PathValue("address"))
+	if !crypto.ValidateAddress(address) {
+		writeError(w, http.StatusBadRequest, crypto.ErrInvalidAddress)
+		return
+	}
+	history := s.Node.WalletHistory(address)
+	out := make([]walletTransaction, 0, len(history))
+	for _, entry := range history {
+		out = append(out, walletTransaction{
+			TxID:          hex.EncodeToString(entry.TxID),
+			Type:          string(entry.Type),
+			Height:        entry.Height,
+			Confirmations: entry.Confirmations,
+			Received:      entry.Received,
+			Sent:          entry.Sent,
+		})
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+type walletLockState struct {
+	Locked bool `json:"locked"`
+}
+
+func (s *Server) handleWalletLock(w http.ResponseWriter, r *http.Request) {
+	if err := s.Node.Wallet.Lock(); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, walletLockState{Locked: true})
+}
+
+type walletUnlockRequest struct {
+	Passphrase string `json:"passphrase"`
+	Timeout    int    `json:"timeout"` // seconds, 0 to stay unlocked until locked
+}
+
+func (s *Server) handleWalletUnlock(w http.ResponseWriter, r *http.Request) {
+	var request walletUnlockRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err := s.Node.Wallet.Unlock(request.Passphrase, time.Duration(request.Timeout)*time.Second)
+	switch {
+	case errors.Is(err, blockchain.ErrWalletPassphrase):
+		writeError(w, http.StatusForbidden, err)
+	case errors.Is(err, blockchain.ErrWalletNotEncrypted):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err)
+	default:
+		writeJSON(w, http.StatusOK, walletLockState{Locked: false})
+	}
+}
+
+type walletWatchRequest struct {
+	Address   string `json:"address"`
+	PublicKey string `json:"public_key"` // hex, instead of the address
+	Label     string `json:"label"`
+	Height    int    `json:"height"` // first block rescanned for outputs of the address
+}
+
+func (s *Server) handleWalletWatch(w http.ResponseWriter, r *http.Request) {
+	var request walletWatchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var publicKey []byte
+	if request.PublicKey != "" {
+		var err error
+		if publicKey, err = hex.DecodeString(request.PublicKey); err != nil {
+			writeError(w, http.StatusBadRequest, crypto.ErrInvalidPublicKey)
+			return
+		}
+	}
+	err := s.Node.WatchAddress([]byte(request.Address), publicKey, request.Label, request.Height)
+	switch {
+	case errors.Is(err, blockchain.ErrRescanInProgress):
+		writeError(w, http.StatusConflict, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		s.writeRescanProgress(w, http.StatusAccepted)
+	}
+}
+
+type walletRescanRequest struct {
+	Height int `json:"height"` // first block rescanned, 0 for the whole chain
+}
+
+type rescanProgress struct {
+	Running  bool   `json:"running"`
+	From     int    `json:"from"`
+	Height   int    `json:"height"`
+	Tip      int    `json:"tip"`
+	Started  string `json:"started"`
+	Finished string `json:"finished,omitempty"`
+}
+
+func (s *Server) handleWalletRescan(w http.ResponseWriter, r *http.Request) {
+	var request walletRescanRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := s.Node.RescanWallet(request.Height); err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	s.writeRescanProgress(w, http.StatusAccepted)
+}
+
+func (s *Server) handleWalletRescanProgress(w http.ResponseWriter, r *http.Request) {
+	s.writeRescanProgress(w, http.StatusOK)
+}
+
+func (s *Server) writeRescanProgress(w http.ResponseWriter, status int) {
+	progress, exists := s.Node.WalletRescanProgress()
+	if !exists {
+		writeError(w, http.StatusNotFound, errors.New("wallet has not been rescanned"))
+		return
+	}
+	out := rescanProgress{
+		Running: progress.Running,
+		From:    progress.From,
+		Height:  progress.Height,
+		Tip:     progress.Tip,
+		Started: progress.Started.UTC().Format(time.RFC3339),
+	}
+	if !progress.Finished.IsZero() {
+		out.Finished = progress.Finished.UTC().Format(time.RFC3339)
+	}
+	writeJSON(w, status, out)
+}
+
+// Partial transactions travel in their JSON encoding, or in the binary one with
+// the Content-Type application/octet-stream. Responses are JSON, or binary when the
+// format query parameter says so. Signing is left to the command line, see
+// -sign-psbt, so no request can make the node sign.
+const maxPSBTSize = 1 << 20
+
+type psbtOutput struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+type psbtRequest struct {
+	Outputs []psbtOutput `json:"outputs"`
+	Fee     int          `json:"fee"`
+	Memo    string       `json:"memo"`
+}
+
+type psbtCombineRequest struct {
+	PSBTs []json.RawMessage `json:"psbts"`
+}
+
+type psbtFinalizeResponse struct {
+	TxID string `json:"txid"`
+}
+
+func (s *Server) handleWalletPSBT(w http.ResponseWriter, r *http.Request) {
+	var request psbtRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 65536)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	outputs := make([]blockchain.TxOutput, 0, len(request.Outputs))
+	for _, output := range request.Outputs {
+		if !crypto.ValidateAddress([]byte(output.Address)) {
+			writeError(w, http.StatusBadRequest, crypto.ErrInvalidAddress)
+			return
+		}
+		outputs = append(outputs, blockchain.TxOutput{Address: []byte(output.Address), Amount: output.Amount})
+	}
+	p, err := s.Node.NewPartialTransfer(outputs, request.Fee, request.Memo)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writePSBT(w, r.URL.Query().Get("format") == "binary", p)
+}
+
+func (s *Server) handlePSBTCombine(w http.ResponseWriter, r *http.Request) {
+	var request psbtCombineRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxPSBTSize)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(request.PSBTs) == 0 {
+		writeError(w, http.StatusBadRequest, blockchain.ErrInvalidPartialTransaction)
+		return
+	}
+	parts := make([]*blockchain.PartialTransaction, len(request.PSBTs))
+	for i, data := range request.PSBTs {
+		p, err := blockchain.ParsePartialTransaction(data)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		parts[i] = p
+	}
+	if err := parts[0].Combine(parts[1:]...); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writePSBT(w, r.URL.Query().Get("format") == "binary", parts[0])
+}
+
+func (s *Server) handlePSBTFinalize(w http.ResponseWriter, r *http.Request) {
+	p, err := readPSBT(w, r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	tx, err := s.Node.SubmitPartial(p)
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, psbtFinalizeResponse{TxID: hex.EncodeToString(tx.ID)})
+}
+
+// readPSBT reads the partial transaction in the request body, in either encoding
+func readPSBT(w http.ResponseWriter, r *http.Request) (*blockchain.PartialTransaction, error) {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPSBTSize))
+	if err != nil {
+		return nil, err
+	}
+	return blockchain.ParsePartialTransaction(data)
+}
+
+func writePSBT(w http.ResponseWriter, binary bool, p *blockchain.PartialTransaction) {
+	if !binary {
+		writeJSON(w, http.StatusOK, p)
+		return
+	}
+	data, err := p.Serialize()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(data); err != nil {
+		logger.ErrorLogger.Println("Failed to write API response:", err)
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.ErrorLogger.Println("Failed to write API response:", err)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"trustify/config"
+)
+
+func TestPostRoutesNeedToken(t *testing.T) {
+	t.Setenv("TRUSTIFY_TEST_API_TOKEN", "")
+	s := NewServer(nil, &config.ConfigAPI{TokenEnv: "TRUSTIFY_TEST_API_TOKEN"})
+	r := httptest.NewRequest(http.MethodPost, "/wallet/unlock", nil)
+	r.RemoteAddr = "127.0.0.1:50000"
+	w := httptest.NewRecorder()
+	s.httpServer.Handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status %d without a token, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	s := &Server{token: []byte("secret")}
+	handler := s.private(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		authorization string
+		want          int
+	}{
+		{"loopback with token", "127.0.0.1:50000", "Bearer secret", http.StatusNoContent},
+		{"ipv6 loopback with token", "[::1]:50000", "Bearer secret", http.StatusNoContent},
+		{"remote with token", "192.0.2.1:50000", "Bearer secret", http.StatusForbidden},
+		{"loopback without token", "127.0.0.1:50000", "", http.StatusUnauthorized},
+		{"loopback with wrong token", "127.0.0.1:50000", "Bearer secreT", http.StatusUnauthorized},
+		{"loopback with basic auth", "127.0.0.1:50000", "Basic secret", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/wallet/lock", nil)
+			r.RemoteAddr = test.remoteAddr
+			if test.authorization != "" {
+				r.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != test.want {
+				t.Errorf("status %d, want %d", w.Code, test.want)
+			}
+		})
+	}
+}
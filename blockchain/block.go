@@ -1,8 +1,12 @@
 package blockchain
 
-// import (
-//     "trustify/logger"
-// )
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+	"trustify/logger"
+)
 
 type BlockHeader struct {
 	BlockHash    []byte
@@ -16,10 +20,10 @@ type BlockHeader struct {
 type Block struct {
 	Header           BlockHeader
 	TransactionCount int
-	Transactions     []*UTXOTransaction
+	Transactions     []*Transaction
 }
 
-func NewBlock(transactions []*UTXOTransaction, previousHash []byte, targetHash []byte) (*Block, error) {
+func NewBlock(transactions []*Transaction, previousHash []byte, targetHash []byte) (*Block, error) {
 	// Ensure that the transactions list is not empty.
 	// Check if previousHash and targetHash are valid
 	// Use the transactions list to compute the Merkle Root: Hash each transaction and pair the hashes and iteratively hash them to compute the root.
@@ -30,73 +34,74 @@ func NewBlock(transactions []*UTXOTransaction, previousHash []byte, targetHash [
 	// Timestamp: Current timestamp.
 	// TargetHash: The difficulty target for Proof of Work.
 	// Leave Nonce empty; it will be updated during mining.
-	// Assign the list of UTXOTransaction objects to the Transactions field.
+	// Assign the list of Transaction objects to the Transactions field.
 	// Set the TransactionCount field to the length of the transactions list.
 	// Package the BlockHeader and transaction data into a Block structure.
 	// Return the new Block object for further processing.
-	// Ensure that the transactions list is not empty.
-	// if len(transactions) == 0 {
-    //     logger.ErrorLogger.Println("Attempted to create a block with no transactions")
-    //     return nil, ErrEmptyTransactions
-    // }
-
-    // if len(previousHash) == 0 {
-    //     logger.ErrorLogger.Println("Invalid previous hash provided")
-    //     return nil, ErrInvalidPreviousHash
-    // }
-
-    // if len(targetHash) == 0 {
-    //     logger.ErrorLogger.Println("Invalid target hash provided")
-    //     return nil, ErrInvalidTargetHash
-    // }
+	if len(transactions) == 0 {
+		logger.ErrorLogger.Println("Attempted to create a block with no transactions")
+		return nil, ErrEmptyTransactions
+	}
 
-    // merkleRoot, err := crypto.ComputeMerkleRoot(transactions)
-    // if err != nil {
-    //     logger.ErrorLogger.Println("Failed to compute Merkle root:", err)
-    //     return nil, err
-    // }
+	if len(previousHash) == 0 {
+		logger.ErrorLogger.Println("Invalid previous hash provided")
+		return nil, ErrInvalidPreviousHash
+	}
 
-    // header := BlockHeader{
-    //     PreviousHash: previousHash,
-    //     MerkleRoot:   merkleRoot,
-    //     Timestamp:    time.Now().Unix(),
-    //     TargetHash:   targetHash,
-    //     Nonce:        0, // Will be updated during mining
-    // }
+	if len(targetHash) == 0 {
+		logger.ErrorLogger.Println("Invalid target hash provided")
+		return nil, ErrInvalidTargetHash
+	}
 
-    // block := &Block{
-    //     Header:           header,
-    //     TransactionCount: len(transactions),
-    //     Transactions:     transactions,
-    // }
+	tree, err := BuildTree(transactions)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to compute Merkle root:", err)
+		return nil, err
+	}
 
-    // // Compute the block hash (without Nonce for now)
-    // blockHash := block.ComputeHash()
-    // block.Header.BlockHash = blockHash
+	header := BlockHeader{
+		PreviousHash: previousHash,
+		MerkleRoot:   tree.GetRoot(),
+		Timestamp:    time.Now().Unix(),
+		TargetHash:   targetHash,
+		Nonce:        0, // Will be updated during mining
+	}
 
-    // logger.InfoLogger.Println("New block created with hash:", blockHash)
-    // return block, nil
+	block := &Block{
+		Header:           header,
+		TransactionCount: len(transactions),
+		Transactions:     transactions,
+	}
 
-    return nil, nil
+	// Compute the block hash (without Nonce for now)
+	block.Header.BlockHash = block.ComputeHash()
+	return block, nil
 }
 
 // TODO: Verify if this method should be moved to mining.go
 func (b *Block) ComputeHash() []byte {
 	// Compute the block's hash
-	// var buffer bytes.Buffer
+	var buffer bytes.Buffer
 
-    // buffer.Write(b.Header.PreviousHash)
-    // buffer.Write(b.Header.MerkleRoot)
-    // timestampBytes := make([]byte, 8)
-    // binary.LittleEndian.PutUint64(timestampBytes, uint64(b.Header.Timestamp))
-    // buffer.Write(timestampBytes)
-    // buffer.Write(b.Header.TargetHash)
-    // nonceBytes := make([]byte, 8)
-    // binary.LittleEndian.PutUint64(nonceBytes, uint64(b.Header.Nonce))
-    // buffer.Write(nonceBytes)
+	buffer.Write(b.Header.PreviousHash)
+	buffer.Write(b.Header.MerkleRoot)
+	timestampBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(timestampBytes, uint64(b.Header.Timestamp))
+	buffer.Write(timestampBytes)
+	buffer.Write(b.Header.TargetHash)
+	nonceBytes := make([]byte, 8)
+	binary.LittleEndian.PutUint64(nonceBytes, uint64(b.Header.Nonce))
+	buffer.Write(nonceBytes)
 
-    // hash := sha256.Sum256(buffer.Bytes())
-    // logger.InfoLogger.Println("Computed hash for block:", hash[:])
-    // return hash[:]
-    return nil
-}
\ No newline at end of file
+	hash := sha256.Sum256(buffer.Bytes())
+	return hash[:]
+}
+
+// MeetsTarget reports whether hash satisfies the proof of work target
+// Targets may be given as a short prefix such as 0000, so the target is
+// compared as though padded with 0xff bytes to the length of the hash
+func MeetsTarget(hash []byte, target []byte) bool {
+	padded := bytes.Repeat([]byte{0xff}, len(hash))
+	copy(padded, target)
+	return bytes.Compare(hash, padded) <= 0
+}
@@ -1,15 +1,52 @@
 package blockchain
 
 import (
-    "trustify/config"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"trustify/config"
 	"trustify/logger"
 )
 
+// Blocks may not claim a timestamp further than this into the future
+const maxFutureBlockTime = 2 * time.Hour
+
+// Time locks are measured against the median timestamp of this many previous blocks,
+// which unlike a single timestamp only moves forward
+const medianTimeSpan = 11
+
 type Blockchain struct {
 	Ledger            []*Block
 	MiningReward      int
 	ReviewReward      int
+	RewardHalfTime    int
 	ConfirmationDepth int
+	CoinbaseMaturity  int
+	TargetHash        []byte
+	UTXOSet           *UTXOSet
+	Reviews           *ReviewIndex
+	Products          *ProductIndex
+	Ratings           *RatingIndex
+	Accounts          *AccountIndex
+	Escrows           *EscrowIndex
+	ReputationModel   ReputationModel
+	Sybil             config.ConfigSybil
+	Mutex             sync.RWMutex
+
+	txHeights map[string]int                // transaction ID -> height of the block including it
+	undo      map[string][]*UTXOTransaction // block hash -> outputs spent by the block
+	indexes   []ChainIndex
+}
+
+// ChainIndex is kept in step with the main chain: it sees every block as it is
+// connected to the tip, and again in reverse as it is disconnected by a reorg
+type ChainIndex interface {
+	ConnectBlock(b *Block, height int)
+	DisconnectBlock(b *Block, height int)
 }
 
 // We are getting the geneisis block from config file and through an ConfigGenesisBlock object.
@@ -21,24 +58,67 @@ type Blockchain struct {
 // Initialize any auxiliary structures required for managing transactions, such as UTXO sets or review tracking.
 // Return the newly created Blockchain instance ready for use.
 func NewBlockchain(genesisBlock *config.ConfigGenesisBlock, blockchainSettings *config.ConfigBlockchainSettings) (*Blockchain, error) {
-    // Convert ConfigGenesisBlock to Block
-    block, err := convertConfigGenesisBlockToBlock(genesisBlock)
-    if err != nil {
-        logger.ErrorLogger.Println("Failed to convert genesis block:", err)
-        return nil, err
-    }
+	// Convert ConfigGenesisBlock to Block
+	block, err := convertConfigGenesisBlockToBlock(genesisBlock)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to convert genesis block:", err)
+		return nil, err
+	}
 
 	logger.InfoLogger.Printf("Genesis Block: %+v\n", block)
 
-    bc := &Blockchain{
-        Ledger:            []*Block{block},
-        MiningReward:      blockchainSettings.MiningReward,
-        ReviewReward:      blockchainSettings.ReviewReward,
-        ConfirmationDepth: blockchainSettings.BlockConfirmationDepth,
-    }
+	targetHash, err := hex.DecodeString(blockchainSettings.TargetHash)
+	if err != nil || len(targetHash) == 0 {
+		logger.ErrorLogger.Printf("Invalid target hash: %s\n", blockchainSettings.TargetHash)
+		return nil, ErrInvalidTargetHash
+	}
+
+	bc := &Blockchain{
+		MiningReward:      blockchainSettings.MiningReward,
+		ReviewReward:      blockchainSettings.ReviewReward,
+		RewardHalfTime:    blockchainSettings.RewardHalfTime,
+		ConfirmationDepth: blockchainSettings.BlockConfirmationDepth,
+		CoinbaseMaturity:  blockchainSettings.CoinbaseMaturity,
+		TargetHash:        targetHash,
+		UTXOSet:           NewUTXOSet(),
+		Reviews:           NewReviewIndex(),
+		Products:          NewProductIndex(),
+		Accounts:          NewAccountIndex(),
+		Escrows:           NewEscrowIndex(),
+		ReputationModel:   DefaultReputation,
+		Sybil:             blockchainSettings.Sybil,
+		txHeights:         make(map[string]int),
+		undo:              make(map[string][]*UTXOTransaction),
+	}
+	if bc.CoinbaseMaturity == 0 {
+		bc.CoinbaseMaturity = bc.ConfirmationDepth
+	}
+	bc.Ratings = NewRatingIndex(bc.Products, bc.Reviews)
+	bc.indexes = []ChainIndex{bc.Products, bc.Reviews, bc.Ratings, bc.Accounts, bc.Escrows}
+	if name := blockchainSettings.ReputationModel; name != "" {
+		model, exists := ReputationModels[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown reputation model %q", name)
+		}
+		bc.ReputationModel = model
+	}
 
-    logger.InfoLogger.Printf("Blockchain initialized with genesis block:  %+v\n", bc)
-    return bc, nil
+	// The genesis block is trusted as configured and connected without validation
+	bc.connectBlock(block)
+
+	logger.InfoLogger.Printf("Blockchain initialized with genesis block:  %+v\n", bc)
+	return bc, nil
+}
+
+// RegisterIndex adds an index to be kept in step with the chain, first
+// replaying the blocks already connected
+func (bc *Blockchain) RegisterIndex(index ChainIndex) {
+	bc.Mutex.Lock()
+	defer bc.Mutex.Unlock()
+	for height, block := range bc.Ledger {
+		index.ConnectBlock(block, height)
+	}
+	bc.indexes = append(bc.indexes, index)
 }
 
 func (bc *Blockchain) AddBlock(b *Block) error {
@@ -57,62 +137,159 @@ func (bc *Blockchain) AddBlock(b *Block) error {
 	// Append the validated block to the chain if all checks pass.
 	// Return meaningful error messages if the block fails any validation step.
 	// Make sure the addition of the block is an atomic operation—either fully added or not at all, to maintain blockchain integrity.
-	
-	// Validate the block structure
-    // if b == nil || len(b.Transactions) == 0 {
-    //     logger.ErrorLogger.Println("Invalid block structure")
-    //     return ErrInvalidBlockHash
-    // }
-
-    // // Validate previous hash
-    // lastBlock := bc.LatestBlock()
-    // if !bytes.Equal(b.Header.PreviousHash, lastBlock.Header.BlockHash) {
-    //     logger.ErrorLogger.Println("Block's previous hash does not match the latest block's hash")
-    //     return ErrInvalidPreviousHash
-    // }
-
-    // // Validate Merkle root
-    // merkleRoot, err := crypto.ComputeMerkleRoot(b.Transactions)
-    // if err != nil || !bytes.Equal(merkleRoot, b.Header.MerkleRoot) {
-    //     logger.ErrorLogger.Println("Invalid Merkle root")
-    //     return ErrInvalidMerkleRoot
-    // }
-
-    // // Validate Proof of Work
-    // blockHash := b.ComputeHash()
-    // if bytes.Compare(blockHash, b.Header.TargetHash) > 0 {
-    //     logger.ErrorLogger.Println("Block does not meet the difficulty target")
-    //     return ErrInvalidBlockHash
-    // }
-
-    // // Validate timestamp (e.g., within 2 hours of current time)
-    // if b.Header.Timestamp > time.Now().Unix()+7200 {
-    //     logger.ErrorLogger.Println("Block timestamp is too far in the future")
-    //     return ErrInvalidTimestamp
-    // }
-
-    // // Validate transactions
-    // for _, tx := range b.Transactions {
-    //     if !tx.Verify() {
-    //         logger.ErrorLogger.Println("Invalid transaction detected")
-    //         return ErrTransactionInvalid
-    //     }
-    //     // Additional validation for UTXO, double-spending, reviews, etc.
-    //     if err := bc.validateTransaction(tx); err != nil {
-    //         logger.ErrorLogger.Println("Transaction validation failed:", err)
-    //         return err
-    //     }
-    // }
-
-    // // Append block to ledger
-    // bc.Ledger = append(bc.Ledger, b)
-    // logger.InfoLogger.Println("Block added to blockchain:", b.Header.BlockHash)
-
-    // // Update UTXOSet
-    // bc.updateUTXOSet(b)
-    // return nil
-
-    return nil
+
+	bc.Mutex.Lock()
+	defer bc.Mutex.Unlock()
+
+	// Validation only reads chain state, so a block failing any check leaves the chain untouched
+	if err := bc.validateBlock(b); err != nil {
+		logger.ErrorLogger.Println("Block validation failed:", err)
+		return err
+	}
+
+	bc.connectBlock(b)
+	logger.InfoLogger.Printf("Block added to blockchain: %x\n", b.Header.BlockHash)
+	return nil
+}
+
+// DisconnectTip removes the latest block, returning the outputs it spent to the
+// UTXO set and rolling back every index, so that a competing branch can be connected
+func (bc *Blockchain) DisconnectTip() (*Block, error) {
+	bc.Mutex.Lock()
+	defer bc.Mutex.Unlock()
+
+	if len(bc.Ledger) <= 1 {
+		return nil, fmt.Errorf("%w: cannot disconnect the genesis block", ErrInvalidBlockHash)
+	}
+	height := len(bc.Ledger) - 1
+	b := bc.Ledger[height]
+
+	for i := len(bc.indexes) - 1; i >= 0; i-- {
+		bc.indexes[i].DisconnectBlock(b, height)
+	}
+
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		tx := b.Transactions[i]
+		for _, utxo := range tx.UTXOs() {
+			bc.UTXOSet.Remove(utxo.ID)
+		}
+		delete(bc.txHeights, hex.EncodeToString(tx.ID))
+	}
+	blockKey := hex.EncodeToString(b.Header.BlockHash)
+	for _, utxo := range bc.undo[blockKey] {
+		bc.UTXOSet.Add(utxo)
+	}
+	delete(bc.undo, blockKey)
+
+	bc.Ledger = bc.Ledger[:height]
+	logger.InfoLogger.Printf("Block disconnected from blockchain: %x\n", b.Header.BlockHash)
+	return b, nil
+}
+
+func (bc *Blockchain) validateBlock(b *Block) error {
+	if b == nil || len(b.Transactions) == 0 || b.TransactionCount != len(b.Transactions) {
+		return ErrEmptyTransactions
+	}
+
+	lastBlock := bc.Ledger[len(bc.Ledger)-1]
+	if !bytes.Equal(b.Header.PreviousHash, lastBlock.Header.BlockHash) {
+		return ErrInvalidPreviousHash
+	}
+
+	tree, err := BuildTree(b.Transactions)
+	if err != nil || !bytes.Equal(tree.GetRoot(), b.Header.MerkleRoot) {
+		return ErrInvalidMerkleRoot
+	}
+
+	if !bytes.Equal(b.Header.TargetHash, bc.TargetHash) {
+		return ErrInvalidTargetHash
+	}
+	if blockHash := b.ComputeHash(); !bytes.Equal(blockHash, b.Header.BlockHash) || !MeetsTarget(blockHash, bc.TargetHash) {
+		return ErrInvalidBlockHash
+	}
+
+	if b.Header.Timestamp > time.Now().Add(maxFutureBlockTime).Unix() {
+		return ErrInvalidTimestamp
+	}
+	if median := bc.medianTimePast(len(bc.Ledger)); b.Header.Timestamp <= median {
+		return fmt.Errorf("%w: not after median time past %d", ErrInvalidTimestamp, median)
+	}
+
+	return bc.validateBlockTransactions(b, len(bc.Ledger))
+}
+
+// validateBlockTransactions checks every transaction against the chain plus the
+// transactions before it in the block, and the coinbase against the rewards and
+// fees the block may claim
+func (bc *Blockchain) validateBlockTransactions(b *Block, height int) error {
+	coinbase := b.Transactions[0]
+	if err := coinbase.CheckFormat(); err != nil {
+		return err
+	}
+	if data, ok := coinbase.Data.(*CoinbaseTransactionData); !ok || data.Height != height {
+		return fmt.Errorf("%w: block must start with a coinbase for height %d", ErrTransactionInvalid, height)
+	}
+
+	view := newUTXOView(bc.UTXOSet, height)
+	claimed := make(map[string]bool)
+	fees := 0
+	reviewCount := 0
+
+	for _, tx := range b.Transactions[1:] {
+		fee, err := bc.validateTransaction(tx, view.Get)
+		if err != nil {
+			return fmt.Errorf("transaction %x: %w", tx.ID, err)
+		}
+		// Besides outputs, the indexes check reviews, revisions and registry changes
+		// without seeing the rest of the block, so each of those may be claimed once
+		// per block, just as in the mempool
+		for _, claim := range claims(tx) {
+			if claimed[claim] {
+				return fmt.Errorf("transaction %x: %w: %s", tx.ID, ErrBlockConflict, claim)
+			}
+			claimed[claim] = true
+		}
+		if _, ok := tx.Data.(*ReviewTransactionData); ok {
+			reviewCount++
+		}
+		view.apply(tx)
+		fees += fee
+	}
+
+	if limit := bc.BlockReward(height) + fees + reviewCount*bc.ReviewReward; coinbase.OutputTotal() > limit {
+		return fmt.Errorf("%w: coinbase pays %d, limit %d", ErrTransactionInvalid, coinbase.OutputTotal(), limit)
+	}
+	return nil
+}
+
+// connectBlock applies a validated block to the UTXO set and indexes, keeping the
+// spent outputs so DisconnectTip can undo it
+func (bc *Blockchain) connectBlock(b *Block) {
+	height := len(bc.Ledger)
+	var spent []*UTXOTransaction
+
+	for _, tx := range b.Transactions {
+		if !tx.IsCoinbase() {
+			for _, input := range tx.Inputs {
+				if utxo, exists := bc.UTXOSet.Get(&input.PrevOut); exists {
+					spent = append(spent, utxo)
+					bc.UTXOSet.Remove(input.PrevOut)
+				}
+			}
+		}
+		for _, utxo := range tx.UTXOs() {
+			utxo.Height = height
+			bc.UTXOSet.Add(utxo)
+		}
+		bc.txHeights[hex.EncodeToString(tx.ID)] = height
+	}
+
+	bc.Ledger = append(bc.Ledger, b)
+	bc.undo[hex.EncodeToString(b.Header.BlockHash)] = spent
+
+	for _, index := range bc.indexes {
+		index.ConnectBlock(b, height)
+	}
 }
 
 func (bc *Blockchain) GetBlockByHash(hash []byte) (*Block, error) {
@@ -121,44 +298,204 @@ func (bc *Blockchain) GetBlockByHash(hash []byte) (*Block, error) {
 	// If a block with the matching hash is found, return it.
 	// If no block is found with the given hash, return a meaningful error indicating that the block does not exist.
 	// Ensure that the retrieved block is valid within the context of the current chain state (e.g., hasn’t been replaced by a fork).
-	
-	// for _, block := range bc.Ledger {
-    //     if bytes.Equal(block.Header.BlockHash, hash) {
-    //         logger.InfoLogger.Println("Block found for hash:", hash)
-    //         return block, nil
-    //     }
-    // }
-    // logger.ErrorLogger.Println("Block not found for hash:", hash)
-    // return nil, ErrBlockNotFound
 
-    return nil, nil
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+
+	for _, block := range bc.Ledger {
+		if bytes.Equal(block.Header.BlockHash, hash) {
+			return block, nil
+		}
+	}
+	logger.ErrorLogger.Printf("Block not found for hash: %x\n", hash)
+	return nil, ErrBlockNotFound
 }
 
 func (bc *Blockchain) LatestBlock() *Block {
 	// Retrieve the last block added to the blockchain, which represents the current state of the ledger.
 	// If the blockchain is empty (e.g., no blocks have been added), return nil.
-	
-	// if len(bc.Ledger) == 0 {
-    //     logger.ErrorLogger.Println("Blockchain is empty")
-    //     return nil
-    // }
-    // return bc.Ledger[len(bc.Ledger)-1]
 
-    return nil
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+
+	if len(bc.Ledger) == 0 {
+		logger.ErrorLogger.Println("Blockchain is empty")
+		return nil
+	}
+	return bc.Ledger[len(bc.Ledger)-1]
+}
+
+// Height is the height of the latest block, the genesis block being at height 0
+func (bc *Blockchain) Height() int {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	return len(bc.Ledger) - 1
+}
+
+// BlockReward is the mining reward at a height, halved every RewardHalfTime blocks
+func (bc *Blockchain) BlockReward(height int) int {
+	if bc.RewardHalfTime <= 0 {
+		return bc.MiningReward
+	}
+	halvings := height / bc.RewardHalfTime
+	if halvings >= 63 {
+		return 0
+	}
+	return bc.MiningReward >> halvings
+}
+
+// MedianTimePast is the median timestamp of the blocks before height, at most
+// medianTimeSpan of them, which time locks on a block at height are checked against
+func (bc *Blockchain) MedianTimePast(height int) int64 {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	return bc.medianTimePast(height)
+}
+
+func (bc *Blockchain) medianTimePast(height int) int64 {
+	if height > len(bc.Ledger) {
+		height = len(bc.Ledger)
+	}
+	start := height - medianTimeSpan
+	if start < 0 {
+		start = 0
+	}
+	var timestamps []int64
+	for _, b := range bc.Ledger[start:height] {
+		timestamps = append(timestamps, b.Header.Timestamp)
+	}
+	if len(timestamps) == 0 {
+		return 0
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2]
+}
+
+// spendContext describes the next block, which both blocks being validated and
+// mempool transactions belong to
+func (bc *Blockchain) spendContext() *SpendContext {
+	height := len(bc.Ledger)
+	return &SpendContext{
+		Height:            height,
+		MedianTime:        bc.medianTimePast(height),
+		MedianTimePast:    bc.medianTimePast,
+		CoinbaseMaturity:  bc.CoinbaseMaturity,
+		DeliveryConfirmed: bc.Escrows.Confirmed,
+	}
+}
+
+// CheckFinal reports, with ErrTxNotFinal, whether a transaction held in the mempool
+// is still locked for the next block. lookup finds the outputs it spends.
+func (bc *Blockchain) CheckFinal(tx *Transaction, lookup func(id *UTXOTransactionID) (*UTXOTransaction, bool)) error {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	return tx.CheckFinal(lookup, bc.spendContext())
 }
 
 // Add a method to identify committed blocks and transactions based on the confirmation depth available from the configuration
 // This method should check for committed blocks and transactions
 // Update the UTXO set with committed transactions
 
+// ContainsTransaction reports whether the transaction with the given ID has been included in a block
+func (bc *Blockchain) ContainsTransaction(txID []byte) bool {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	_, exists := bc.txHeights[hex.EncodeToString(txID)]
+	return exists
+}
+
+// GetTransaction finds a confirmed transaction and the height of the block including it
+func (bc *Blockchain) GetTransaction(txID []byte) (*Transaction, int, bool) {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	return bc.transaction(txID)
+}
+
+func (bc *Blockchain) transaction(txID []byte) (*Transaction, int, bool) {
+	height, exists := bc.txHeights[hex.EncodeToString(txID)]
+	if !exists {
+		return nil, 0, false
+	}
+	for _, tx := range bc.Ledger[height].Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			return tx, height, true
+		}
+	}
+	return nil, 0, false
+}
 
-func (bc *Blockchain) validateTransaction(tx *UTXOTransaction) error {
-    // Implement validation logic for transactions
-    // Check UTXOSet for inputs
-    // Verify signatures, double-spending, etc.
-    return nil
+// ValidateTransaction checks a transaction for the mempool against the tip of the
+// chain and returns its fee. lookup must find every output the transaction may
+// spend, confirmed or otherwise.
+// A transaction that is valid but locked returns its fee along with ErrTxNotFinal.
+func (bc *Blockchain) ValidateTransaction(tx *Transaction, lookup func(id *UTXOTransactionID) (*UTXOTransaction, bool)) (int, error) {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	return bc.validateTransaction(tx, lookup)
 }
 
-func (bc *Blockchain) updateUTXOSet(b *Block) {
-    // Remove spent UTXOs and add new UTXOs from the block's transactions
-}
\ No newline at end of file
+func (bc *Blockchain) validateTransaction(tx *Transaction, lookup func(id *UTXOTransactionID) (*UTXOTransaction, bool)) (int, error) {
+	if err := tx.CheckFormat(); err != nil {
+		return 0, err
+	}
+	if tx.IsCoinbase() {
+		return 0, fmt.Errorf("%w: coinbase outside the first position of a block", ErrTransactionInvalid)
+	}
+	if _, exists := bc.txHeights[hex.EncodeToString(tx.ID)]; exists {
+		return 0, ErrTxConfirmed
+	}
+
+	// Locks are reported last, once everything else about the transaction is known to be valid
+	fee, final := tx.CheckInputs(lookup, bc.spendContext())
+	if final != nil && !errors.Is(final, ErrTxNotFinal) {
+		return 0, final
+	}
+
+	switch data := tx.Data.(type) {
+	case *PurchaseTransactionData:
+		// The buyer named in the payload must have signed for at least one of the inputs,
+		// as reviews are later authorized by this purchase
+		if !tx.SignedBy(data.BuyerAddress) {
+			return 0, fmt.Errorf("%w: purchase not signed by buyer", ErrInvalidSignature)
+		}
+		if err := bc.Products.CheckPurchase(data); err != nil {
+			return 0, err
+		}
+	case *ReviewTransactionData:
+		if err := bc.Reviews.CheckReview(data); err != nil {
+			return 0, err
+		}
+	case *ReviewAmendTransactionData:
+		if err := bc.Reviews.CheckRevision(data.ReviewID, data.ReviewerAddress); err != nil {
+			return 0, err
+		}
+	case *ReviewRetractTransactionData:
+		if err := bc.Reviews.CheckRevision(data.ReviewID, data.ReviewerAddress); err != nil {
+			return 0, err
+		}
+	case *ProductListingTransactionData:
+		if err := bc.Products.CheckListing(data); err != nil {
+			return 0, err
+		}
+	case *ProductUpdateTransactionData:
+		if err := bc.Products.CheckChange(data.ProductID, data.SellerAddress); err != nil {
+			return 0, err
+		}
+	case *ProductDelistTransactionData:
+		if err := bc.Products.CheckChange(data.ProductID, data.SellerAddress); err != nil {
+			return 0, err
+		}
+	case *DeliveryConfirmationTransactionData:
+		if err := bc.Escrows.CheckConfirmation(data, lookup); err != nil {
+			return 0, err
+		}
+	case *RefundTransactionData:
+		if !tx.SignedBy(data.SellerAddress) {
+			return 0, fmt.Errorf("%w: refund not signed by seller", ErrInvalidSignature)
+		}
+		if err := bc.checkRefund(data); err != nil {
+			return 0, err
+		}
+	}
+	return fee, final
+}
@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"fmt"
+	"sort"
+)
+
+// CoinSelector picks UTXOs from the candidates whose amounts add up to at least target
+// Anything selected above target comes back to the wallet as a change output
+type CoinSelector func(utxos []*UTXOTransaction, target int) ([]*UTXOTransaction, error)
+
+// Bound on the branches BranchAndBound explores before giving up on an exact match
+const bnbMaxTries = 100000
+
+var CoinSelectors = map[string]CoinSelector{
+	"largest_first":    LargestFirst,
+	"smallest_first":   SmallestFirst,
+	"branch_and_bound": BranchAndBound,
+}
+
+// LargestFirst spends the biggest outputs first, using as few inputs as possible
+func LargestFirst(utxos []*UTXOTransaction, target int) ([]*UTXOTransaction, error) {
+	sorted := sortUTXOs(utxos, func(a, b *UTXOTransaction) bool { return a.Amount > b.Amount })
+	return accumulate(sorted, target)
+}
+
+// SmallestFirst spends the smallest outputs first, consolidating dust into change
+func SmallestFirst(utxos []*UTXOTransaction, target int) ([]*UTXOTransaction, error) {
+	sorted := sortUTXOs(utxos, func(a, b *UTXOTransaction) bool { return a.Amount < b.Amount })
+	return accumulate(sorted, target)
+}
+
+// BranchAndBound searches for a set of outputs adding up to exactly target, so that
+// no change output is needed. The search walks include/exclude decisions over the
+// outputs from largest to smallest, pruning branches that overshoot target or can no
+// longer reach it. If no exact match is found within bnbMaxTries branches it falls
+// back to LargestFirst.
+func BranchAndBound(utxos []*UTXOTransaction, target int) ([]*UTXOTransaction, error) {
+	sorted := sortUTXOs(utxos, func(a, b *UTXOTransaction) bool { return a.Amount > b.Amount })
+
+	// remaining[i] is the sum of sorted[i:], the most the rest of a branch can add
+	remaining := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Amount
+	}
+	if remaining[0] < target {
+		return nil, insufficientFunds(remaining[0], target)
+	}
+
+	tries := 0
+	var selected []*UTXOTransaction
+	var search func(i, total int) bool
+	search = func(i, total int) bool {
+		tries++
+		switch {
+		case total == target:
+			return true
+		case total > target, total+remaining[i] < target, i == len(sorted), tries > bnbMaxTries:
+			return false
+		}
+		selected = append(selected, sorted[i])
+		if search(i+1, total+sorted[i].Amount) {
+			return true
+		}
+		selected = selected[:len(selected)-1]
+		return search(i+1, total)
+	}
+
+	if search(0, 0) {
+		return selected, nil
+	}
+	return LargestFirst(utxos, target)
+}
+
+func accumulate(sorted []*UTXOTransaction, target int) ([]*UTXOTransaction, error) {
+	var selected []*UTXOTransaction
+	total := 0
+	for _, utxo := range sorted {
+		if total >= target {
+			break
+		}
+		selected = append(selected, utxo)
+		total += utxo.Amount
+	}
+	if total < target {
+		return nil, insufficientFunds(total, target)
+	}
+	return selected, nil
+}
+
+// Ties are broken by outpoint so every node selects the same coins from the same wallet
+func sortUTXOs(utxos []*UTXOTransaction, less func(a, b *UTXOTransaction) bool) []*UTXOTransaction {
+	sorted := append([]*UTXOTransaction(nil), utxos...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Amount != sorted[j].Amount {
+			return less(sorted[i], sorted[j])
+		}
+		return sorted[i].ID.String() < sorted[j].ID.String()
+	})
+	return sorted
+}
+
+func insufficientFunds(available, target int) error {
+	return fmt.Errorf("%w: need %d, have %d", ErrInsufficientFunds, target, available)
+}
@@ -0,0 +1,98 @@
+package blockchain
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testUTXOs returns outputs of the given amounts, each in a transaction of its own
+func testUTXOs(amounts ...int) []*UTXOTransaction {
+	utxos := make([]*UTXOTransaction, len(amounts))
+	for i, amount := range amounts {
+		utxos[i] = &UTXOTransaction{ID: UTXOTransactionID{TxID: []byte{byte(i + 1)}, Index: 0}, Amount: amount}
+	}
+	return utxos
+}
+
+func repeat(amount, n int) []int {
+	out := make([]int, n)
+	for i := range out {
+		out[i] = amount
+	}
+	return out
+}
+
+func amounts(utxos []*UTXOTransaction) []int {
+	out := []int{}
+	for _, utxo := range utxos {
+		out = append(out, utxo.Amount)
+	}
+	return out
+}
+
+func TestCoinSelectors(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		amounts  []int
+		target   int
+		want     []int
+		err      error
+	}{
+		{"largest first", "largest_first", []int{2, 5, 3, 4}, 6, []int{5, 4}, nil},
+		{"largest first exact", "largest_first", []int{2, 5, 3, 4}, 9, []int{5, 4}, nil},
+		{"largest first single", "largest_first", []int{2, 5, 3, 4}, 5, []int{5}, nil},
+		{"largest first everything", "largest_first", []int{2, 5, 3, 4}, 14, []int{5, 4, 3, 2}, nil},
+		{"largest first insufficient", "largest_first", []int{2, 5, 3, 4}, 15, nil, ErrInsufficientFunds},
+		{"largest first nothing to spend", "largest_first", nil, 1, nil, ErrInsufficientFunds},
+		{"largest first nothing needed", "largest_first", []int{2, 5}, 0, []int{}, nil},
+		{"smallest first", "smallest_first", []int{2, 5, 3, 4}, 6, []int{2, 3, 4}, nil},
+		{"smallest first exact", "smallest_first", []int{2, 5, 3, 4}, 5, []int{2, 3}, nil},
+		{"smallest first insufficient", "smallest_first", []int{2, 5, 3, 4}, 15, nil, ErrInsufficientFunds},
+		{"branch and bound exact", "branch_and_bound", []int{2, 5, 3, 4}, 6, []int{4, 2}, nil},
+		{"branch and bound prefers the largest", "branch_and_bound", []int{2, 5, 3, 4}, 7, []int{5, 2}, nil},
+		{"branch and bound everything", "branch_and_bound", []int{2, 5, 3, 4}, 14, []int{5, 4, 3, 2}, nil},
+		{"branch and bound falls back", "branch_and_bound", []int{10, 7}, 5, []int{10}, nil},
+		{"branch and bound falls back to several", "branch_and_bound", []int{4, 4, 4}, 10, []int{4, 4, 4}, nil},
+		{"branch and bound gives up", "branch_and_bound", repeat(2, 40), 31, repeat(2, 16), nil},
+		{"branch and bound insufficient", "branch_and_bound", []int{2, 5, 3, 4}, 15, nil, ErrInsufficientFunds},
+		{"branch and bound nothing needed", "branch_and_bound", []int{2, 5}, 0, []int{}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			utxos := testUTXOs(test.amounts...)
+			selected, err := CoinSelectors[test.selector](utxos, test.target)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("got %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := amounts(selected); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("selected %v, want %v", got, test.want)
+			}
+			if got := amounts(utxos); !reflect.DeepEqual(got, test.amounts) && len(test.amounts) > 0 {
+				t.Errorf("candidates reordered to %v", got)
+			}
+		})
+	}
+}
+
+func TestCoinSelectionBreaksTiesByOutpoint(t *testing.T) {
+	utxos := testUTXOs(3, 3, 3)
+	reversed := []*UTXOTransaction{utxos[2], utxos[1], utxos[0]}
+	for name, selector := range CoinSelectors {
+		a, errA := selector(utxos, 4)
+		b, errB := selector(reversed, 4)
+		if errA != nil || errB != nil {
+			t.Fatalf("%s: %v, %v", name, errA, errB)
+		}
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("%s selected differently depending on the order of the candidates", name)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"trustify/config"
+	"trustify/logger"
+)
+
+// ContentStore keeps review text and media off chain, one file per blob named by its
+// sha256 hash, the same hash reviews commit to in ContentHash
+// Blobs are checked against their hash whenever they are read, so a corrupted or
+// tampered file is never served
+type ContentStore struct {
+	Dir     string
+	MaxSize int
+}
+
+func NewContentStore(cfg *config.ConfigContent) (*ContentStore, error) {
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		logger.ErrorLogger.Println("Failed to create content store:", err)
+		return nil, err
+	}
+	return &ContentStore{
+		Dir:     cfg.Dir,
+		MaxSize: cfg.MaxSize,
+	}, nil
+}
+
+// ContentHash is the commitment a review makes to its off-chain content
+func ContentHash(content []byte) []byte {
+	hash := sha256.Sum256(content)
+	return hash[:]
+}
+
+// Put stores content and returns its hash
+// Storing the same content twice is harmless, the file is simply rewritten
+func (cs *ContentStore) Put(content []byte) ([]byte, error) {
+	if cs.MaxSize > 0 && len(content) > cs.MaxSize {
+		return nil, fmt.Errorf("%w: %d of %d bytes", ErrContentTooLarge, len(content), cs.MaxSize)
+	}
+	hash := ContentHash(content)
+
+	// Written to a temporary file first so a reader never sees a partial blob
+	tmp, err := os.CreateTemp(cs.Dir, "*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), cs.path(hash)); err != nil {
+		return nil, err
+	}
+
+	logger.InfoLogger.Printf("Stored content %x (%d bytes)\n", hash, len(content))
+	return hash, nil
+}
+
+// Get returns the content stored under hash after checking it still hashes to it
+func (cs *ContentStore) Get(hash []byte) ([]byte, error) {
+	if len(hash) != sha256.Size {
+		return nil, fmt.Errorf("%w: %x", ErrContentNotFound, hash)
+	}
+	content, err := os.ReadFile(cs.path(hash))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %x", ErrContentNotFound, hash)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(ContentHash(content), hash) {
+		logger.ErrorLogger.Printf("Stored content %x is corrupt, removing it\n", hash)
+		os.Remove(cs.path(hash))
+		return nil, fmt.Errorf("%w: %x", ErrContentMismatch, hash)
+	}
+	return content, nil
+}
+
+func (cs *ContentStore) Has(hash []byte) bool {
+	if len(hash) != sha256.Size {
+		return false
+	}
+	_, err := os.Stat(cs.path(hash))
+	return err == nil
+}
+
+func (cs *ContentStore) path(hash []byte) string {
+	return filepath.Join(cs.Dir, hex.EncodeToString(hash))
+}
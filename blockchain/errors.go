@@ -13,8 +13,46 @@ var (
 	ErrBlockNotFound       = errors.New("block not found")
 	ErrTransactionInvalid  = errors.New("transaction invalid")
 	ErrDoubleSpending      = errors.New("double spending detected")
+	ErrBlockConflict       = errors.New("conflicting transactions in block")
 	ErrReviewNotPurchased  = errors.New("reviewer has not purchased the product")
 	ErrReviewDuplicate     = errors.New("duplicate review submission")
+	ErrInvalidRating       = errors.New("rating out of range")
+	ErrReviewTooLong       = errors.New("review text too long")
+	ErrReviewNotFound      = errors.New("review not found")
+	ErrReviewRetracted     = errors.New("review has been retracted")
+	ErrProductNotListed    = errors.New("product not listed")
+	ErrProductExists       = errors.New("product already listed")
+	ErrProductSeller       = errors.New("seller did not list the product")
+	ErrPurchaseRefunded    = errors.New("purchase already refunded")
+	ErrEscrowLocked        = errors.New("escrow spending conditions not met")
+	ErrEscrowConfirmed     = errors.New("escrow delivery already confirmed")
+	ErrContentNotFound     = errors.New("content not found")
+	ErrContentMismatch     = errors.New("content does not match its hash")
+	ErrContentTooLarge     = errors.New("content too large")
 	ErrInvalidSignature    = errors.New("invalid digital signature")
+	ErrMissingSignatures   = errors.New("not enough signatures")
+	ErrScriptInvalid       = errors.New("malformed script")
+	ErrScriptFailed        = errors.New("script failed")
 	ErrUTXONotFound        = errors.New("UTXO not found")
+	ErrImmatureCoinbase    = errors.New("coinbase output not yet mature")
+	ErrInsufficientFunds   = errors.New("insufficient funds")
+	ErrTxInMempool         = errors.New("transaction already in mempool")
+	ErrMempoolConflict     = errors.New("transaction conflicts with a mempool entry")
+	ErrMempoolFull         = errors.New("mempool full")
+	ErrInsufficientFee     = errors.New("fee rate below mempool minimum")
+	ErrTxExpired           = errors.New("transaction expired from mempool")
+	ErrTxNotFinal          = errors.New("transaction not final")
+	ErrTxConfirmed         = errors.New("transaction already confirmed")
+	ErrReplacementFee      = errors.New("replacement does not pay enough fee")
+	ErrTooManyReplacements = errors.New("replacement evicts too many transactions")
+	ErrWalletLocked        = errors.New("wallet is locked")
+	ErrWalletPassphrase    = errors.New("wrong wallet passphrase")
+	ErrWalletNotEncrypted  = errors.New("wallet has no encrypted file")
+	ErrWatchOnly           = errors.New("watch-only wallet cannot sign")
+	ErrRescanInProgress    = errors.New("wallet rescan already in progress")
+)
+
+var (
+	ErrInvalidPartialTransaction = errors.New("invalid partially signed transaction")
+	ErrFeeTooHigh                = errors.New("fee above the signing cap")
 )
@@ -0,0 +1,305 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync"
+	"trustify/crypto"
+	"trustify/logger"
+	"trustify/types"
+)
+
+// EscrowTerms lock the payment of an escrowed purchase. The output can be spent
+// by buyer and seller together, by the seller alone once the buyer has confirmed
+// delivery on chain, or by the buyer alone in a block at height Timeout or later
+// if delivery was never confirmed.
+// The seller takes the coins with a release and the buyer with a refund.
+type EscrowTerms struct {
+	BuyerAddress  []byte
+	SellerAddress []byte
+	Timeout       int
+}
+
+// The buyer confirms delivery of the purchase paid into Escrow, letting the seller
+// release it. Confirmations spend nothing and are signed by the buyer like reviews.
+type DeliveryConfirmationTransactionData struct {
+	Escrow       UTXOTransactionID
+	BuyerAddress []byte
+	PublicKey    []byte
+	Signature    []byte
+}
+
+// Releases pay an escrow to the seller and refunds return it to the buyer. Either
+// spends the escrow output named by Escrow as its only input.
+type EscrowReleaseTransactionData struct {
+	Escrow UTXOTransactionID
+}
+
+type EscrowRefundTransactionData struct {
+	Escrow UTXOTransactionID
+}
+
+func init() {
+	gob.Register(&DeliveryConfirmationTransactionData{})
+	gob.Register(&EscrowReleaseTransactionData{})
+	gob.Register(&EscrowRefundTransactionData{})
+}
+
+func (e *EscrowTerms) writeHash(w *hashWriter) {
+	w.writeBytes(e.BuyerAddress)
+	w.writeBytes(e.SellerAddress)
+	w.writeInt(e.Timeout)
+}
+
+// Address is the script address the escrow output pays, committing to the terms
+func (e *EscrowTerms) Address() []byte {
+	w := &hashWriter{}
+	w.writeString("escrow")
+	e.writeHash(w)
+	return crypto.ScriptAddress(w.Bytes())
+}
+
+// check validates the terms of an output paying address
+func (e *EscrowTerms) check(address []byte) error {
+	if !crypto.ValidateAddress(e.BuyerAddress) || !crypto.ValidateAddress(e.SellerAddress) {
+		return fmt.Errorf("%w: escrow buyer %s, seller %s", ErrTransactionInvalid, e.BuyerAddress, e.SellerAddress)
+	}
+	if bytes.Equal(e.BuyerAddress, e.SellerAddress) {
+		return fmt.Errorf("%w: escrow buyer is the seller", ErrTransactionInvalid)
+	}
+	if e.Timeout <= 0 {
+		return fmt.Errorf("%w: non-positive escrow timeout", ErrTransactionInvalid)
+	}
+	if !bytes.Equal(address, e.Address()) {
+		return fmt.Errorf("%w: output address %s does not commit to its escrow", ErrTransactionInvalid, address)
+	}
+	return nil
+}
+
+// checkSpend applies the escrow conditions to input, which spends an output under
+// these terms. Every key signing the input must be the buyer's or the seller's.
+func (e *EscrowTerms) checkSpend(tx *Transaction, input *TxInput, ctx *SpendContext) error {
+	buyer, seller := false, false
+	for _, publicKey := range input.Signers() {
+		switch address := crypto.AddressFromPublicKey(publicKey); {
+		case bytes.Equal(address, e.BuyerAddress):
+			buyer = true
+		case bytes.Equal(address, e.SellerAddress):
+			seller = true
+		default:
+			return fmt.Errorf("%w: %s is not party to the escrow", ErrInvalidSignature, address)
+		}
+	}
+
+	switch tx.Data.(type) {
+	case *EscrowReleaseTransactionData:
+		if !seller {
+			return fmt.Errorf("%w: release not signed by seller", ErrInvalidSignature)
+		}
+		if !buyer && !ctx.DeliveryConfirmed(&input.PrevOut) {
+			return fmt.Errorf("%w: delivery not confirmed", ErrEscrowLocked)
+		}
+	case *EscrowRefundTransactionData:
+		if !buyer {
+			return fmt.Errorf("%w: refund not signed by buyer", ErrInvalidSignature)
+		}
+		if !seller {
+			if ctx.Height < e.Timeout {
+				return fmt.Errorf("%w: refundable from height %d", ErrEscrowLocked, e.Timeout)
+			}
+			if ctx.DeliveryConfirmed(&input.PrevOut) {
+				return fmt.Errorf("%w: delivery confirmed", ErrEscrowLocked)
+			}
+		}
+	default:
+		return fmt.Errorf("%w: escrow spent outside a release or refund", ErrEscrowLocked)
+	}
+	return nil
+}
+
+// checkEscrowSpend checks that a release or refund spends escrow and nothing else
+func checkEscrowSpend(tx *Transaction, escrow UTXOTransactionID) error {
+	if len(tx.Inputs) != 1 || !bytes.Equal(tx.Inputs[0].PrevOut.TxID, escrow.TxID) || tx.Inputs[0].PrevOut.Index != escrow.Index {
+		return fmt.Errorf("%w: must spend escrow %s alone", ErrTransactionInvalid, escrow)
+	}
+	return nil
+}
+
+func (d *DeliveryConfirmationTransactionData) writeHash(w *hashWriter) {
+	w.writeBytes(d.Escrow.TxID)
+	w.writeInt(d.Escrow.Index)
+	w.writeBytes(d.BuyerAddress)
+}
+
+func (d *EscrowReleaseTransactionData) writeHash(w *hashWriter) {
+	w.writeBytes(d.Escrow.TxID)
+	w.writeInt(d.Escrow.Index)
+}
+
+func (d *EscrowRefundTransactionData) writeHash(w *hashWriter) {
+	w.writeBytes(d.Escrow.TxID)
+	w.writeInt(d.Escrow.Index)
+}
+
+func (d *DeliveryConfirmationTransactionData) author() ([]byte, []byte, []byte) {
+	return d.BuyerAddress, d.PublicKey, d.Signature
+}
+
+func (d *DeliveryConfirmationTransactionData) setSignature(publicKey []byte, signature []byte) {
+	d.PublicKey, d.Signature = publicKey, signature
+}
+
+// EscrowIndex records the escrows whose delivery the buyer has confirmed on chain
+type EscrowIndex struct {
+	confirmed map[string][]byte // escrow outpoint -> ID of the confirming transaction
+	Mutex     sync.RWMutex
+}
+
+func NewEscrowIndex() *EscrowIndex {
+	return &EscrowIndex{
+		confirmed: make(map[string][]byte),
+	}
+}
+
+func (ei *EscrowIndex) ConnectBlock(b *Block, height int) {
+	ei.Mutex.Lock()
+	defer ei.Mutex.Unlock()
+	for _, tx := range b.Transactions {
+		if data, ok := tx.Data.(*DeliveryConfirmationTransactionData); ok {
+			ei.confirmed[data.Escrow.String()] = tx.ID
+		}
+	}
+}
+
+func (ei *EscrowIndex) DisconnectBlock(b *Block, height int) {
+	ei.Mutex.Lock()
+	defer ei.Mutex.Unlock()
+	for _, tx := range b.Transactions {
+		if data, ok := tx.Data.(*DeliveryConfirmationTransactionData); ok {
+			delete(ei.confirmed, data.Escrow.String())
+		}
+	}
+}
+
+// Confirmed reports whether delivery of the escrow has been confirmed on chain
+func (ei *EscrowIndex) Confirmed(escrow *UTXOTransactionID) bool {
+	ei.Mutex.RLock()
+	defer ei.Mutex.RUnlock()
+	_, exists := ei.confirmed[escrow.String()]
+	return exists
+}
+
+// CheckConfirmation applies the rules for confirming delivery of an escrow, found
+// through lookup: it must be unspent, bought by the confirming buyer and not
+// confirmed already
+func (ei *EscrowIndex) CheckConfirmation(data *DeliveryConfirmationTransactionData, lookup func(id *UTXOTransactionID) (*UTXOTransaction, bool)) error {
+	utxo, exists := lookup(&data.Escrow)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrUTXONotFound, data.Escrow)
+	}
+	if utxo.Escrow == nil {
+		return fmt.Errorf("%w: %s is not an escrow", ErrTransactionInvalid, data.Escrow)
+	}
+	if !bytes.Equal(utxo.Escrow.BuyerAddress, data.BuyerAddress) {
+		return fmt.Errorf("%w: escrow %s was paid by %s", ErrInvalidSignature, data.Escrow, utxo.Escrow.BuyerAddress)
+	}
+	if ei.Confirmed(&data.Escrow) {
+		return fmt.Errorf("%w: %s", ErrEscrowConfirmed, data.Escrow)
+	}
+	return nil
+}
+
+// NewEscrowPurchaseTransaction buys productID like NewPurchaseTransaction, but pays
+// amount into escrow for the seller at address to instead of to the seller directly
+// The buyer can take the coins back from height timeout on unless delivery is confirmed.
+func NewEscrowPurchaseTransaction(w *Wallet, to string, amount int, fee int, productID string, timeout int) (*Transaction, error) {
+	escrow := &EscrowTerms{
+		SellerAddress: []byte(to),
+		Timeout:       timeout,
+	}
+	return newPurchaseTransaction(w, to, amount, fee, productID, escrow)
+}
+
+// NewDeliveryConfirmationTransaction confirms, as buyer, delivery of the purchase
+// paid into escrow
+func NewDeliveryConfirmationTransaction(w *Wallet, escrow UTXOTransactionID) (*Transaction, error) {
+	data := &DeliveryConfirmationTransactionData{
+		Escrow:       escrow,
+		BuyerAddress: w.identity(escrowRole(escrow)),
+	}
+	tx := &Transaction{
+		Type: types.TransactionTypeConfirm,
+		Data: data,
+	}
+	if err := signAuthored(tx, data, w); err != nil {
+		logger.ErrorLogger.Println("Failed to sign delivery confirmation:", err)
+		return nil, err
+	}
+
+	logger.InfoLogger.Printf("New delivery confirmation created: %x\n", tx.ID)
+	return tx, nil
+}
+
+// NewEscrowReleaseTransaction pays escrow, less fee, to the seller, signed with the
+// wallet's key. Before delivery is confirmed the buyer must cosign it as well.
+func NewEscrowReleaseTransaction(w *Wallet, escrow *UTXOTransaction, fee int) (*Transaction, error) {
+	if escrow.Escrow == nil {
+		return nil, fmt.Errorf("%w: %s is not an escrow", ErrTransactionInvalid, escrow.ID)
+	}
+	tx, err := newEscrowSpend(w, escrow, fee, types.TransactionTypeEscrowRelease, &EscrowReleaseTransactionData{Escrow: escrow.ID}, escrow.Escrow.SellerAddress)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to create escrow release:", err)
+		return nil, err
+	}
+	logger.InfoLogger.Printf("New escrow release created: %x\n", tx.ID)
+	return tx, nil
+}
+
+// NewEscrowRefundTransaction returns escrow, less fee, to the buyer, signed with the
+// wallet's key. Before the timeout the seller must cosign it as well.
+func NewEscrowRefundTransaction(w *Wallet, escrow *UTXOTransaction, fee int) (*Transaction, error) {
+	if escrow.Escrow == nil {
+		return nil, fmt.Errorf("%w: %s is not an escrow", ErrTransactionInvalid, escrow.ID)
+	}
+	tx, err := newEscrowSpend(w, escrow, fee, types.TransactionTypeEscrowRefund, &EscrowRefundTransactionData{Escrow: escrow.ID}, escrow.Escrow.BuyerAddress)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to create escrow refund:", err)
+		return nil, err
+	}
+	logger.InfoLogger.Printf("New escrow refund created: %x\n", tx.ID)
+	return tx, nil
+}
+
+func newEscrowSpend(w *Wallet, escrow *UTXOTransaction, fee int, txType types.TransactionType, data TransactionData, to []byte) (*Transaction, error) {
+	if fee < 0 || fee >= escrow.Amount {
+		return nil, fmt.Errorf("%w: fee %d of escrow %d", ErrTransactionInvalid, fee, escrow.Amount)
+	}
+	tx := &Transaction{
+		Type:    txType,
+		Inputs:  []TxInput{{PrevOut: escrow.ID}},
+		Outputs: []TxOutput{{Address: to, Amount: escrow.Amount - fee}},
+		Data:    data,
+	}
+	key, err := w.signingKey(w.identity(escrowRole(escrow.ID)))
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Sign(key.PrivateKey); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// CosignTransaction adds the wallet's signature to input i of a transaction
+// another party has signed, such as a joint escrow release or refund
+func (w *Wallet) CosignTransaction(tx *Transaction, i int) error {
+	if i < 0 || i >= len(tx.Inputs) {
+		return fmt.Errorf("%w: no input %d", ErrTransactionInvalid, i)
+	}
+	key, err := w.signingKey(w.identity(escrowRole(tx.Inputs[i].PrevOut)))
+	if err != nil {
+		return err
+	}
+	return tx.Cosign(i, key.PrivateKey)
+}
@@ -0,0 +1,160 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"trustify/types"
+)
+
+// escrowParties is a chain on which buyer has paid 10 for a product of seller's into
+// an escrow that times out at timeout
+type escrowParties struct {
+	chain                  *swapChain
+	buyer, seller, outside *Wallet
+	escrow                 *UTXOTransaction
+	timeout                int
+}
+
+func newEscrowParties(t *testing.T) *escrowParties {
+	t.Helper()
+	buyer, seller, outside := newTestWallet(t), newTestWallet(t), newTestWallet(t)
+	chain := newSwapChain(t, buyer, seller)
+	chain.mustMine(newTestListing(t, seller, "p"))
+
+	timeout := chain.bc.Height() + 5
+	purchase, err := NewEscrowPurchaseTransaction(buyer, string(seller.BitcoinAddress), 10, 1, "p", timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain.mustMine(purchase)
+	escrows := chain.bc.UTXOSet.GetEscrows(buyer.BitcoinAddress)
+	if len(escrows) != 1 {
+		t.Fatalf("%d escrows for the buyer, want 1", len(escrows))
+	}
+	return &escrowParties{chain: chain, buyer: buyer, seller: seller, outside: outside, escrow: escrows[0], timeout: timeout}
+}
+
+func (p *escrowParties) confirm(t *testing.T) {
+	t.Helper()
+	tx, err := NewDeliveryConfirmationTransaction(p.buyer, p.escrow.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.chain.mustMine(tx)
+}
+
+func TestEscrowSpends(t *testing.T) {
+	release := func(p *escrowParties) (*Transaction, error) {
+		return NewEscrowReleaseTransaction(p.seller, p.escrow, 1)
+	}
+	refund := func(p *escrowParties) (*Transaction, error) {
+		return NewEscrowRefundTransaction(p.buyer, p.escrow, 1)
+	}
+	tests := []struct {
+		name      string
+		spend     func(p *escrowParties) (*Transaction, error)
+		cosigner  func(p *escrowParties) *Wallet
+		confirmed bool
+		timedOut  bool
+		want      error
+	}{
+		{name: "joint release", spend: release, cosigner: func(p *escrowParties) *Wallet { return p.buyer }},
+		{name: "joint refund", spend: refund, cosigner: func(p *escrowParties) *Wallet { return p.seller }},
+		{name: "seller release after confirmation", spend: release, confirmed: true},
+		{name: "seller release after confirmation and timeout", spend: release, confirmed: true, timedOut: true},
+		{name: "buyer refund after timeout", spend: refund, timedOut: true},
+
+		{name: "seller release without confirmation", spend: release, want: ErrEscrowLocked},
+		{name: "seller release without confirmation after timeout", spend: release, timedOut: true, want: ErrEscrowLocked},
+		{name: "buyer refund before timeout", spend: refund, want: ErrEscrowLocked},
+		{name: "buyer refund after confirmation", spend: refund, confirmed: true, timedOut: true, want: ErrEscrowLocked},
+		{name: "release by the buyer", spend: func(p *escrowParties) (*Transaction, error) {
+			return newEscrowSpend(p.buyer, p.escrow, 1, types.TransactionTypeEscrowRelease, &EscrowReleaseTransactionData{Escrow: p.escrow.ID}, p.escrow.Escrow.SellerAddress)
+		}, confirmed: true, want: ErrInvalidSignature},
+		{name: "refund by the seller", spend: func(p *escrowParties) (*Transaction, error) {
+			return newEscrowSpend(p.seller, p.escrow, 1, types.TransactionTypeEscrowRefund, &EscrowRefundTransactionData{Escrow: p.escrow.ID}, p.escrow.Escrow.BuyerAddress)
+		}, timedOut: true, want: ErrInvalidSignature},
+		{name: "release cosigned by an outsider", spend: release, cosigner: func(p *escrowParties) *Wallet { return p.outside }, want: ErrInvalidSignature},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newEscrowParties(t)
+			if test.confirmed {
+				p.confirm(t)
+			}
+			if test.timedOut {
+				p.chain.mineTo(p.timeout - 1)
+			} else if p.chain.bc.Height()+1 >= p.timeout {
+				t.Fatalf("next block %d is past the timeout %d", p.chain.bc.Height()+1, p.timeout)
+			}
+			tx, err := test.spend(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.cosigner != nil {
+				if err := test.cosigner(p).CosignTransaction(tx, 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err = p.chain.mine(tx)
+			if test.want == nil && err != nil {
+				t.Fatal(err)
+			}
+			if !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+			if test.want != nil {
+				return
+			}
+			if _, exists := p.chain.bc.UTXOSet.Get(&p.escrow.ID); exists {
+				t.Error("escrow still unspent")
+			}
+		})
+	}
+}
+
+func TestEscrowCheckConfirmation(t *testing.T) {
+	p := newEscrowParties(t)
+	lookup := func(id *UTXOTransactionID) (*UTXOTransaction, bool) { return p.chain.bc.UTXOSet.Get(id) }
+	paid := p.chain.bc.UTXOSet.GetAllForAddress(p.buyer.BitcoinAddress)[0]
+	tests := []struct {
+		name string
+		data *DeliveryConfirmationTransactionData
+		want error
+	}{
+		{"buyer", &DeliveryConfirmationTransactionData{Escrow: p.escrow.ID, BuyerAddress: p.buyer.BitcoinAddress}, nil},
+		{"seller", &DeliveryConfirmationTransactionData{Escrow: p.escrow.ID, BuyerAddress: p.seller.BitcoinAddress}, ErrInvalidSignature},
+		{"not an escrow", &DeliveryConfirmationTransactionData{Escrow: paid.ID, BuyerAddress: p.buyer.BitcoinAddress}, ErrTransactionInvalid},
+		{"missing", &DeliveryConfirmationTransactionData{Escrow: UTXOTransactionID{TxID: make([]byte, 32)}, BuyerAddress: p.buyer.BitcoinAddress}, ErrUTXONotFound},
+	}
+	for _, test := range tests {
+		if err := p.chain.bc.Escrows.CheckConfirmation(test.data, lookup); !errors.Is(err, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+
+	// Confirmed once, and no longer once the confirming block is disconnected
+	p.confirm(t)
+	confirmation := p.chain.blocks[len(p.chain.blocks)-1]
+	if err := p.chain.bc.Escrows.CheckConfirmation(tests[0].data, lookup); !errors.Is(err, ErrEscrowConfirmed) {
+		t.Errorf("got %v confirming twice", err)
+	}
+	p.chain.bc.Escrows.DisconnectBlock(confirmation, p.chain.bc.Height())
+	if p.chain.bc.Escrows.Confirmed(&p.escrow.ID) {
+		t.Error("escrow confirmed after disconnecting its confirmation")
+	}
+	if err := p.chain.bc.Escrows.CheckConfirmation(tests[0].data, lookup); err != nil {
+		t.Errorf("got %v confirming after the disconnect", err)
+	}
+}
+
+func TestNewEscrowSpendRejects(t *testing.T) {
+	p := newEscrowParties(t)
+	if _, err := NewEscrowReleaseTransaction(p.seller, p.escrow, p.escrow.Amount); !errors.Is(err, ErrTransactionInvalid) {
+		t.Errorf("got %v releasing the whole escrow as fee", err)
+	}
+	plain := &UTXOTransaction{ID: p.escrow.ID, Amount: p.escrow.Amount}
+	if _, err := NewEscrowRefundTransaction(p.buyer, plain, 1); !errors.Is(err, ErrTransactionInvalid) {
+		t.Errorf("got %v refunding an output that is not an escrow", err)
+	}
+}
@@ -0,0 +1,291 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"trustify/crypto"
+	"trustify/logger"
+)
+
+// An HD wallet derives all of its keys from a mnemonic, along the BIP-44 account
+// path hdAccountPath: receive addresses on chain 0 below it and change addresses on
+// chain 1. Each transaction gets a fresh receive or change address, and restoring
+// the mnemonic recovers every key the wallet used by scanning the chain with a
+// lookahead of GapLimit unused addresses on each chain.
+
+const hdAccountPath = "m/44'/0'/0'"
+
+const (
+	receiveChain = 0
+	changeChain  = 1
+)
+
+// Unused addresses derived past the last used one on each chain, when not configured
+const DefaultGapLimit = 20
+
+// WalletKey is one of the wallet's key pairs
+type WalletKey struct {
+	Address    []byte
+	PublicKey  []byte
+	PrivateKey []byte
+	// Derivation of HD keys below the account key, unset for imported keys
+	Change bool
+	Index  int
+	// Imported without its private key, to be watched only
+	Watch bool
+}
+
+// hdChain is the state of one chain of an HD wallet
+type hdChain struct {
+	key  *crypto.ExtendedKey
+	keys []*WalletKey // derived so far, by index
+	next int          // next index handed out as a fresh address
+}
+
+// NewHDWallet restores the wallet of mnemonic and passphrase. Its identity, used
+// to list products and as the default signer, is the first receive address.
+func NewHDWallet(mnemonic string, passphrase string, gapLimit int) (*Wallet, error) {
+	account, err := hdAccount(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newHDWallet(account, gapLimit)
+	if err != nil {
+		return nil, err
+	}
+	w.mnemonic, w.mnemonicPassphrase = mnemonic, passphrase
+	logger.InfoLogger.Printf("HD wallet restored with identity %s and a gap limit of %d\n", w.BitcoinAddress, w.GapLimit)
+	return w, nil
+}
+
+// newHDWallet derives the chains of the wallet below account, which derives public
+// keys only when it is a public extended key
+func newHDWallet(account *crypto.ExtendedKey, gapLimit int) (*Wallet, error) {
+	if gapLimit <= 0 {
+		gapLimit = DefaultGapLimit
+	}
+	w := NewWallet(nil, nil, nil)
+	w.GapLimit = gapLimit
+	w.account = account.Neuter()
+	for i := range w.chains {
+		key, err := account.Child(uint32(i))
+		if err != nil {
+			return nil, err
+		}
+		w.chains[i] = &hdChain{key: key}
+		if err := w.lookahead(i, 0); err != nil {
+			return nil, err
+		}
+	}
+	identity := w.chains[receiveChain]
+	identity.next = 1
+	primary := identity.keys[0]
+	w.BitcoinAddress, w.PublicKey, w.PrivateKey = primary.Address, primary.PublicKey, primary.PrivateKey
+	return w, nil
+}
+
+// AccountKey is the public extended key of an HD wallet's account, from which a
+// watch-only wallet derives the same addresses, see NewWatchOnlyHDWallet
+func (w *Wallet) AccountKey() (string, bool) {
+	if w.account == nil {
+		return "", false
+	}
+	return w.account.String(), true
+}
+
+// hdAccount derives the account key of mnemonic and passphrase
+func hdAccount(mnemonic string, passphrase string) (*crypto.ExtendedKey, error) {
+	seed, err := crypto.MnemonicSeed(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	master, err := crypto.NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	path, err := crypto.ParsePath(hdAccountPath)
+	if err != nil {
+		return nil, err
+	}
+	return master.Derive(path)
+}
+
+// IsHD reports whether the wallet derives its keys from a mnemonic
+func (w *Wallet) IsHD() bool {
+	return w.chains[receiveChain] != nil
+}
+
+// lookahead derives the keys of chain up to GapLimit past index, the last used
+// one. The caller holds the wallet's mutex, unless the wallet is not yet shared.
+// A locked wallet derives public keys only, see Unlock.
+func (w *Wallet) lookahead(chain int, index int) error {
+	c := w.chains[chain]
+	for len(c.keys) <= index+w.GapLimit {
+		child, err := c.key.Child(uint32(len(c.keys)))
+		if err != nil {
+			return err
+		}
+		key := &WalletKey{
+			Address:    crypto.AddressFromPublicKey(child.PublicKey),
+			PublicKey:  child.PublicKey,
+			PrivateKey: child.PrivateKey,
+			Change:     chain == changeChain,
+			Index:      len(c.keys),
+		}
+		w.Keys[string(key.Address)] = key
+		c.keys = append(c.keys, key)
+	}
+	return nil
+}
+
+// markUsed records that the key at address received coins, moving the lookahead
+// of its chain along. The caller holds the wallet's mutex.
+func (w *Wallet) markUsed(address []byte) {
+	key := w.Keys[string(address)]
+	if key == nil || !w.IsHD() {
+		return
+	}
+	chain := receiveChain
+	if key.Change {
+		chain = changeChain
+	}
+	c := w.chains[chain]
+	if key.Index >= c.next {
+		c.next = key.Index + 1
+	}
+	if err := w.lookahead(chain, key.Index); err != nil {
+		logger.ErrorLogger.Println("Failed to derive wallet keys:", err)
+	}
+}
+
+// freshAddress hands out the next unused address of chain
+func (w *Wallet) freshAddress(chain int) ([]byte, error) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	c := w.chains[chain]
+	index := c.next
+	if err := w.lookahead(chain, index); err != nil {
+		return nil, err
+	}
+	c.next++
+	return c.keys[index].Address, nil
+}
+
+// NewReceiveAddress returns a fresh address to be paid at. A wallet without a
+// mnemonic has only its own address.
+func (w *Wallet) NewReceiveAddress() ([]byte, error) {
+	if !w.IsHD() {
+		return w.BitcoinAddress, nil
+	}
+	return w.freshAddress(receiveChain)
+}
+
+// ChangeAddress returns the address change is returned to, a fresh one for each
+// transaction of an HD wallet
+func (w *Wallet) ChangeAddress() ([]byte, error) {
+	if !w.IsHD() {
+		return w.BitcoinAddress, nil
+	}
+	return w.freshAddress(changeChain)
+}
+
+// Addresses lists the addresses of the wallet's keys
+func (w *Wallet) Addresses() [][]byte {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	addresses := make([][]byte, 0, len(w.Keys))
+	for _, key := range w.Keys {
+		addresses = append(addresses, key.Address)
+	}
+	return addresses
+}
+
+// isDerived reports whether key was derived from the wallet's mnemonic
+func (w *Wallet) isDerived(key *WalletKey) bool {
+	c := w.chains[receiveChain]
+	if key.Change {
+		c = w.chains[changeChain]
+	}
+	return c != nil && key.Index < len(c.keys) && c.keys[key.Index] == key
+}
+
+// keyFor returns the wallet's key of address, or the identity key when the wallet
+// has none
+func (w *Wallet) keyFor(address []byte) *WalletKey {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	if key, exists := w.Keys[string(address)]; exists {
+		return key
+	}
+	return w.Keys[string(w.BitcoinAddress)]
+}
+
+// keyByHash returns a copy of the wallet's key with the public key hash pubKeyHash
+func (w *Wallet) keyByHash(pubKeyHash []byte) (*WalletKey, bool) {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	for _, key := range w.Keys {
+		if bytes.Equal(crypto.PublicKeyHash(key.PublicKey), pubKeyHash) {
+			copied := *key
+			return &copied, true
+		}
+	}
+	return nil, false
+}
+
+// ownerOf returns the address of the wallet's output spent by input, or the
+// identity address when the output is not the wallet's
+func (w *Wallet) ownerOf(input TxInput) []byte {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	for _, utxo := range w.UTXOs {
+		if bytes.Equal(utxo.ID.TxID, input.PrevOut.TxID) && utxo.ID.Index == input.PrevOut.Index {
+			return utxo.Address
+		}
+	}
+	return w.BitcoinAddress
+}
+
+// identity returns the wallet's address recorded under role, such as the buyer of
+// a product, or the identity address when there is none
+func (w *Wallet) identity(role string) []byte {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	if address, exists := w.roles[role]; exists {
+		return address
+	}
+	return w.BitcoinAddress
+}
+
+// recordRoles remembers which of the wallet's addresses acted in tx, so later
+// transactions about the same purchase, review or escrow are signed by it. The
+// caller holds the wallet's mutex.
+func (w *Wallet) recordRoles(tx *Transaction) {
+	switch data := tx.Data.(type) {
+	case *PurchaseTransactionData:
+		if w.owns(data.BuyerAddress) {
+			w.roles[purchaseRole(data.ProductID)] = data.BuyerAddress
+		}
+	case *ReviewTransactionData:
+		if w.owns(data.ReviewerAddress) {
+			w.roles[reviewRole(tx.ID)] = data.ReviewerAddress
+		}
+	}
+	for i, output := range tx.Outputs {
+		if output.Escrow == nil {
+			continue
+		}
+		id := UTXOTransactionID{TxID: tx.ID, Index: i}
+		if w.owns(output.Escrow.BuyerAddress) {
+			w.roles[escrowRole(id)] = output.Escrow.BuyerAddress
+		} else if w.owns(output.Escrow.SellerAddress) {
+			w.roles[escrowRole(id)] = output.Escrow.SellerAddress
+		}
+	}
+}
+
+func purchaseRole(productID string) string { return "purchase:" + productID }
+
+func reviewRole(reviewID []byte) string { return fmt.Sprintf("review:%x", reviewID) }
+
+func escrowRole(id UTXOTransactionID) string { return "escrow:" + id.String() }
@@ -0,0 +1,235 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"trustify/crypto"
+	"trustify/logger"
+	"trustify/types"
+)
+
+// HTLCTerms are a hash time-locked contract: the recipient may spend the output by
+// revealing the preimage of Hash, and from block Timeout on the refund key may take
+// it back. An HTLC is an ordinary script output, see HTLCTerms.Script.
+//
+// An atomic swap between two chains uses one HTLC on each with the same Hash. The
+// initiator, who knows the preimage, locks coins to the participant on one chain
+// with the longer Timeout; the participant locks coins to the initiator on the other
+// chain with a shorter one. Redeeming the participant's HTLC reveals the preimage,
+// which the participant reads from the redeeming transaction to redeem the
+// initiator's. If either stops, both refund once their timeouts pass.
+type HTLCTerms struct {
+	Hash          []byte // SHA-256 of the preimage
+	RecipientHash []byte // public key hash of the key redeeming with the preimage
+	RefundHash    []byte // public key hash of the key refunding after Timeout
+	Timeout       int    // height from which the refund is possible
+}
+
+// Length in bytes of the swap secrets NewSwapSecret generates
+const SwapSecretSize = 32
+
+// Script is the locking script of the HTLC:
+//
+//	OP_IF
+//	    OP_SHA256 <Hash> OP_EQUALVERIFY OP_DUP OP_HASH160 <RecipientHash>
+//	OP_ELSE
+//	    <Timeout> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <RefundHash>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+func (h *HTLCTerms) Script() []byte {
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SHA256).AddData(h.Hash).AddOp(OP_EQUALVERIFY, OP_DUP, OP_HASH160).AddData(h.RecipientHash).
+		AddOp(OP_ELSE).
+		AddInt(int64(h.Timeout)).AddOp(OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_DUP, OP_HASH160).AddData(h.RefundHash).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY, OP_CHECKSIG).
+		Script()
+}
+
+// Address is the script address the HTLC output pays
+func (h *HTLCTerms) Address() []byte {
+	return crypto.ScriptAddress(h.Script())
+}
+
+func (h *HTLCTerms) check() error {
+	if len(h.Hash) != sha256.Size {
+		return fmt.Errorf("%w: HTLC hash of %d bytes", ErrTransactionInvalid, len(h.Hash))
+	}
+	if len(h.RecipientHash) != 20 || len(h.RefundHash) != 20 {
+		return fmt.Errorf("%w: HTLC key hashes must be 20 bytes", ErrTransactionInvalid)
+	}
+	if h.Timeout <= 0 || h.Timeout >= LockTimeThreshold {
+		return fmt.Errorf("%w: HTLC timeout must be a block height, not %d", ErrTransactionInvalid, h.Timeout)
+	}
+	return nil
+}
+
+// ParseHTLC recognizes the locking script of an HTLC and returns its terms
+func ParseHTLC(script []byte) (*HTLCTerms, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 17 {
+		return nil, false
+	}
+	h := &HTLCTerms{Hash: ops[2].Data, RecipientHash: ops[6].Data, RefundHash: ops[13].Data}
+	timeout, err := decodeScriptNum(ops[8].Data)
+	if ops[8].Opcode >= OP_1 && ops[8].Opcode <= OP_16 {
+		timeout, err = int64(ops[8].Opcode-OP_1+1), nil
+	}
+	if err != nil {
+		return nil, false
+	}
+	h.Timeout = int(timeout)
+	if h.check() != nil || !bytes.Equal(h.Script(), script) {
+		return nil, false
+	}
+	return h, true
+}
+
+// HTLC returns the terms of the output if it is an HTLC
+func (utxo *UTXOTransaction) HTLC() (*HTLCTerms, bool) {
+	if utxo.LockingScript == nil {
+		return nil, false
+	}
+	return ParseHTLC(utxo.LockingScript)
+}
+
+// GetHTLCs returns the unspent HTLC outputs that publicKey may redeem or refund
+func (u *UTXOSet) GetHTLCs(publicKey []byte) []*UTXOTransaction {
+	pubKeyHash := crypto.PublicKeyHash(publicKey)
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+	var utxos []*UTXOTransaction
+	for _, utxo := range u.UTXOs {
+		if h, ok := utxo.HTLC(); ok && (bytes.Equal(h.RecipientHash, pubKeyHash) || bytes.Equal(h.RefundHash, pubKeyHash)) {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos
+}
+
+// NewSwapSecret returns a random preimage and its hash, for the initiator of a swap
+func NewSwapSecret() (preimage []byte, hash []byte, err error) {
+	preimage = make([]byte, SwapSecretSize)
+	if _, err := rand.Read(preimage); err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(preimage)
+	return preimage, sum[:], nil
+}
+
+// NewSwapInitiateTransaction locks amount from the wallet's UTXOs in an HTLC paying
+// recipient, the public key of the other side of the swap, against the preimage of
+// hash, and refundable to the wallet from height timeout
+func NewSwapInitiateTransaction(w *Wallet, recipient []byte, amount int, fee int, hash []byte, timeout int) (*Transaction, *HTLCTerms, error) {
+	if !crypto.ValidatePublicKey(recipient) {
+		return nil, nil, fmt.Errorf("%w: recipient %x", crypto.ErrInvalidPublicKey, recipient)
+	}
+	refund, err := w.NewReceiveAddress()
+	if err != nil {
+		return nil, nil, err
+	}
+	terms := &HTLCTerms{
+		Hash:          hash,
+		RecipientHash: crypto.PublicKeyHash(recipient),
+		RefundHash:    crypto.PublicKeyHash(w.keyFor(refund).PublicKey),
+		Timeout:       timeout,
+	}
+	if err := terms.check(); err != nil {
+		return nil, nil, err
+	}
+	output, err := NewScriptOutput(terms.Script(), amount)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx, err := NewTransferTransaction(w, []TxOutput{output}, fee, "swap")
+	if err != nil {
+		return nil, nil, err
+	}
+	logger.InfoLogger.Printf("New swap initiated in %x, refundable from height %d\n", tx.ID, timeout)
+	return tx, terms, nil
+}
+
+// NewSwapRedeemTransaction spends the HTLC output to the wallet by revealing preimage
+func NewSwapRedeemTransaction(w *Wallet, htlc *UTXOTransaction, preimage []byte, fee int) (*Transaction, error) {
+	terms, ok := htlc.HTLC()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not an HTLC", ErrTransactionInvalid, htlc.ID)
+	}
+	if sum := sha256.Sum256(preimage); !bytes.Equal(sum[:], terms.Hash) {
+		return nil, fmt.Errorf("%w: preimage does not match HTLC hash", ErrTransactionInvalid)
+	}
+	key, ok := w.keyByHash(terms.RecipientHash)
+	if !ok {
+		return nil, fmt.Errorf("%w: wallet is not the HTLC recipient", ErrInvalidSignature)
+	}
+	return newHTLCSpend(w, key, htlc, fee, "swap redeem", preimage, []byte{1})
+}
+
+// NewSwapRefundTransaction takes the HTLC output back to the wallet. It is not final
+// before the HTLC timeout, so the mempool holds it until then.
+func NewSwapRefundTransaction(w *Wallet, htlc *UTXOTransaction, fee int) (*Transaction, error) {
+	terms, ok := htlc.HTLC()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not an HTLC", ErrTransactionInvalid, htlc.ID)
+	}
+	key, ok := w.keyByHash(terms.RefundHash)
+	if !ok {
+		return nil, fmt.Errorf("%w: wallet is not the HTLC refund key", ErrInvalidSignature)
+	}
+	return newHTLCSpend(w, key, htlc, fee, "swap refund", nil)
+}
+
+// newHTLCSpend pays the HTLC output less fee to a fresh address of the wallet,
+// unlocked by the signature and public key of key followed by the branch items
+func newHTLCSpend(w *Wallet, key *WalletKey, htlc *UTXOTransaction, fee int, memo string, items ...[]byte) (*Transaction, error) {
+	if fee < 0 || fee >= htlc.Amount {
+		return nil, fmt.Errorf("%w: fee %d of HTLC %d", ErrTransactionInvalid, fee, htlc.Amount)
+	}
+	to, err := w.NewReceiveAddress()
+	if err != nil {
+		return nil, err
+	}
+	tx := &Transaction{
+		Type:    types.TransactionTypeTransfer,
+		Inputs:  []TxInput{{PrevOut: htlc.ID}},
+		Outputs: []TxOutput{{Address: to, Amount: htlc.Amount - fee}},
+		Data:    &TransferTransactionData{Memo: memo},
+	}
+	if key.PrivateKey == nil {
+		return nil, ErrWalletLocked
+	}
+	signature, err := tx.ScriptSignature(key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	tx.Inputs[0].UnlockingScript = UnlockingScript(append([][]byte{signature, key.PublicKey}, items...)...)
+	logger.InfoLogger.Printf("New %s transaction created: %x\n", memo, tx.ID)
+	return tx, nil
+}
+
+// ExtractPreimage finds the swap preimage revealed by tx redeeming the HTLC output
+// htlc, which lets the other side of the swap redeem on its own chain
+func ExtractPreimage(tx *Transaction, htlc *UTXOTransaction) ([]byte, bool) {
+	terms, ok := htlc.HTLC()
+	if !ok {
+		return nil, false
+	}
+	for _, input := range tx.Inputs {
+		if !bytes.Equal(input.PrevOut.TxID, htlc.ID.TxID) || input.PrevOut.Index != htlc.ID.Index {
+			continue
+		}
+		ops, err := parseScript(input.UnlockingScript)
+		if err != nil {
+			return nil, false
+		}
+		for _, op := range ops {
+			if sum := sha256.Sum256(op.Data); op.Data != nil && bytes.Equal(sum[:], terms.Hash) {
+				return op.Data, true
+			}
+		}
+	}
+	return nil, false
+}
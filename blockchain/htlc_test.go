@@ -0,0 +1,278 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+	"trustify/config"
+	"trustify/crypto"
+)
+
+// swapChain is one of the two chains of a swap, run in-process without a network
+type swapChain struct {
+	t      *testing.T
+	bc     *Blockchain
+	miner  []byte
+	blocks []*Block
+}
+
+// newSwapChain starts a chain whose genesis block pays 1000 to funded, and follows
+// it with the wallets
+func newSwapChain(t *testing.T, funded *Wallet, wallets ...*Wallet) *swapChain {
+	t.Helper()
+	genesis := &config.ConfigGenesisBlock{
+		BlockHash:        "00",
+		PreviousHash:     "00",
+		TargetHash:       "ff",
+		Timestamp:        int(time.Now().Add(-24 * time.Hour).Unix()),
+		TransactionCount: 1,
+		Transactions: config.ConfigGenesisTransactions{
+			Outputs: []config.ConfigUTXOTransaction{{Address: string(funded.BitcoinAddress), Amount: 1000}},
+		},
+	}
+	settings := &config.ConfigBlockchainSettings{
+		TargetHash:             "ff",
+		BlockConfirmationDepth: 1,
+		CoinbaseMaturity:       1,
+		MiningReward:           50,
+	}
+	bc, err := NewBlockchain(genesis, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range append([]*Wallet{funded}, wallets...) {
+		w.CoinbaseMaturity = bc.CoinbaseMaturity
+		bc.RegisterIndex(w)
+	}
+	return &swapChain{t: t, bc: bc, miner: []byte("1BoatSLRHtKNngkdXEeobR76b53LETtpyT")}
+}
+
+// mine adds a block of txs a minute after the tip
+func (c *swapChain) mine(txs ...*Transaction) error {
+	c.t.Helper()
+	tip := c.bc.LatestBlock()
+	height := c.bc.Height() + 1
+	coinbase := NewCoinbaseTransaction(height, []TxOutput{{Address: c.miner, Amount: c.bc.BlockReward(height)}})
+	b, err := NewBlock(append([]*Transaction{coinbase}, txs...), tip.Header.BlockHash, c.bc.TargetHash)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	b.Header.Timestamp = tip.Header.Timestamp + 60
+	b.Header.BlockHash = b.ComputeHash()
+	if err := c.bc.AddBlock(b); err != nil {
+		return err
+	}
+	c.blocks = append(c.blocks, b)
+	return nil
+}
+
+func (c *swapChain) mustMine(txs ...*Transaction) {
+	c.t.Helper()
+	if err := c.mine(txs...); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// mineTo adds empty blocks up to height
+func (c *swapChain) mineTo(height int) {
+	c.t.Helper()
+	for c.bc.Height() < height {
+		c.mustMine()
+	}
+}
+
+// htlc returns the one HTLC output publicKey may spend
+func (c *swapChain) htlc(publicKey []byte) *UTXOTransaction {
+	c.t.Helper()
+	htlcs := c.bc.UTXOSet.GetHTLCs(publicKey)
+	if len(htlcs) != 1 {
+		c.t.Fatalf("%d HTLCs for the key, want 1", len(htlcs))
+	}
+	return htlcs[0]
+}
+
+// redeemer finds the transaction in the chain that spends htlc
+func (c *swapChain) redeemer(htlc *UTXOTransaction) *Transaction {
+	c.t.Helper()
+	for _, b := range c.blocks {
+		for _, tx := range b.Transactions {
+			for _, input := range tx.Inputs {
+				if bytes.Equal(input.PrevOut.TxID, htlc.ID.TxID) && input.PrevOut.Index == htlc.ID.Index {
+					return tx
+				}
+			}
+		}
+	}
+	c.t.Fatalf("HTLC %s not spent", htlc.ID)
+	return nil
+}
+
+func balance(w *Wallet) int {
+	spendable, _ := w.GetBalance()
+	return spendable
+}
+
+// swapParties returns wallets for Alice and Bob on each of the two chains, the same
+// keys on both
+func swapParties(t *testing.T) (aliceA, aliceB, bobA, bobB *Wallet) {
+	t.Helper()
+	wallets := make([]*Wallet, 4)
+	for i := 0; i < 2; i++ {
+		keys, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := crypto.AddressFromPublicKey(keys.PublicKey)
+		wallets[2*i] = NewWallet(keys.PrivateKey, keys.PublicKey, address)
+		wallets[2*i+1] = NewWallet(keys.PrivateKey, keys.PublicKey, address)
+	}
+	return wallets[0], wallets[1], wallets[2], wallets[3]
+}
+
+func TestAtomicSwapRedeem(t *testing.T) {
+	aliceA, aliceB, bobA, bobB := swapParties(t)
+	chainA := newSwapChain(t, aliceA, bobA)
+	chainB := newSwapChain(t, bobB, aliceB)
+	preimage, hash, err := NewSwapSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice, who knows the preimage, locks 300 to Bob on A with the longer timeout
+	initiateA, termsA, err := NewSwapInitiateTransaction(aliceA, bobA.PublicKey, 300, 1, hash, chainA.bc.Height()+20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainA.mustMine(initiateA)
+
+	// Bob checks her HTLC before locking 200 to her on B against the same hash
+	htlcA := chainA.htlc(bobA.PublicKey)
+	if terms, _ := htlcA.HTLC(); htlcA.Amount != 300 || !bytes.Equal(terms.Hash, hash) || !bytes.Equal(terms.RecipientHash, crypto.PublicKeyHash(bobA.PublicKey)) {
+		t.Fatalf("Alice's HTLC is %d to %x against %x", htlcA.Amount, terms.RecipientHash, terms.Hash)
+	}
+	if !bytes.Equal(termsA.Script(), htlcA.LockingScript) {
+		t.Fatal("HTLC on A does not have the terms Alice made")
+	}
+	initiateB, _, err := NewSwapInitiateTransaction(bobB, aliceB.PublicKey, 200, 1, hash, chainB.bc.Height()+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainB.mustMine(initiateB)
+
+	// Alice redeems on B, revealing the preimage
+	htlcB := chainB.htlc(aliceB.PublicKey)
+	if _, err := NewSwapRedeemTransaction(aliceB, htlcB, []byte("guess"), 1); err == nil {
+		t.Fatal("redeemed with the wrong preimage")
+	}
+	if _, err := NewSwapRedeemTransaction(bobB, htlcB, preimage, 1); err == nil {
+		t.Fatal("the refund key redeemed")
+	}
+	redeemB, err := NewSwapRedeemTransaction(aliceB, htlcB, preimage, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainB.mustMine(redeemB)
+
+	// Bob reads the preimage from chain B and redeems on A
+	revealed, found := ExtractPreimage(chainB.redeemer(htlcB), htlcB)
+	if !found || !bytes.Equal(revealed, preimage) {
+		t.Fatal("preimage not found in the redeeming transaction")
+	}
+	redeemA, err := NewSwapRedeemTransaction(bobA, htlcA, revealed, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainA.mustMine(redeemA)
+
+	if got := balance(aliceA); got != 1000-300-1 {
+		t.Errorf("Alice has %d on A", got)
+	}
+	if got := balance(bobA); got != 299 {
+		t.Errorf("Bob has %d on A", got)
+	}
+	if got := balance(bobB); got != 1000-200-1 {
+		t.Errorf("Bob has %d on B", got)
+	}
+	if got := balance(aliceB); got != 199 {
+		t.Errorf("Alice has %d on B", got)
+	}
+
+	// Once redeemed the HTLCs are gone, so they can no longer be refunded
+	chainA.mineTo(termsA.Timeout)
+	refundA, err := NewSwapRefundTransaction(aliceA, htlcA, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chainA.mine(refundA); !errors.Is(err, ErrUTXONotFound) {
+		t.Errorf("got %v refunding a redeemed HTLC", err)
+	}
+}
+
+func TestAtomicSwapRefund(t *testing.T) {
+	aliceA, aliceB, bobA, bobB := swapParties(t)
+	chainA := newSwapChain(t, aliceA, bobA)
+	chainB := newSwapChain(t, bobB, aliceB)
+	preimage, hash, err := NewSwapSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	initiateA, termsA, err := NewSwapInitiateTransaction(aliceA, bobA.PublicKey, 300, 1, hash, chainA.bc.Height()+6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainA.mustMine(initiateA)
+	initiateB, termsB, err := NewSwapInitiateTransaction(bobB, aliceB.PublicKey, 200, 1, hash, chainB.bc.Height()+3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chainB.mustMine(initiateB)
+
+	// Alice walks away, so Bob refunds on B, but not before the timeout
+	htlcB := chainB.htlc(bobB.PublicKey)
+	if _, err := NewSwapRefundTransaction(aliceB, htlcB, 1); err == nil {
+		t.Fatal("the recipient refunded")
+	}
+	refundB, err := NewSwapRefundTransaction(bobB, htlcB, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chainB.mine(refundB); !errors.Is(err, ErrTxNotFinal) {
+		t.Fatalf("got %v refunding at height %d before timeout %d", err, chainB.bc.Height()+1, termsB.Timeout)
+	}
+	chainB.mineTo(termsB.Timeout - 2)
+	if err := chainB.mine(refundB); !errors.Is(err, ErrTxNotFinal) {
+		t.Fatalf("got %v refunding in the block before the timeout", err)
+	}
+	chainB.mineTo(termsB.Timeout - 1)
+	chainB.mustMine(refundB)
+	if got := balance(bobB); got != 1000-1-1 {
+		t.Errorf("Bob has %d on B after the refund", got)
+	}
+
+	// Alice refunds on A once its longer timeout passes
+	htlcA := chainA.htlc(aliceA.PublicKey)
+	chainA.mineTo(termsA.Timeout - 2)
+	refundA, err := NewSwapRefundTransaction(aliceA, htlcA, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chainA.mine(refundA); !errors.Is(err, ErrTxNotFinal) {
+		t.Fatalf("got %v refunding on A before the timeout", err)
+	}
+	chainA.mineTo(termsA.Timeout - 1)
+	chainA.mustMine(refundA)
+	if got := balance(aliceA); got != 1000-1-1 {
+		t.Errorf("Alice has %d on A after the refund", got)
+	}
+
+	// With both refunded, the preimage redeems nothing
+	redeemA, err := NewSwapRedeemTransaction(bobA, htlcA, preimage, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := chainA.mine(redeemA); !errors.Is(err, ErrUTXONotFound) {
+		t.Errorf("got %v redeeming a refunded HTLC", err)
+	}
+}
@@ -1,58 +1,499 @@
 package blockchain
 
 import (
-	"container/heap"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
 	"sync"
+	"time"
+	"trustify/config"
+	"trustify/logger"
 )
 
-// Feel free to correct any mistakes or define new methods if needed
+// The dynamic minimum fee raised by evictions halves every mempoolFeeHalfLife
+// until it falls back under the configured minimum relay fee
+const mempoolFeeHalfLife = 10 * time.Minute
 
-type TransactionHeap []*UTXOTransaction
+type MempoolEntry struct {
+	ID   string
+	Tx   *Transaction
+	Size int
+	Fee  int
+	Time time.Time
+}
 
-func (th TransactionHeap) Len() int { return len(th) }
-func (th TransactionHeap) Less(i, j int) bool {
-	return th[i].Fee > th[j].Fee // Higher fee, higher priority
+// FeeRate is the fee paid per 1000 bytes of serialized transaction
+func (e *MempoolEntry) FeeRate() float64 {
+	return float64(e.Fee) * 1000 / float64(e.Size)
 }
-func (th TransactionHeap) Swap(i, j int) {
-	th[i], th[j] = th[j], th[i]
+
+type Mempool struct {
+	Entries         map[string]*MempoolEntry
+	MaxSize         int
+	MinRelayFee     int
+	Expiry          time.Duration
+	MaxReplacements int
+	MaxFreePending  int
+	Mutex           sync.Mutex
+
+	size          int
+	claims        map[string]string // claim -> ID of the entry holding it, see claims
+	free          map[string]int    // author -> entries spending nothing, see freeAuthor
+	rollingMinFee float64
+	lastFeeUpdate time.Time
 }
 
-func (th *TransactionHeap) Push(x interface{}) {
-	*th = append(*th, x.(*UTXOTransaction))
+func NewMempool(settings *config.ConfigMempool) *Mempool {
+	return &Mempool{
+		Entries:         make(map[string]*MempoolEntry),
+		MaxSize:         settings.MaxSize,
+		MinRelayFee:     settings.MinRelayFee,
+		Expiry:          time.Duration(settings.Expiry) * time.Second,
+		MaxReplacements: settings.MaxReplacements,
+		MaxFreePending:  settings.MaxFreePending,
+		claims:          make(map[string]string),
+		free:            make(map[string]int),
+	}
 }
 
-func (th *TransactionHeap) Pop() interface{} {
-	old := *th
-	n := len(old)
-	x := old[n-1]
-	*th = old[0 : n-1]
-	return x
+// AddTransaction admits a transaction to the pool, or returns the reason it was rejected
+// Admission may evict the lowest fee-rate entries, together with anything spending their
+// outputs, to keep the pool within MaxSize
+// A transaction spending the same outputs as replaceable entries replaces them if it
+// pays more, see replacements
+// The fee is worked out by the caller while validating the transaction's inputs
+func (mp *Mempool) AddTransaction(tx *Transaction, fee int) error {
+	mp.Mutex.Lock()
+	defer mp.Mutex.Unlock()
+	return mp.add(tx, fee, time.Now())
 }
 
-type Mempool struct {
-	Transactions *TransactionHeap
-	Mutex        sync.Mutex
+// add admits tx as though it had arrived at the given time
+func (mp *Mempool) add(tx *Transaction, fee int, arrived time.Time) error {
+	now := time.Now()
+	mp.expire(now)
+
+	entry := &MempoolEntry{
+		ID:   hex.EncodeToString(tx.ID),
+		Tx:   tx,
+		Size: len(SerializeTransaction(tx)),
+		Fee:  fee,
+		Time: arrived,
+	}
+
+	if _, exists := mp.Entries[entry.ID]; exists {
+		return ErrTxInMempool
+	}
+
+	if mp.Expiry > 0 && now.Sub(arrived) > mp.Expiry {
+		return ErrTxExpired
+	}
+
+	// Reviews and other authored transactions spend nothing and so cannot pay a fee.
+	// Instead each author may have only MaxFreePending of them in the pool.
+	if minFee := mp.minFee(now); len(tx.Inputs) > 0 && entry.FeeRate() < minFee {
+		return fmt.Errorf("%w: %.2f < %.2f per kB", ErrInsufficientFee, entry.FeeRate(), minFee)
+	}
+
+	replaced, err := mp.replacements(entry)
+	if err != nil {
+		return err
+	}
+	if author, free := freeAuthor(tx); free && mp.MaxFreePending > 0 {
+		pending := mp.free[author]
+		for _, old := range replaced {
+			if oldAuthor, oldFree := freeAuthor(old.Tx); oldFree && oldAuthor == author {
+				pending--
+			}
+		}
+		if pending >= mp.MaxFreePending {
+			return fmt.Errorf("%w: %s already has %d transactions without a fee pending", ErrInsufficientFee, author, pending)
+		}
+	}
+	for _, old := range replaced {
+		mp.remove(old)
+	}
+
+	// A transaction evicted by its own admission is rejected, and the pool left as
+	// it was, the entries it replaced included
+	rollingMinFee, lastFeeUpdate := mp.rollingMinFee, mp.lastFeeUpdate
+	mp.insert(entry)
+	evicted := mp.trim()
+
+	if _, exists := mp.Entries[entry.ID]; !exists {
+		for _, old := range append(replaced, evicted...) {
+			if old != entry {
+				mp.insert(old)
+			}
+		}
+		mp.rollingMinFee, mp.lastFeeUpdate = rollingMinFee, lastFeeUpdate
+		return ErrMempoolFull
+	}
+	for _, old := range replaced {
+		logger.InfoLogger.Printf("Transaction %s replaced by %s\n", old.ID, entry.ID)
+	}
+	for _, old := range evicted {
+		logger.InfoLogger.Printf("Evicted transaction %s from full mempool\n", old.ID)
+	}
+
+	logger.InfoLogger.Printf("Transaction %s added to mempool (%d bytes, fee %d)\n", entry.ID, entry.Size, entry.Fee)
+	return nil
+}
+
+// GetTransactions removes and returns up to count transactions, highest fee rate first
+// A transaction is never returned ahead of an in-pool transaction whose outputs it spends.
+// Transactions final rejects are time locked and stay held in the pool, as do their
+// descendants.
+func (mp *Mempool) GetTransactions(count int, final func(tx *Transaction) bool) []*Transaction {
+	// final may look up outputs in the pool, so it is asked before taking the lock.
+	// Anything added in between is left for the next call.
+	mature := make(map[string]bool)
+	for _, tx := range mp.Pending() {
+		mature[hex.EncodeToString(tx.ID)] = final(tx)
+	}
+
+	mp.Mutex.Lock()
+	defer mp.Mutex.Unlock()
+
+	mp.expire(time.Now())
+
+	sorted := mp.sortedEntries()
+	selected := make(map[string]bool)
+	var txs []*Transaction
+
+	for progress := true; progress && len(txs) < count; {
+		progress = false
+		for _, entry := range sorted {
+			if len(txs) == count {
+				break
+			}
+			if selected[entry.ID] || !mature[entry.ID] || !mp.parentsSelected(entry, selected) {
+				continue
+			}
+			selected[entry.ID] = true
+			txs = append(txs, entry.Tx)
+			progress = true
+		}
+	}
+
+	for id := range selected {
+		mp.remove(mp.Entries[id])
+	}
+	return txs
+}
+
+// Expire drops every transaction that has been waiting longer than Expiry
+func (mp *Mempool) Expire() int {
+	mp.Mutex.Lock()
+	defer mp.Mutex.Unlock()
+	return mp.expire(time.Now())
+}
+
+// MinFee is the fee rate, per 1000 bytes, a new transaction must currently pay
+func (mp *Mempool) MinFee() float64 {
+	mp.Mutex.Lock()
+	defer mp.Mutex.Unlock()
+	return mp.minFee(time.Now())
 }
 
-func NewMempool() *Mempool {
-	th := &TransactionHeap{}
-	heap.Init(th)
-	return &Mempool{Transactions: th}
+func (mp *Mempool) Contains(id string) bool {
+	mp.Mutex.Lock()
+	defer mp.Mutex.Unlock()
+	_, exists := mp.Entries[id]
+	return exists
 }
 
-func (mp *Mempool) AddTransaction(tx *UTXOTransaction) {
+// GetOutput looks up an output of a transaction still in the pool, for transactions spending it
+func (mp *Mempool) GetOutput(id *UTXOTransactionID) (*UTXOTransaction, bool) {
 	mp.Mutex.Lock()
 	defer mp.Mutex.Unlock()
-	heap.Push(mp.Transactions, tx)
+	entry, exists := mp.Entries[hex.EncodeToString(id.TxID)]
+	if !exists || id.Index < 0 || id.Index >= len(entry.Tx.Outputs) {
+		return nil, false
+	}
+	return entry.Tx.UTXOs()[id.Index], true
 }
 
-func (mp *Mempool) GetTransactions(count int) []*UTXOTransaction {
+// GetTransaction returns the pooled transaction with the given ID
+func (mp *Mempool) GetTransaction(txID []byte) (*Transaction, bool) {
 	mp.Mutex.Lock()
 	defer mp.Mutex.Unlock()
-	var txs []*UTXOTransaction
-	for i := 0; i < count && mp.Transactions.Len() > 0; i++ {
-		tx := heap.Pop(mp.Transactions).(*UTXOTransaction)
-		txs = append(txs, tx)
+	entry, exists := mp.Entries[hex.EncodeToString(txID)]
+	if !exists {
+		return nil, false
+	}
+	return entry.Tx, true
+}
+
+// Pending returns every transaction in the pool, oldest first
+func (mp *Mempool) Pending() []*Transaction {
+	mp.Mutex.Lock()
+	entries := make([]*MempoolEntry, 0, len(mp.Entries))
+	for _, entry := range mp.Entries {
+		entries = append(entries, entry)
+	}
+	mp.Mutex.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	txs := make([]*Transaction, len(entries))
+	for i, entry := range entries {
+		txs[i] = entry.Tx
 	}
 	return txs
 }
+
+func (mp *Mempool) Size() int {
+	mp.Mutex.Lock()
+	defer mp.Mutex.Unlock()
+	return mp.size
+}
+
+func (mp *Mempool) Len() int {
+	mp.Mutex.Lock()
+	defer mp.Mutex.Unlock()
+	return len(mp.Entries)
+}
+
+// replacements returns the entries a new transaction would evict: those spending any of
+// the same outputs, and their descendants. The replacement is refused unless
+//   - every directly conflicting entry opted in with Replaceable
+//   - it evicts no more than MaxReplacements transactions
+//   - it does not spend outputs of a transaction it replaces
+//   - it pays a strictly higher fee rate than each conflicting entry
+//   - its fee exceeds the total fee of all evicted entries by at least the
+//     minimum relay fee for its own size
+func (mp *Mempool) replacements(entry *MempoolEntry) ([]*MempoolEntry, error) {
+	conflicts := make(map[string]*MempoolEntry)
+	for _, claim := range claims(entry.Tx) {
+		spender, exists := mp.claims[claim]
+		if !exists {
+			continue
+		}
+		conflict := mp.Entries[spender]
+		if !conflict.Tx.Replaceable {
+			return nil, fmt.Errorf("%w: %s already claimed by %s", ErrMempoolConflict, claim, spender)
+		}
+		if entry.FeeRate() <= conflict.FeeRate() {
+			return nil, fmt.Errorf("%w: fee rate %.2f does not exceed %.2f of %s", ErrReplacementFee, entry.FeeRate(), conflict.FeeRate(), conflict.ID)
+		}
+		conflicts[spender] = conflict
+	}
+	if len(conflicts) == 0 {
+		return nil, nil
+	}
+
+	evicted := make(map[string]*MempoolEntry)
+	for _, conflict := range conflicts {
+		mp.collectDescendants(conflict, evicted)
+	}
+	if mp.MaxReplacements > 0 && len(evicted) > mp.MaxReplacements {
+		return nil, fmt.Errorf("%w: %d > %d", ErrTooManyReplacements, len(evicted), mp.MaxReplacements)
+	}
+
+	evictedFee := 0
+	replaced := make([]*MempoolEntry, 0, len(evicted))
+	for id, old := range evicted {
+		evictedFee += old.Fee
+		replaced = append(replaced, old)
+		for _, input := range entry.Tx.Inputs {
+			if hex.EncodeToString(input.PrevOut.TxID) == id {
+				return nil, fmt.Errorf("%w: spends output of replaced transaction %s", ErrMempoolConflict, id)
+			}
+		}
+	}
+
+	relayFee := mp.MinRelayFee * entry.Size / 1000
+	if entry.Fee <= evictedFee || entry.Fee < evictedFee+relayFee {
+		return nil, fmt.Errorf("%w: fee %d below %d of replaced transactions plus %d relay fee", ErrReplacementFee, entry.Fee, evictedFee, relayFee)
+	}
+	return replaced, nil
+}
+
+func (mp *Mempool) collectDescendants(entry *MempoolEntry, into map[string]*MempoolEntry) {
+	if _, seen := into[entry.ID]; seen {
+		return
+	}
+	into[entry.ID] = entry
+	for _, child := range mp.children(entry) {
+		mp.collectDescendants(child, into)
+	}
+}
+
+func (mp *Mempool) insert(entry *MempoolEntry) {
+	mp.Entries[entry.ID] = entry
+	mp.size += entry.Size
+	for _, claim := range claims(entry.Tx) {
+		mp.claims[claim] = entry.ID
+	}
+	if author, free := freeAuthor(entry.Tx); free {
+		mp.free[author]++
+	}
+}
+
+func (mp *Mempool) remove(entry *MempoolEntry) {
+	if _, exists := mp.Entries[entry.ID]; !exists {
+		return
+	}
+	delete(mp.Entries, entry.ID)
+	mp.size -= entry.Size
+	for _, claim := range claims(entry.Tx) {
+		delete(mp.claims, claim)
+	}
+	if author, free := freeAuthor(entry.Tx); free {
+		if mp.free[author]--; mp.free[author] <= 0 {
+			delete(mp.free, author)
+		}
+	}
+}
+
+// freeAuthor returns the address signing a transaction that spends nothing and so
+// pays no fee
+func freeAuthor(tx *Transaction) (string, bool) {
+	if len(tx.Inputs) > 0 {
+		return "", false
+	}
+	if data, ok := tx.Data.(authoredData); ok {
+		address, _, _ := data.author()
+		return string(address), true
+	}
+	return "", true
+}
+
+// claims lists what a transaction uses up, which no other pool entry may also use:
+// the outputs it spends, named by their outpoint, for a review, the reviewer's one
+// review of the product, for an amendment or retraction, the next revision of the
+// review, for a listing, update or delisting, the next change to the product, for
+// a delivery confirmation, the escrow's one confirmation, and for a refund, the
+// purchase's one refund
+func claims(tx *Transaction) []string {
+	var claims []string
+	for _, input := range tx.Inputs {
+		claims = append(claims, input.PrevOut.String())
+	}
+	switch data := tx.Data.(type) {
+	case *ReviewTransactionData:
+		claims = append(claims, "review:"+reviewKey(data.ReviewerAddress, data.ProductID))
+	case *ReviewAmendTransactionData:
+		claims = append(claims, fmt.Sprintf("revision:%x", data.ReviewID))
+	case *ReviewRetractTransactionData:
+		claims = append(claims, fmt.Sprintf("revision:%x", data.ReviewID))
+	case *ProductListingTransactionData:
+		claims = append(claims, "product:"+data.ProductID)
+	case *ProductUpdateTransactionData:
+		claims = append(claims, "product:"+data.ProductID)
+	case *ProductDelistTransactionData:
+		claims = append(claims, "product:"+data.ProductID)
+	case *DeliveryConfirmationTransactionData:
+		claims = append(claims, "delivery:"+data.Escrow.String())
+	case *RefundTransactionData:
+		claims = append(claims, fmt.Sprintf("refund:%x", data.PurchaseID))
+	}
+	return claims
+}
+
+// removeWithDescendants drops the entry and every entry that spends its outputs
+func (mp *Mempool) removeWithDescendants(entry *MempoolEntry) []*MempoolEntry {
+	if _, exists := mp.Entries[entry.ID]; !exists {
+		return nil
+	}
+	children := mp.children(entry)
+	mp.remove(entry)
+	removed := []*MempoolEntry{entry}
+	for _, child := range children {
+		removed = append(removed, mp.removeWithDescendants(child)...)
+	}
+	return removed
+}
+
+// Outputs of an unconfirmed transaction are referenced by its hash and output index
+func (mp *Mempool) children(entry *MempoolEntry) []*MempoolEntry {
+	var children []*MempoolEntry
+	prefix := entry.ID + ":"
+	for output, spender := range mp.claims {
+		if strings.HasPrefix(output, prefix) {
+			if child, exists := mp.Entries[spender]; exists {
+				children = append(children, child)
+			}
+		}
+	}
+	return children
+}
+
+func (mp *Mempool) parentsSelected(entry *MempoolEntry, selected map[string]bool) bool {
+	for _, input := range entry.Tx.Inputs {
+		parent := hex.EncodeToString(input.PrevOut.TxID)
+		if _, inPool := mp.Entries[parent]; inPool && !selected[parent] {
+			return false
+		}
+	}
+	return true
+}
+
+func (mp *Mempool) sortedEntries() []*MempoolEntry {
+	entries := make([]*MempoolEntry, 0, len(mp.Entries))
+	for _, entry := range mp.Entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].FeeRate() != entries[j].FeeRate() {
+			return entries[i].FeeRate() > entries[j].FeeRate()
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries
+}
+
+// trim evicts the lowest fee-rate entries until the pool fits in MaxSize, and
+// returns them
+// Every eviction raises the minimum fee above the evicted rate, so the pool
+// does not immediately refill with transactions that would be evicted again
+func (mp *Mempool) trim() []*MempoolEntry {
+	if mp.MaxSize <= 0 {
+		return nil
+	}
+	var evicted []*MempoolEntry
+	for mp.size > mp.MaxSize {
+		sorted := mp.sortedEntries()
+		lowest := sorted[len(sorted)-1]
+		rate := lowest.FeeRate()
+		evicted = append(evicted, mp.removeWithDescendants(lowest)...)
+		if bumped := rate + float64(mp.MinRelayFee); bumped > mp.rollingMinFee {
+			mp.rollingMinFee = bumped
+			mp.lastFeeUpdate = time.Now()
+		}
+	}
+	return evicted
+}
+
+func (mp *Mempool) expire(now time.Time) int {
+	if mp.Expiry <= 0 {
+		return 0
+	}
+	expired := 0
+	for _, entry := range mp.Entries {
+		if now.Sub(entry.Time) <= mp.Expiry {
+			continue
+		}
+		for _, removed := range mp.removeWithDescendants(entry) {
+			logger.InfoLogger.Printf("Transaction %s expired from mempool\n", removed.ID)
+			expired++
+		}
+	}
+	return expired
+}
+
+func (mp *Mempool) minFee(now time.Time) float64 {
+	if mp.rollingMinFee > 0 {
+		halvings := now.Sub(mp.lastFeeUpdate).Seconds() / mempoolFeeHalfLife.Seconds()
+		mp.rollingMinFee /= math.Pow(2, halvings)
+		mp.lastFeeUpdate = now
+		if mp.rollingMinFee < float64(mp.MinRelayFee)/2 {
+			mp.rollingMinFee = 0
+		}
+	}
+	return math.Max(float64(mp.MinRelayFee), mp.rollingMinFee)
+}
@@ -0,0 +1,93 @@
+package blockchain
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+	"trustify/logger"
+)
+
+// mempoolRecord is the on-disk form of a MempoolEntry
+// Size and fee are recomputed on load, only the arrival time needs keeping
+type mempoolRecord struct {
+	Tx   *Transaction
+	Time time.Time
+}
+
+// Save writes every pending transaction to path
+// The dump is written to a temporary file first so a crash never leaves a truncated dump behind
+func (mp *Mempool) Save(path string) error {
+	mp.Mutex.Lock()
+	records := make([]mempoolRecord, 0, len(mp.Entries))
+	for _, entry := range mp.Entries {
+		records = append(records, mempoolRecord{Tx: entry.Tx, Time: entry.Time})
+	}
+	mp.Mutex.Unlock()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(records); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	logger.InfoLogger.Printf("Saved %d mempool transactions to %s\n", len(records), path)
+	return nil
+}
+
+// Load re-admits the transactions saved at path, oldest first so that parents are
+// back in the pool before the transactions spending them
+// Each transaction must pass validate, which returns its fee, and the normal admission
+// policy again, since the chain may have moved on while the node was down. Rejected
+// transactions are logged and dropped. A missing dump is not an error.
+func (mp *Mempool) Load(path string, validate func(tx *Transaction) (int, error)) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var records []mempoolRecord
+	if err := gob.NewDecoder(file).Decode(&records); err != nil {
+		return 0, err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+
+	restored := 0
+	for _, record := range records {
+		fee, err := validate(record.Tx)
+		if err != nil {
+			logger.InfoLogger.Printf("Dropped saved transaction %x: %v\n", record.Tx.ID, err)
+			continue
+		}
+		mp.Mutex.Lock()
+		err = mp.add(record.Tx, fee, record.Time)
+		mp.Mutex.Unlock()
+		if err != nil {
+			logger.InfoLogger.Printf("Dropped saved transaction %x: %v\n", record.Tx.ID, err)
+			continue
+		}
+		restored++
+	}
+
+	logger.InfoLogger.Printf("Restored %d of %d saved mempool transactions from %s\n", restored, len(records), path)
+	return restored, nil
+}
@@ -0,0 +1,181 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"trustify/config"
+	"trustify/crypto"
+	"trustify/types"
+)
+
+func newTestWallet(t *testing.T) *Wallet {
+	t.Helper()
+	keys, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWallet(keys.PrivateKey, keys.PublicKey, crypto.AddressFromPublicKey(keys.PublicKey))
+}
+
+func newTestListing(t *testing.T, w *Wallet, productID string) *Transaction {
+	t.Helper()
+	metadata := sha256.Sum256([]byte(productID))
+	tx, err := NewProductListingTransaction(w, productID, metadata[:], 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+func TestMempoolLimitsFreeTransactionsPerAuthor(t *testing.T) {
+	mp := NewMempool(&config.ConfigMempool{MinRelayFee: 1, MaxFreePending: 2})
+	alice, bob := newTestWallet(t), newTestWallet(t)
+
+	for i := 0; i < 2; i++ {
+		if err := mp.AddTransaction(newTestListing(t, alice, fmt.Sprintf("alice-%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mp.AddTransaction(newTestListing(t, alice, "alice-2"), 0); !errors.Is(err, ErrInsufficientFee) {
+		t.Fatalf("got %v for a third free transaction", err)
+	}
+	if err := mp.AddTransaction(newTestListing(t, bob, "bob-0"), 0); err != nil {
+		t.Fatalf("got %v for another author", err)
+	}
+
+	// Mining frees the author's slots
+	all := func(*Transaction) bool { return true }
+	if txs := mp.GetTransactions(10, all); len(txs) != 3 {
+		t.Fatalf("mined %d transactions, want 3", len(txs))
+	}
+	if err := mp.AddTransaction(newTestListing(t, alice, "alice-2"), 0); err != nil {
+		t.Fatalf("got %v once the pool emptied", err)
+	}
+}
+
+func TestMempoolFreeTransactionsUnlimited(t *testing.T) {
+	mp := NewMempool(&config.ConfigMempool{MinRelayFee: 1})
+	alice := newTestWallet(t)
+	for i := 0; i < 10; i++ {
+		if err := mp.AddTransaction(newTestListing(t, alice, fmt.Sprintf("alice-%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestTransfer spends output 0 of the transaction prev, with a memo of memoSize bytes
+func newTestTransfer(prev byte, memoSize int, replaceable bool) *Transaction {
+	tx := &Transaction{
+		Type:        types.TransactionTypeTransfer,
+		Inputs:      []TxInput{{PrevOut: UTXOTransactionID{TxID: []byte{prev}, Index: 0}}},
+		Outputs:     []TxOutput{{Address: []byte("1BoatSLRHtKNngkdXEeobR76b53LETtpyT"), Amount: 10}},
+		Data:        &TransferTransactionData{Memo: strings.Repeat("m", memoSize)},
+		Replaceable: replaceable,
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func TestMempoolKeepsReplacedWhenReplacementEvicted(t *testing.T) {
+	original := newTestTransfer(1, 0, true)
+	other := newTestTransfer(2, 0, false)
+	replacement := newTestTransfer(1, 2000, false)
+	size := func(tx *Transaction) int { return len(SerializeTransaction(tx)) }
+
+	// The pool holds exactly the original and a transaction paying a far higher rate,
+	// and the replacement pays more than the original but is too big to fit besides it
+	mp := NewMempool(&config.ConfigMempool{MinRelayFee: 1, MaxSize: size(original) + size(other)})
+	if err := mp.AddTransaction(original, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.AddTransaction(other, 100000); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.AddTransaction(replacement, 1000); !errors.Is(err, ErrMempoolFull) {
+		t.Fatalf("got %v adding a replacement that does not fit", err)
+	}
+	for _, tx := range []*Transaction{original, other} {
+		if !mp.Contains(fmt.Sprintf("%x", tx.ID)) {
+			t.Errorf("transaction %x lost", tx.ID)
+		}
+	}
+	if mp.Contains(fmt.Sprintf("%x", replacement.ID)) {
+		t.Error("replacement kept")
+	}
+	if mp.Size() != size(original)+size(other) || mp.MinFee() != 1 {
+		t.Errorf("pool of %d bytes with minimum fee %.2f after the rejection", mp.Size(), mp.MinFee())
+	}
+
+	// The original still holds its claim on the output
+	if err := mp.AddTransaction(newTestTransfer(1, 0, false), 5); !errors.Is(err, ErrReplacementFee) {
+		t.Errorf("got %v spending the original's output again", err)
+	}
+}
+
+func TestMempoolSaveLoad(t *testing.T) {
+	alice, bob, carol := newTestWallet(t), newTestWallet(t), newTestWallet(t)
+	chain := newSwapChain(t, alice)
+	settings := &config.ConfigMempool{MinRelayFee: 1, Expiry: 3600}
+	validate := func(mp *Mempool) func(tx *Transaction) (int, error) {
+		return func(tx *Transaction) (int, error) {
+			return chain.bc.ValidateTransaction(tx, func(id *UTXOTransactionID) (*UTXOTransaction, bool) {
+				if utxo, exists := chain.bc.UTXOSet.Get(id); exists {
+					return utxo, true
+				}
+				return mp.GetOutput(id)
+			})
+		}
+	}
+	admit := func(mp *Mempool, tx *Transaction) {
+		t.Helper()
+		fee, err := validate(mp)(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := mp.AddTransaction(tx, fee); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mp := NewMempool(settings)
+	transfer, err := NewTransferTransaction(alice, []TxOutput{{Address: bob.BitcoinAddress, Amount: 100}}, 5, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, expired := newTestListing(t, bob, "bob-1"), newTestListing(t, carol, "carol-1")
+	for _, tx := range []*Transaction{transfer, listing, expired} {
+		admit(mp, tx)
+	}
+	// The node was down long enough for one entry to expire
+	mp.Entries[fmt.Sprintf("%x", expired.ID)].Time = time.Now().Add(-2 * time.Hour)
+
+	path := filepath.Join(t.TempDir(), "mempool.dat")
+	if err := mp.Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Meanwhile the transfer was mined, so its saved copy spends an output that is gone
+	chain.mustMine(transfer)
+
+	reloaded := NewMempool(settings)
+	restored, err := reloaded.Load(path, validate(reloaded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored != 1 || len(reloaded.Entries) != 1 || !reloaded.Contains(fmt.Sprintf("%x", listing.ID)) {
+		t.Errorf("restored %d transactions, want only the listing %x", restored, listing.ID)
+	}
+	entry := reloaded.Entries[fmt.Sprintf("%x", listing.ID)]
+	if saved := mp.Entries[fmt.Sprintf("%x", listing.ID)]; entry == nil || !entry.Time.Equal(saved.Time) || entry.Size != saved.Size {
+		t.Errorf("listing restored as %+v, saved as %+v", entry, saved)
+	}
+
+	if restored, err := NewMempool(settings).Load(filepath.Join(t.TempDir(), "missing.dat"), validate(reloaded)); err != nil || restored != 0 {
+		t.Errorf("restored %d from a missing dump: %v", restored, err)
+	}
+}
@@ -35,7 +35,7 @@ func (m *Miner) MineBlock() (*Block, error) {
 
     // // Add coinbase transaction
     // coinbaseTx := m.createCoinbaseTransaction()
-    // transactions = append([]*UTXOTransaction{coinbaseTx}, transactions...)
+    // transactions = append([]*Transaction{coinbaseTx}, transactions...)
 
     // // Create new block
     // previousHash := m.Blockchain.LatestBlock().Header.BlockHash
@@ -86,7 +86,7 @@ func (m *Miner) ProofOfWork(b *Block) {
 
 }
 
-func (m *Miner) createCoinbaseTransaction() *UTXOTransaction {
+func (m *Miner) createCoinbaseTransaction() *Transaction {
     // Create a coinbase transaction rewarding the miner
     // tx := &UTXOTransaction{
     //     ID: UTXOTransactionID{
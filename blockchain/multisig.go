@@ -0,0 +1,310 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"trustify/crypto"
+	"trustify/logger"
+	"trustify/types"
+	"unicode/utf8"
+)
+
+// MultisigTerms lock an output to Threshold signatures by distinct keys among
+// PublicKeys, as for a treasury shared by several sellers. The output pays the
+// script address of the terms.
+type MultisigTerms struct {
+	Threshold  int
+	PublicKeys [][]byte
+}
+
+// A transfer moves coins between addresses outside of any purchase, for instance
+// into or out of a multisig output. Memo is a free note from the payer.
+type TransferTransactionData struct {
+	Memo string
+}
+
+const (
+	MaxMultisigKeys = 15
+
+	// Limit in bytes on transfer memos
+	MaxMemoLength = 80
+)
+
+func init() {
+	gob.Register(&TransferTransactionData{})
+}
+
+func (d *TransferTransactionData) writeHash(w *hashWriter) {
+	w.writeString(d.Memo)
+}
+
+// NewMultisigTerms checks an m-of-n condition and returns it
+func NewMultisigTerms(threshold int, publicKeys [][]byte) (*MultisigTerms, error) {
+	m := &MultisigTerms{Threshold: threshold, PublicKeys: publicKeys}
+	if err := m.check(m.Address()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *MultisigTerms) writeHash(w *hashWriter) {
+	w.writeInt(m.Threshold)
+	w.writeInt(len(m.PublicKeys))
+	for _, publicKey := range m.PublicKeys {
+		w.writeBytes(publicKey)
+	}
+}
+
+// Address is the script address the multisig output pays, committing to the terms
+func (m *MultisigTerms) Address() []byte {
+	return crypto.MultisigAddress(m.Threshold, m.PublicKeys)
+}
+
+// Includes reports whether publicKey is one of the keys that may sign
+func (m *MultisigTerms) Includes(publicKey []byte) bool {
+	for _, key := range m.PublicKeys {
+		if bytes.Equal(key, publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// check validates the terms of an output paying address
+func (m *MultisigTerms) check(address []byte) error {
+	if len(m.PublicKeys) == 0 || len(m.PublicKeys) > MaxMultisigKeys {
+		return fmt.Errorf("%w: multisig of %d keys, at most %d", ErrTransactionInvalid, len(m.PublicKeys), MaxMultisigKeys)
+	}
+	if m.Threshold < 1 || m.Threshold > len(m.PublicKeys) {
+		return fmt.Errorf("%w: multisig threshold %d of %d keys", ErrTransactionInvalid, m.Threshold, len(m.PublicKeys))
+	}
+	seen := make(map[string]bool)
+	for _, publicKey := range m.PublicKeys {
+		if !crypto.ValidatePublicKey(publicKey) {
+			return fmt.Errorf("%w: %x", crypto.ErrInvalidPublicKey, publicKey)
+		}
+		if seen[string(publicKey)] {
+			return fmt.Errorf("%w: multisig key %x listed twice", ErrTransactionInvalid, publicKey)
+		}
+		seen[string(publicKey)] = true
+	}
+	if !bytes.Equal(address, m.Address()) {
+		return fmt.Errorf("%w: output address %s does not commit to its multisig", ErrTransactionInvalid, address)
+	}
+	return nil
+}
+
+// checkSpend requires input to be signed by at least Threshold distinct keys of
+// the terms, and by no other key
+func (m *MultisigTerms) checkSpend(input *TxInput) error {
+	signed := make(map[string]bool)
+	for _, publicKey := range input.Signers() {
+		if !m.Includes(publicKey) {
+			return fmt.Errorf("%w: %s is not a multisig key", ErrInvalidSignature, crypto.AddressFromPublicKey(publicKey))
+		}
+		signed[string(publicKey)] = true
+	}
+	if len(signed) < m.Threshold {
+		return fmt.Errorf("%w: %d of %d", ErrMissingSignatures, len(signed), m.Threshold)
+	}
+	return nil
+}
+
+// Signers lists the public keys that have signed the input, the primary signer first
+func (input *TxInput) Signers() [][]byte {
+	var signers [][]byte
+	if len(input.PublicKey) > 0 {
+		signers = append(signers, input.PublicKey)
+	}
+	for _, cosigner := range input.Cosigners {
+		signers = append(signers, cosigner.PublicKey)
+	}
+	return signers
+}
+
+// AddSignature signs input i with privKey as its primary signer, or as a cosigner if
+// it has one already. Signing twice with the same key changes nothing.
+func (tx *Transaction) AddSignature(i int, privKey []byte) error {
+	if i < 0 || i >= len(tx.Inputs) {
+		return fmt.Errorf("%w: no input %d", ErrTransactionInvalid, i)
+	}
+	pubKey, err := crypto.PublicKeyFromPrivate(privKey)
+	if err != nil {
+		return err
+	}
+	for _, signer := range tx.Inputs[i].Signers() {
+		if bytes.Equal(signer, pubKey) {
+			return nil
+		}
+	}
+	if len(tx.Inputs[i].PublicKey) == 0 {
+		return tx.SignInput(i, privKey)
+	}
+	return tx.Cosign(i, privKey)
+}
+
+// CombineSignatures merges into tx the signatures that other signers added to their
+// own copies of it, so partial signatures collected separately make one transaction
+func (tx *Transaction) CombineSignatures(others ...*Transaction) error {
+	tx.ID = tx.Hash()
+	for _, other := range others {
+		if !bytes.Equal(other.Hash(), tx.ID) || len(other.Inputs) != len(tx.Inputs) {
+			return fmt.Errorf("%w: signatures of a different transaction %x", ErrTransactionInvalid, other.ID)
+		}
+		for i := range other.Inputs {
+			input := &other.Inputs[i]
+			signatures := append([]InputSignature{{PublicKey: input.PublicKey, Signature: input.Signature}}, input.Cosigners...)
+			for _, signature := range signatures {
+				if len(signature.PublicKey) == 0 || !crypto.Verify(tx.ID, signature.Signature, signature.PublicKey) {
+					continue
+				}
+				tx.addInputSignature(i, signature)
+			}
+		}
+	}
+	return nil
+}
+
+func (tx *Transaction) addInputSignature(i int, signature InputSignature) {
+	input := &tx.Inputs[i]
+	for _, signer := range input.Signers() {
+		if bytes.Equal(signer, signature.PublicKey) {
+			return
+		}
+	}
+	if len(input.PublicKey) == 0 {
+		input.PublicKey, input.Signature = signature.PublicKey, signature.Signature
+		return
+	}
+	input.Cosigners = append(input.Cosigners, signature)
+}
+
+// SignMultisig adds the signatures of the wallet's keys to every input spending a
+// multisig output, found through lookup, that lists them, and returns how many
+// signatures it added. Watch keys, which have no private key, are skipped.
+func (w *Wallet) SignMultisig(tx *Transaction, lookup func(id *UTXOTransactionID) (*UTXOTransaction, bool)) (int, error) {
+	w.Mutex.RLock()
+	if w.locked {
+		w.Mutex.RUnlock()
+		return 0, ErrWalletLocked
+	}
+	keys := make([]WalletKey, 0, len(w.Keys))
+	for _, key := range w.Keys {
+		if key.PrivateKey != nil {
+			keys = append(keys, *key)
+		}
+	}
+	w.Mutex.RUnlock()
+
+	signed := 0
+	for i, input := range tx.Inputs {
+		utxo, exists := lookup(&input.PrevOut)
+		if !exists || utxo.Multisig == nil {
+			continue
+		}
+		for _, key := range keys {
+			if !utxo.Multisig.Includes(key.PublicKey) {
+				continue
+			}
+			before := len(tx.Inputs[i].Signers())
+			if err := tx.AddSignature(i, key.PrivateKey); err != nil {
+				return signed, err
+			}
+			signed += len(tx.Inputs[i].Signers()) - before
+		}
+	}
+	return signed, nil
+}
+
+// NewTransferTransaction pays outputs, plus fee to the miner, from the wallet's
+// UTXOs and returns the change to the wallet. Every input is signed.
+func NewTransferTransaction(w *Wallet, outputs []TxOutput, fee int, memo string) (*Transaction, error) {
+	tx, err := NewUnsignedTransferTransaction(w, outputs, fee, memo)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.SignTransaction(tx); err != nil {
+		logger.ErrorLogger.Println("Failed to sign transfer transaction:", err)
+		return nil, err
+	}
+	logger.InfoLogger.Printf("New transfer transaction created: %x\n", tx.ID)
+	return tx, nil
+}
+
+// NewUnsignedTransferTransaction builds the transfer of NewTransferTransaction
+// without signing it, for a watch-only wallet whose keys are elsewhere
+func NewUnsignedTransferTransaction(w *Wallet, outputs []TxOutput, fee int, memo string) (*Transaction, error) {
+	amount := 0
+	for _, output := range outputs {
+		amount += output.Amount
+	}
+	if len(outputs) == 0 || fee < 0 {
+		return nil, fmt.Errorf("%w: %d outputs, fee %d", ErrTransactionInvalid, len(outputs), fee)
+	}
+
+	inputs, change, err := w.CreateInputs(amount + fee)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to create inputs for transfer transaction:", err)
+		return nil, err
+	}
+	outputs = append([]TxOutput(nil), outputs...)
+	if change > 0 {
+		changeAddress, err := w.ChangeAddress()
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, TxOutput{Address: changeAddress, Amount: change})
+	}
+
+	tx := &Transaction{
+		Type:    types.TransactionTypeTransfer,
+		Inputs:  inputs,
+		Outputs: outputs,
+		Data:    &TransferTransactionData{Memo: memo},
+	}
+	tx.ID = tx.Hash()
+	return tx, nil
+}
+
+// NewMultisigOutput pays amount to a threshold of publicKeys
+func NewMultisigOutput(threshold int, publicKeys [][]byte, amount int) (TxOutput, error) {
+	terms, err := NewMultisigTerms(threshold, publicKeys)
+	if err != nil {
+		return TxOutput{}, err
+	}
+	return TxOutput{Address: terms.Address(), Amount: amount, Multisig: terms}, nil
+}
+
+// NewMultisigSpendTransaction spends the multisig utxos to outputs as an unsigned
+// transfer, leaving what the inputs hold beyond the outputs as fee. Each signer adds
+// its signature with SignMultisig, on the transaction or on a copy of it to be
+// merged with CombineSignatures.
+func NewMultisigSpendTransaction(utxos []*UTXOTransaction, outputs []TxOutput, memo string) (*Transaction, error) {
+	tx := &Transaction{
+		Type:    types.TransactionTypeTransfer,
+		Outputs: outputs,
+		Data:    &TransferTransactionData{Memo: memo},
+	}
+	total := 0
+	for _, utxo := range utxos {
+		if utxo.Multisig == nil {
+			return nil, fmt.Errorf("%w: %s is not a multisig output", ErrTransactionInvalid, utxo.ID)
+		}
+		tx.Inputs = append(tx.Inputs, TxInput{PrevOut: utxo.ID})
+		total += utxo.Amount
+	}
+	if len(tx.Inputs) == 0 || total < tx.OutputTotal() {
+		return nil, fmt.Errorf("%w: %d in multisig inputs for %d out", ErrInsufficientFunds, total, tx.OutputTotal())
+	}
+	tx.ID = tx.Hash()
+	return tx, nil
+}
+
+// checkMemo applies the limits on transfer memos
+func checkMemo(memo string) error {
+	if len(memo) > MaxMemoLength || !utf8.ValidString(memo) {
+		return fmt.Errorf("%w: memo must be at most %d bytes of UTF-8", ErrTransactionInvalid, MaxMemoLength)
+	}
+	return nil
+}
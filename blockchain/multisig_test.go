@@ -0,0 +1,45 @@
+package blockchain
+
+import (
+	"testing"
+	"trustify/crypto"
+)
+
+func TestSignMultisigSkipsWatchKeys(t *testing.T) {
+	w := newTestWallet(t)
+	watched, other := newTestWallet(t), newTestWallet(t)
+	if err := w.ImportPublicKey(watched.PublicKey, "partner"); err != nil {
+		t.Fatal(err)
+	}
+	terms, err := NewMultisigTerms(2, [][]byte{watched.PublicKey, w.PublicKey, other.PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	utxos := make(map[string]*UTXOTransaction)
+	var spent []*UTXOTransaction
+	for i := 0; i < 2; i++ {
+		utxo := &UTXOTransaction{ID: UTXOTransactionID{TxID: []byte{byte(i + 1)}}, Address: terms.Address(), Amount: 50, Multisig: terms}
+		utxos[utxo.ID.String()] = utxo
+		spent = append(spent, utxo)
+	}
+	lookup := func(id *UTXOTransactionID) (*UTXOTransaction, bool) {
+		utxo, exists := utxos[id.String()]
+		return utxo, exists
+	}
+	tx, err := NewMultisigSpendTransaction(spent, []TxOutput{{Address: crypto.AddressFromPublicKey(other.PublicKey), Amount: 90}}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if signed, err := w.SignMultisig(tx, lookup); err != nil || signed != 2 {
+		t.Fatalf("added %d signatures: %v", signed, err)
+	}
+	if signed, err := w.SignMultisig(tx, lookup); err != nil || signed != 0 {
+		t.Errorf("added %d signatures signing again: %v", signed, err)
+	}
+	for i, input := range tx.Inputs {
+		if signers := input.Signers(); len(signers) != 1 {
+			t.Errorf("input %d has %d signers", i, len(signers))
+		}
+	}
+}
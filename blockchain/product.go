@@ -0,0 +1,149 @@
+package blockchain
+
+import (
+	"encoding/gob"
+	"trustify/logger"
+	"trustify/types"
+)
+
+// Sellers register products before they can be bought. A listing claims ProductID
+// for SellerAddress, an update changes the metadata and price of a listed product and
+// a delisting stops further purchases. All three are signed by the seller like reviews.
+// MetadataHash commits to the off-chain product description by its sha256 hash.
+type ProductListingTransactionData struct {
+	ProductID     string
+	SellerAddress []byte
+	MetadataHash  []byte
+	Price         int
+	PublicKey     []byte
+	Signature     []byte
+}
+
+type ProductUpdateTransactionData struct {
+	ProductID     string
+	SellerAddress []byte
+	MetadataHash  []byte
+	Price         int
+	PublicKey     []byte
+	Signature     []byte
+}
+
+type ProductDelistTransactionData struct {
+	ProductID     string
+	SellerAddress []byte
+	PublicKey     []byte
+	Signature     []byte
+}
+
+// Limit in bytes on product IDs
+const MaxProductIDLength = 64
+
+func init() {
+	gob.Register(&ProductListingTransactionData{})
+	gob.Register(&ProductUpdateTransactionData{})
+	gob.Register(&ProductDelistTransactionData{})
+}
+
+func (d *ProductListingTransactionData) writeHash(w *hashWriter) {
+	w.writeString(d.ProductID)
+	w.writeBytes(d.SellerAddress)
+	w.writeBytes(d.MetadataHash)
+	w.writeInt(d.Price)
+}
+
+func (d *ProductUpdateTransactionData) writeHash(w *hashWriter) {
+	w.writeString(d.ProductID)
+	w.writeBytes(d.SellerAddress)
+	w.writeBytes(d.MetadataHash)
+	w.writeInt(d.Price)
+}
+
+func (d *ProductDelistTransactionData) writeHash(w *hashWriter) {
+	w.writeString(d.ProductID)
+	w.writeBytes(d.SellerAddress)
+}
+
+func (d *ProductListingTransactionData) author() ([]byte, []byte, []byte) {
+	return d.SellerAddress, d.PublicKey, d.Signature
+}
+
+func (d *ProductUpdateTransactionData) author() ([]byte, []byte, []byte) {
+	return d.SellerAddress, d.PublicKey, d.Signature
+}
+
+func (d *ProductDelistTransactionData) author() ([]byte, []byte, []byte) {
+	return d.SellerAddress, d.PublicKey, d.Signature
+}
+
+func (d *ProductListingTransactionData) setSignature(publicKey []byte, signature []byte) {
+	d.PublicKey, d.Signature = publicKey, signature
+}
+
+func (d *ProductUpdateTransactionData) setSignature(publicKey []byte, signature []byte) {
+	d.PublicKey, d.Signature = publicKey, signature
+}
+
+func (d *ProductDelistTransactionData) setSignature(publicKey []byte, signature []byte) {
+	d.PublicKey, d.Signature = publicKey, signature
+}
+
+// NewProductListingTransaction registers productID with the wallet's address as seller
+func NewProductListingTransaction(w *Wallet, productID string, metadataHash []byte, price int) (*Transaction, error) {
+	data := &ProductListingTransactionData{
+		ProductID:     productID,
+		SellerAddress: w.BitcoinAddress,
+		MetadataHash:  metadataHash,
+		Price:         price,
+	}
+	tx := &Transaction{
+		Type: types.TransactionTypeListing,
+		Data: data,
+	}
+	if err := signAuthored(tx, data, w); err != nil {
+		logger.ErrorLogger.Println("Failed to sign product listing:", err)
+		return nil, err
+	}
+
+	logger.InfoLogger.Printf("New product listing created: %x\n", tx.ID)
+	return tx, nil
+}
+
+// NewProductUpdateTransaction changes the metadata and price of the wallet's listed product
+func NewProductUpdateTransaction(w *Wallet, productID string, metadataHash []byte, price int) (*Transaction, error) {
+	data := &ProductUpdateTransactionData{
+		ProductID:     productID,
+		SellerAddress: w.BitcoinAddress,
+		MetadataHash:  metadataHash,
+		Price:         price,
+	}
+	tx := &Transaction{
+		Type: types.TransactionTypeUpdate,
+		Data: data,
+	}
+	if err := signAuthored(tx, data, w); err != nil {
+		logger.ErrorLogger.Println("Failed to sign product update:", err)
+		return nil, err
+	}
+
+	logger.InfoLogger.Printf("New product update created: %x\n", tx.ID)
+	return tx, nil
+}
+
+// NewProductDelistTransaction withdraws the wallet's listed product from sale
+func NewProductDelistTransaction(w *Wallet, productID string) (*Transaction, error) {
+	data := &ProductDelistTransactionData{
+		ProductID:     productID,
+		SellerAddress: w.BitcoinAddress,
+	}
+	tx := &Transaction{
+		Type: types.TransactionTypeDelist,
+		Data: data,
+	}
+	if err := signAuthored(tx, data, w); err != nil {
+		logger.ErrorLogger.Println("Failed to sign product delisting:", err)
+		return nil, err
+	}
+
+	logger.InfoLogger.Printf("New product delisting created: %x\n", tx.ID)
+	return tx, nil
+}
@@ -0,0 +1,167 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// ProductIndex is the registry of products listed on chain, keyed by product ID
+// Every listing, update and delisting is kept as a version so disconnecting a block
+// restores the previous state and a product's history stays queryable
+type ProductIndex struct {
+	products map[string]*ProductRecord
+	Mutex    sync.RWMutex
+}
+
+// ProductRecord is a registered product with every version of its listing
+// A product ID belongs to the seller who first listed it, even once delisted
+type ProductRecord struct {
+	ProductID     string
+	SellerAddress []byte
+	Versions      []ProductVersion // oldest first
+}
+
+type ProductVersion struct {
+	TxID         []byte
+	Height       int
+	MetadataHash []byte
+	Price        int
+	Listed       bool
+}
+
+func NewProductIndex() *ProductIndex {
+	return &ProductIndex{
+		products: make(map[string]*ProductRecord),
+	}
+}
+
+// Latest is the current version of the product
+func (r *ProductRecord) Latest() ProductVersion {
+	return r.Versions[len(r.Versions)-1]
+}
+
+func (pi *ProductIndex) ConnectBlock(b *Block, height int) {
+	pi.Mutex.Lock()
+	defer pi.Mutex.Unlock()
+	for _, tx := range b.Transactions {
+		switch data := tx.Data.(type) {
+		case *ProductListingTransactionData:
+			record, exists := pi.products[data.ProductID]
+			if !exists {
+				record = &ProductRecord{ProductID: data.ProductID, SellerAddress: data.SellerAddress}
+				pi.products[data.ProductID] = record
+			}
+			record.Versions = append(record.Versions, ProductVersion{
+				TxID:         tx.ID,
+				Height:       height,
+				MetadataHash: data.MetadataHash,
+				Price:        data.Price,
+				Listed:       true,
+			})
+		case *ProductUpdateTransactionData:
+			record := pi.products[data.ProductID]
+			record.Versions = append(record.Versions, ProductVersion{
+				TxID:         tx.ID,
+				Height:       height,
+				MetadataHash: data.MetadataHash,
+				Price:        data.Price,
+				Listed:       true,
+			})
+		case *ProductDelistTransactionData:
+			record := pi.products[data.ProductID]
+			version := record.Latest()
+			version.TxID = tx.ID
+			version.Height = height
+			version.Listed = false
+			record.Versions = append(record.Versions, version)
+		}
+	}
+}
+
+func (pi *ProductIndex) DisconnectBlock(b *Block, height int) {
+	pi.Mutex.Lock()
+	defer pi.Mutex.Unlock()
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		var productID string
+		switch data := b.Transactions[i].Data.(type) {
+		case *ProductListingTransactionData:
+			productID = data.ProductID
+		case *ProductUpdateTransactionData:
+			productID = data.ProductID
+		case *ProductDelistTransactionData:
+			productID = data.ProductID
+		default:
+			continue
+		}
+		record := pi.products[productID]
+		record.Versions = record.Versions[:len(record.Versions)-1]
+		if len(record.Versions) == 0 {
+			delete(pi.products, productID)
+		}
+	}
+}
+
+// Product returns a copy of the registered product with all its versions
+func (pi *ProductIndex) Product(productID string) (*ProductRecord, bool) {
+	pi.Mutex.RLock()
+	defer pi.Mutex.RUnlock()
+	record, exists := pi.products[productID]
+	if !exists {
+		return nil, false
+	}
+	copied := *record
+	copied.Versions = append([]ProductVersion(nil), record.Versions...)
+	return &copied, true
+}
+
+// CheckListing allows listing a new product ID, or relisting a delisted product by
+// the seller it belongs to
+func (pi *ProductIndex) CheckListing(data *ProductListingTransactionData) error {
+	pi.Mutex.RLock()
+	defer pi.Mutex.RUnlock()
+	record, exists := pi.products[data.ProductID]
+	if !exists {
+		return nil
+	}
+	if !bytes.Equal(record.SellerAddress, data.SellerAddress) {
+		return fmt.Errorf("%w: %s belongs to %s", ErrProductExists, data.ProductID, record.SellerAddress)
+	}
+	if record.Latest().Listed {
+		return fmt.Errorf("%w: %s", ErrProductExists, data.ProductID)
+	}
+	return nil
+}
+
+// CheckChange applies the rules for updating or delisting productID on behalf of
+// seller: the product must be listed, and by seller
+func (pi *ProductIndex) CheckChange(productID string, seller []byte) error {
+	pi.Mutex.RLock()
+	defer pi.Mutex.RUnlock()
+	record, exists := pi.products[productID]
+	if !exists || !record.Latest().Listed {
+		return fmt.Errorf("%w: %s", ErrProductNotListed, productID)
+	}
+	if !bytes.Equal(record.SellerAddress, seller) {
+		return fmt.Errorf("%w: %s belongs to %s", ErrProductSeller, productID, record.SellerAddress)
+	}
+	return nil
+}
+
+// CheckPurchase requires a purchase to be of a listed product, from the seller who
+// listed it and for at least its current price
+func (pi *ProductIndex) CheckPurchase(data *PurchaseTransactionData) error {
+	pi.Mutex.RLock()
+	defer pi.Mutex.RUnlock()
+	record, exists := pi.products[data.ProductID]
+	if !exists || !record.Latest().Listed {
+		return fmt.Errorf("%w: %s", ErrProductNotListed, data.ProductID)
+	}
+	if !bytes.Equal(record.SellerAddress, data.SellerAddress) {
+		return fmt.Errorf("%w: %s is sold by %s", ErrProductSeller, data.ProductID, record.SellerAddress)
+	}
+	if price := record.Latest().Price; data.Amount < price {
+		return fmt.Errorf("%w: pays %d for %s listed at %d", ErrTransactionInvalid, data.Amount, data.ProductID, price)
+	}
+	return nil
+}
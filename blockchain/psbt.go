@@ -0,0 +1,374 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"trustify/crypto"
+	"trustify/logger"
+)
+
+// A partially signed transaction carries an unsigned transaction between the
+// nodes that sign it, such as from an online watch-only node to an air-gapped one
+// holding the keys, together with the outputs its inputs spend so a signer that
+// does not follow the chain knows whose signatures they need. A signature commits
+// to the outputs but not to the amounts spent, so each input also carries the
+// transaction that created its output, which proves the amount to a signer without
+// the chain; a signer verifies every input and caps the fee before it signs.
+// Signatures collect in the inputs of the transaction itself: each signer adds its
+// own, copies signed separately are combined, and once every input is signed the
+// transaction is finalized and broadcast by any node.
+
+// PartialTransaction is a transaction being signed, with an entry in Inputs for
+// each of its inputs
+type PartialTransaction struct {
+	Tx     *Transaction
+	Inputs []PartialInput
+}
+
+// PartialInput describes the output an input spends
+type PartialInput struct {
+	UTXO *UTXOTransaction
+	// Transaction that created the output, nil when the creator did not know it
+	PrevTx *Transaction
+	// Set when the output pays an address of an HD wallet, nil otherwise
+	Origin *KeyOrigin
+}
+
+// KeyOrigin locates a key below the account key of an HD wallet, so a signer can
+// derive it even when it never handed out the address
+type KeyOrigin struct {
+	Account uint32 // fingerprint of the account key
+	Change  bool
+	Index   int
+}
+
+// Binary encodings of partial transactions start with partialMagic, followed by
+// the gob encoding of the PartialTransaction
+var partialMagic = []byte{'p', 's', 'b', 't', 0xff}
+
+// NewPartialTransaction prepares tx to be signed. The outputs it spends are found
+// among the wallet's UTXOs, which also give the origin of HD keys, or else through
+// lookup, and the transactions creating them through source. Either may be nil.
+func NewPartialTransaction(w *Wallet, tx *Transaction, lookup func(id *UTXOTransactionID) (*UTXOTransaction, bool), source func(txID []byte) (*Transaction, bool)) (*PartialTransaction, error) {
+	if tx.IsCoinbase() {
+		return nil, fmt.Errorf("%w: coinbase transactions are not signed", ErrTransactionInvalid)
+	}
+	tx.ID = tx.Hash()
+	p := &PartialTransaction{Tx: tx, Inputs: make([]PartialInput, len(tx.Inputs))}
+	for i, input := range tx.Inputs {
+		utxo, origin := w.partialInput(input.PrevOut)
+		if utxo == nil && lookup != nil {
+			utxo, _ = lookup(&input.PrevOut)
+		}
+		if utxo == nil {
+			return nil, fmt.Errorf("%w: %s", ErrUTXONotFound, input.PrevOut)
+		}
+		copied := *utxo
+		p.Inputs[i] = PartialInput{UTXO: &copied, Origin: origin}
+		if source != nil {
+			if prevTx, found := source(input.PrevOut.TxID); found {
+				p.Inputs[i].PrevTx = prevTx
+			}
+		}
+	}
+	return p, nil
+}
+
+// NewPartialTransferTransaction builds the transfer of NewUnsignedTransferTransaction
+// as a partial transaction, for a watch-only wallet to have it signed elsewhere.
+// source finds the transactions that created the outputs spent.
+func NewPartialTransferTransaction(w *Wallet, outputs []TxOutput, fee int, memo string, source func(txID []byte) (*Transaction, bool)) (*PartialTransaction, error) {
+	tx, err := NewUnsignedTransferTransaction(w, outputs, fee, memo)
+	if err != nil {
+		return nil, err
+	}
+	p, err := NewPartialTransaction(w, tx, nil, source)
+	if err != nil {
+		return nil, err
+	}
+	logger.InfoLogger.Printf("New partial transfer transaction created: %x\n", tx.ID)
+	return p, nil
+}
+
+// partialInput returns a copy of the wallet's output id with the origin of the key
+// it pays, or nil when the output is not the wallet's
+func (w *Wallet) partialInput(id UTXOTransactionID) (*UTXOTransaction, *KeyOrigin) {
+	if w == nil {
+		return nil, nil
+	}
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	for _, utxo := range w.UTXOs {
+		if !bytes.Equal(utxo.ID.TxID, id.TxID) || utxo.ID.Index != id.Index {
+			continue
+		}
+		key := w.Keys[string(utxo.Address)]
+		if key == nil || w.account == nil || !w.isDerived(key) {
+			return utxo, nil
+		}
+		return utxo, &KeyOrigin{Account: w.account.Fingerprint(), Change: key.Change, Index: key.Index}
+	}
+	return nil, nil
+}
+
+// check verifies that the inputs describe the outputs the transaction spends
+func (p *PartialTransaction) check() error {
+	if p.Tx == nil || len(p.Inputs) != len(p.Tx.Inputs) {
+		return fmt.Errorf("%w: inputs do not match the transaction", ErrInvalidPartialTransaction)
+	}
+	if !bytes.Equal(p.Tx.ID, p.Tx.Hash()) {
+		return fmt.Errorf("%w: transaction ID %x does not match its hash", ErrInvalidPartialTransaction, p.Tx.ID)
+	}
+	for i, input := range p.Inputs {
+		prevOut := p.Tx.Inputs[i].PrevOut
+		if input.UTXO == nil || !bytes.Equal(input.UTXO.ID.TxID, prevOut.TxID) || input.UTXO.ID.Index != prevOut.Index {
+			return fmt.Errorf("%w: input %d does not describe %s", ErrInvalidPartialTransaction, i, prevOut)
+		}
+	}
+	return nil
+}
+
+// verifyInput checks that input i describes the output it spends as created by
+// its previous transaction, or else as held by the wallet
+func (p *PartialTransaction) verifyInput(i int, w *Wallet) error {
+	input := p.Inputs[i]
+	prevOut := p.Tx.Inputs[i].PrevOut
+	var known *UTXOTransaction
+	if input.PrevTx != nil {
+		if !bytes.Equal(input.PrevTx.Hash(), prevOut.TxID) || prevOut.Index < 0 || prevOut.Index >= len(input.PrevTx.Outputs) {
+			return fmt.Errorf("%w: previous transaction of input %d does not create %s", ErrInvalidPartialTransaction, i, prevOut)
+		}
+		known = &UTXOTransaction{ID: prevOut, Coinbase: input.PrevTx.IsCoinbase()}
+		known.setOutput(input.PrevTx.Outputs[prevOut.Index])
+	} else if known, _ = w.partialInput(prevOut); known == nil {
+		return fmt.Errorf("%w: input %d spends %s, which neither the wallet nor a previous transaction shows", ErrInvalidPartialTransaction, i, prevOut)
+	}
+	if !sameOutput(known, input.UTXO) {
+		return fmt.Errorf("%w: input %d misdescribes %s", ErrInvalidPartialTransaction, i, prevOut)
+	}
+	return nil
+}
+
+// output returns the transaction output utxo was created from
+func (utxo *UTXOTransaction) output() TxOutput {
+	return TxOutput{
+		Address:       utxo.Address,
+		Amount:        utxo.Amount,
+		Escrow:        utxo.Escrow,
+		Multisig:      utxo.Multisig,
+		LockingScript: utxo.LockingScript,
+		LockHeight:    utxo.LockHeight,
+		LockTime:      utxo.LockTime,
+	}
+}
+
+func (utxo *UTXOTransaction) setOutput(output TxOutput) {
+	utxo.Address, utxo.Amount, utxo.Escrow, utxo.Multisig = output.Address, output.Amount, output.Escrow, output.Multisig
+	utxo.LockingScript, utxo.LockHeight, utxo.LockTime = output.LockingScript, output.LockHeight, output.LockTime
+}
+
+// sameOutput compares the outputs in their canonical transaction encoding, which
+// does not tell nil from empty fields apart as the encodings of partial
+// transactions do not
+func sameOutput(a, b *UTXOTransaction) bool {
+	txA := Transaction{Outputs: []TxOutput{a.output()}}
+	txB := Transaction{Outputs: []TxOutput{b.output()}}
+	return a.Coinbase == b.Coinbase && bytes.Equal(txA.Hash(), txB.Hash())
+}
+
+// signers lists the addresses whose keys may sign input i
+// Script outputs are unlocked by their scripts, which a signer completes on its own.
+func (p *PartialTransaction) signers(i int) [][]byte {
+	utxo := p.Inputs[i].UTXO
+	switch {
+	case utxo.LockingScript != nil:
+		return nil
+	case utxo.Escrow != nil:
+		return [][]byte{utxo.Escrow.BuyerAddress, utxo.Escrow.SellerAddress}
+	case utxo.Multisig != nil:
+		addresses := make([][]byte, len(utxo.Multisig.PublicKeys))
+		for j, publicKey := range utxo.Multisig.PublicKeys {
+			addresses[j] = crypto.AddressFromPublicKey(publicKey)
+		}
+		return addresses
+	}
+	return [][]byte{utxo.Address}
+}
+
+// SignPartial adds the signatures of the wallet's keys to every input of p they
+// may sign, and returns how many signatures it added. Inputs the wallet has no key
+// for are left to other signers.
+// Nothing is signed unless every input is verified, by its previous transaction or
+// the wallet's own outputs, and the fee they leave is at most maxFee.
+func (w *Wallet) SignPartial(p *PartialTransaction, maxFee int) (int, error) {
+	if err := p.check(); err != nil {
+		return 0, err
+	}
+	if w.WatchOnly {
+		return 0, ErrWatchOnly
+	}
+	for i := range p.Inputs {
+		if err := p.verifyInput(i, w); err != nil {
+			return 0, err
+		}
+	}
+	if fee := p.Fee(); fee < 0 {
+		return 0, fmt.Errorf("%w: outputs exceed inputs by %d", ErrInvalidPartialTransaction, -fee)
+	} else if fee > maxFee {
+		return 0, fmt.Errorf("%w: %d, above the cap of %d", ErrFeeTooHigh, fee, maxFee)
+	}
+
+	signed := 0
+	for i := range p.Inputs {
+		for _, address := range p.signers(i) {
+			key := w.partialKey(address, p.Inputs[i].Origin)
+			if key == nil || key.Watch {
+				continue
+			}
+			if key.PrivateKey == nil || w.IsLocked() {
+				return signed, ErrWalletLocked
+			}
+			before := len(p.Tx.Inputs[i].Signers())
+			if err := p.Tx.AddSignature(i, key.PrivateKey); err != nil {
+				return signed, err
+			}
+			if len(p.Tx.Inputs[i].Signers()) > before {
+				signed++
+			}
+		}
+	}
+	logger.InfoLogger.Printf("Wallet added %d signatures to partial transaction %x\n", signed, p.Tx.ID)
+	return signed, nil
+}
+
+// partialKey returns a copy of the wallet's key of address. An HD key the wallet
+// has not derived yet is derived from origin when it names the wallet's account.
+func (w *Wallet) partialKey(address []byte, origin *KeyOrigin) *WalletKey {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	if key, exists := w.Keys[string(address)]; exists {
+		copied := *key
+		return &copied
+	}
+	if origin == nil || w.account == nil || origin.Account != w.account.Fingerprint() || origin.Index < 0 || uint32(origin.Index) >= crypto.HardenedOffset {
+		return nil
+	}
+	chain := w.chains[receiveChain]
+	if origin.Change {
+		chain = w.chains[changeChain]
+	}
+	child, err := chain.key.Child(uint32(origin.Index))
+	if err != nil || !bytes.Equal(crypto.AddressFromPublicKey(child.PublicKey), address) {
+		return nil
+	}
+	return &WalletKey{Address: address, PublicKey: child.PublicKey, PrivateKey: child.PrivateKey, Change: origin.Change, Index: origin.Index}
+}
+
+// Combine merges into p the signatures collected in others, copies of the same
+// transaction signed separately
+func (p *PartialTransaction) Combine(others ...*PartialTransaction) error {
+	if err := p.check(); err != nil {
+		return err
+	}
+	txs := make([]*Transaction, len(others))
+	for j, other := range others {
+		if err := other.check(); err != nil {
+			return err
+		}
+		txs[j] = other.Tx
+	}
+	if err := p.Tx.CombineSignatures(txs...); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPartialTransaction, err)
+	}
+	for _, other := range others {
+		for i, input := range other.Inputs {
+			if p.Inputs[i].Origin == nil {
+				p.Inputs[i].Origin = input.Origin
+			}
+			if p.Inputs[i].PrevTx == nil {
+				p.Inputs[i].PrevTx = input.PrevTx
+			}
+			// Unlocking scripts are not signatures CombineSignatures knows of
+			if p.Tx.Inputs[i].UnlockingScript == nil {
+				p.Tx.Inputs[i].UnlockingScript = other.Tx.Inputs[i].UnlockingScript
+			}
+		}
+	}
+	return nil
+}
+
+// Finalize checks that every input carries the signatures it needs and returns
+// the transaction, ready to be broadcast
+// Conditions that depend on the chain, such as escrow timeouts and time locks, are
+// left to the node that validates the transaction.
+func (p *PartialTransaction) Finalize() (*Transaction, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	for i, input := range p.Tx.Inputs {
+		utxo := p.Inputs[i].UTXO
+		signed := make(map[string]bool)
+		for _, publicKey := range input.Signers() {
+			signed[string(crypto.AddressFromPublicKey(publicKey))] = true
+		}
+		var missing bool
+		switch {
+		case utxo.LockingScript != nil:
+			missing = len(input.UnlockingScript) == 0
+		case utxo.Escrow != nil:
+			missing = len(signed) == 0
+		case utxo.Multisig != nil:
+			missing = len(signed) < utxo.Multisig.Threshold
+		default:
+			missing = !signed[string(utxo.Address)]
+		}
+		if missing {
+			return nil, fmt.Errorf("%w: input %d spending %s", ErrMissingSignatures, i, input.PrevOut)
+		}
+	}
+	if !p.Tx.Verify() {
+		return nil, ErrInvalidSignature
+	}
+	tx := *p.Tx
+	return &tx, nil
+}
+
+// Fee is what the inputs hold beyond the outputs, as described by the partial
+// transaction. The amounts spent are only as trustworthy as the inputs, which
+// SignPartial verifies.
+func (p *PartialTransaction) Fee() int {
+	total := 0
+	for _, input := range p.Inputs {
+		if input.UTXO != nil {
+			total += input.UTXO.Amount
+		}
+	}
+	return total - p.Tx.OutputTotal()
+}
+
+// Serialize writes the binary encoding of p
+func (p *PartialTransaction) Serialize() ([]byte, error) {
+	buff := bytes.NewBuffer(append([]byte(nil), partialMagic...))
+	if err := gob.NewEncoder(buff).Encode(p); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// ParsePartialTransaction reads a partial transaction in either encoding, binary
+// as written by Serialize or JSON
+func ParsePartialTransaction(data []byte) (*PartialTransaction, error) {
+	p := &PartialTransaction{}
+	if bytes.HasPrefix(data, partialMagic) {
+		if err := gob.NewDecoder(bytes.NewReader(data[len(partialMagic):])).Decode(p); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPartialTransaction, err)
+		}
+	} else if err := p.UnmarshalJSON(data); err != nil {
+		return nil, err
+	}
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
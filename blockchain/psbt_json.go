@@ -0,0 +1,372 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"trustify/types"
+)
+
+// The JSON encoding of partial transactions spells out the transaction for review
+// before signing: addresses as strings, keys, signatures, scripts and IDs in hex,
+// and the payload as encoding/json writes its type, named by the transaction type.
+
+// Version of the JSON encoding
+const partialJSONVersion = 1
+
+// transactionPayloads creates an empty payload for each transaction type, for the
+// JSON payload to be decoded into
+var transactionPayloads = map[types.TransactionType]func() TransactionData{
+	types.TransactionTypeCoinbase:      func() TransactionData { return &CoinbaseTransactionData{} },
+	types.TransactionTypePurchase:      func() TransactionData { return &PurchaseTransactionData{} },
+	types.TransactionTypeReview:        func() TransactionData { return &ReviewTransactionData{} },
+	types.TransactionTypeAmend:         func() TransactionData { return &ReviewAmendTransactionData{} },
+	types.TransactionTypeRetract:       func() TransactionData { return &ReviewRetractTransactionData{} },
+	types.TransactionTypeListing:       func() TransactionData { return &ProductListingTransactionData{} },
+	types.TransactionTypeUpdate:        func() TransactionData { return &ProductUpdateTransactionData{} },
+	types.TransactionTypeDelist:        func() TransactionData { return &ProductDelistTransactionData{} },
+	types.TransactionTypeRefund:        func() TransactionData { return &RefundTransactionData{} },
+	types.TransactionTypeTransfer:      func() TransactionData { return &TransferTransactionData{} },
+	types.TransactionTypeConfirm:       func() TransactionData { return &DeliveryConfirmationTransactionData{} },
+	types.TransactionTypeEscrowRelease: func() TransactionData { return &EscrowReleaseTransactionData{} },
+	types.TransactionTypeEscrowRefund:  func() TransactionData { return &EscrowRefundTransactionData{} },
+}
+
+type partialJSON struct {
+	Version     int                   `json:"version"`
+	ID          string                `json:"id"`
+	Type        types.TransactionType `json:"type"`
+	Replaceable bool                  `json:"replaceable,omitempty"`
+	Inputs      []partialInputJSON    `json:"inputs"`
+	Outputs     []outputJSON          `json:"outputs"`
+	Data        json.RawMessage       `json:"data,omitempty"`
+	Fee         int                   `json:"fee"` // informational, recomputed when read
+}
+
+type partialInputJSON struct {
+	PrevOut         outPointJSON    `json:"prev_out"`
+	RelativeHeight  int             `json:"relative_height,omitempty"`
+	RelativeTime    int64           `json:"relative_time,omitempty"`
+	UTXO            utxoJSON        `json:"utxo"`
+	PrevTx          *txJSON         `json:"prev_tx,omitempty"`
+	Origin          *originJSON     `json:"origin,omitempty"`
+	Signatures      []signatureJSON `json:"signatures,omitempty"` // the primary signer first
+	UnlockingScript string          `json:"unlocking_script,omitempty"`
+}
+
+// txJSON is a transaction without its signatures, which its ID does not cover
+type txJSON struct {
+	ID          string                `json:"id"`
+	Type        types.TransactionType `json:"type"`
+	Replaceable bool                  `json:"replaceable,omitempty"`
+	Inputs      []txInputJSON         `json:"inputs"`
+	Outputs     []outputJSON          `json:"outputs"`
+	Data        json.RawMessage       `json:"data,omitempty"`
+}
+
+type txInputJSON struct {
+	PrevOut        outPointJSON `json:"prev_out"`
+	RelativeHeight int          `json:"relative_height,omitempty"`
+	RelativeTime   int64        `json:"relative_time,omitempty"`
+}
+
+type outPointJSON struct {
+	TxID  string `json:"txid"`
+	Index int    `json:"index"`
+}
+
+type originJSON struct {
+	Account string `json:"account"` // fingerprint of the account key
+	Change  bool   `json:"change"`
+	Index   int    `json:"index"`
+}
+
+type signatureJSON struct {
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+type outputJSON struct {
+	Address       string        `json:"address"`
+	Amount        int           `json:"amount"`
+	Escrow        *escrowJSON   `json:"escrow,omitempty"`
+	Multisig      *multisigJSON `json:"multisig,omitempty"`
+	LockingScript string        `json:"locking_script,omitempty"`
+	LockHeight    int           `json:"lock_height,omitempty"`
+	LockTime      int64         `json:"lock_time,omitempty"`
+}
+
+type utxoJSON struct {
+	outputJSON
+	Height   int  `json:"height"`
+	Coinbase bool `json:"coinbase,omitempty"`
+}
+
+type escrowJSON struct {
+	Buyer   string `json:"buyer"`
+	Seller  string `json:"seller"`
+	Timeout int    `json:"timeout"`
+}
+
+type multisigJSON struct {
+	Threshold  int      `json:"threshold"`
+	PublicKeys []string `json:"public_keys"`
+}
+
+// MarshalJSON writes the JSON encoding of p
+func (p *PartialTransaction) MarshalJSON() ([]byte, error) {
+	if err := p.check(); err != nil {
+		return nil, err
+	}
+	out := partialJSON{
+		Version:     partialJSONVersion,
+		ID:          hex.EncodeToString(p.Tx.ID),
+		Type:        p.Tx.Type,
+		Replaceable: p.Tx.Replaceable,
+		Fee:         p.Fee(),
+	}
+	for i, input := range p.Tx.Inputs {
+		in := partialInputJSON{
+			PrevOut:         outPointJSON{TxID: hex.EncodeToString(input.PrevOut.TxID), Index: input.PrevOut.Index},
+			RelativeHeight:  input.RelativeHeight,
+			RelativeTime:    input.RelativeTime,
+			UTXO:            newUTXOJSON(p.Inputs[i].UTXO),
+			UnlockingScript: hex.EncodeToString(input.UnlockingScript),
+		}
+		if prevTx := p.Inputs[i].PrevTx; prevTx != nil {
+			prev, err := newTxJSON(prevTx)
+			if err != nil {
+				return nil, err
+			}
+			in.PrevTx = prev
+		}
+		if origin := p.Inputs[i].Origin; origin != nil {
+			in.Origin = &originJSON{Account: fmt.Sprintf("%08x", origin.Account), Change: origin.Change, Index: origin.Index}
+		}
+		if len(input.PublicKey) > 0 {
+			in.Signatures = append(in.Signatures, signatureJSON{hex.EncodeToString(input.PublicKey), hex.EncodeToString(input.Signature)})
+		}
+		for _, cosigner := range input.Cosigners {
+			in.Signatures = append(in.Signatures, signatureJSON{hex.EncodeToString(cosigner.PublicKey), hex.EncodeToString(cosigner.Signature)})
+		}
+		out.Inputs = append(out.Inputs, in)
+	}
+	for _, output := range p.Tx.Outputs {
+		out.Outputs = append(out.Outputs, newOutputJSON(output))
+	}
+	data, err := marshalPayload(p.Tx.Data)
+	if err != nil {
+		return nil, err
+	}
+	out.Data = data
+	return json.Marshal(out)
+}
+
+// UnmarshalJSON reads the JSON encoding of a partial transaction. The transaction
+// must hash to the ID it was written with.
+func (p *PartialTransaction) UnmarshalJSON(data []byte) error {
+	var in partialJSON
+	if err := json.Unmarshal(data, &in); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPartialTransaction, err)
+	}
+	if in.Version != partialJSONVersion {
+		return fmt.Errorf("%w: version %d", ErrInvalidPartialTransaction, in.Version)
+	}
+
+	d := &hexDecoder{}
+	tx := &Transaction{Type: in.Type, Replaceable: in.Replaceable}
+	inputs := make([]PartialInput, len(in.Inputs))
+	for i, input := range in.Inputs {
+		txInput := TxInput{
+			PrevOut:         UTXOTransactionID{TxID: d.decode(input.PrevOut.TxID), Index: input.PrevOut.Index},
+			RelativeHeight:  input.RelativeHeight,
+			RelativeTime:    input.RelativeTime,
+			UnlockingScript: d.decode(input.UnlockingScript),
+		}
+		for j, signature := range input.Signatures {
+			s := InputSignature{PublicKey: d.decode(signature.PublicKey), Signature: d.decode(signature.Signature)}
+			if j == 0 {
+				txInput.PublicKey, txInput.Signature = s.PublicKey, s.Signature
+			} else {
+				txInput.Cosigners = append(txInput.Cosigners, s)
+			}
+		}
+		tx.Inputs = append(tx.Inputs, txInput)
+
+		utxo := &UTXOTransaction{ID: txInput.PrevOut, Height: input.UTXO.Height, Coinbase: input.UTXO.Coinbase}
+		utxo.setOutput(d.output(input.UTXO.outputJSON))
+		inputs[i].UTXO = utxo
+		if input.PrevTx != nil {
+			prevTx, err := d.tx(input.PrevTx)
+			if err != nil {
+				return err
+			}
+			inputs[i].PrevTx = prevTx
+		}
+		if input.Origin != nil {
+			var account uint32
+			if _, err := fmt.Sscanf(input.Origin.Account, "%08x", &account); err != nil {
+				return fmt.Errorf("%w: account fingerprint %q", ErrInvalidPartialTransaction, input.Origin.Account)
+			}
+			inputs[i].Origin = &KeyOrigin{Account: account, Change: input.Origin.Change, Index: input.Origin.Index}
+		}
+	}
+	for _, output := range in.Outputs {
+		tx.Outputs = append(tx.Outputs, d.output(output))
+	}
+	if d.err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidPartialTransaction, d.err)
+	}
+
+	payload, err := unmarshalPayload(in.Type, in.Data)
+	if err != nil {
+		return err
+	}
+	tx.Data = payload
+	tx.ID = tx.Hash()
+	if hex.EncodeToString(tx.ID) != in.ID {
+		return fmt.Errorf("%w: transaction hashes to %x, not %s", ErrInvalidPartialTransaction, tx.ID, in.ID)
+	}
+	p.Tx, p.Inputs = tx, inputs
+	return nil
+}
+
+func newTxJSON(tx *Transaction) (*txJSON, error) {
+	out := &txJSON{ID: hex.EncodeToString(tx.Hash()), Type: tx.Type, Replaceable: tx.Replaceable}
+	for _, input := range tx.Inputs {
+		out.Inputs = append(out.Inputs, txInputJSON{
+			PrevOut:        outPointJSON{TxID: hex.EncodeToString(input.PrevOut.TxID), Index: input.PrevOut.Index},
+			RelativeHeight: input.RelativeHeight,
+			RelativeTime:   input.RelativeTime,
+		})
+	}
+	for _, output := range tx.Outputs {
+		out.Outputs = append(out.Outputs, newOutputJSON(output))
+	}
+	data, err := marshalPayload(tx.Data)
+	if err != nil {
+		return nil, err
+	}
+	out.Data = data
+	return out, nil
+}
+
+func marshalPayload(data TransactionData) (json.RawMessage, error) {
+	if data == nil {
+		return nil, nil
+	}
+	return json.Marshal(data)
+}
+
+// unmarshalPayload decodes the payload of a transaction of type txType
+func unmarshalPayload(txType types.TransactionType, data json.RawMessage) (TransactionData, error) {
+	if len(data) == 0 || bytes.Equal(data, []byte("null")) {
+		return nil, nil
+	}
+	payload, known := transactionPayloads[txType]
+	if !known {
+		return nil, fmt.Errorf("%w: transaction type %q", ErrInvalidPartialTransaction, txType)
+	}
+	out := payload()
+	if err := json.Unmarshal(data, out); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPartialTransaction, err)
+	}
+	return out, nil
+}
+
+func newOutputJSON(output TxOutput) outputJSON {
+	out := outputJSON{
+		Address:       string(output.Address),
+		Amount:        output.Amount,
+		LockingScript: hex.EncodeToString(output.LockingScript),
+		LockHeight:    output.LockHeight,
+		LockTime:      output.LockTime,
+	}
+	if output.Escrow != nil {
+		out.Escrow = &escrowJSON{Buyer: string(output.Escrow.BuyerAddress), Seller: string(output.Escrow.SellerAddress), Timeout: output.Escrow.Timeout}
+	}
+	if output.Multisig != nil {
+		out.Multisig = &multisigJSON{Threshold: output.Multisig.Threshold}
+		for _, publicKey := range output.Multisig.PublicKeys {
+			out.Multisig.PublicKeys = append(out.Multisig.PublicKeys, hex.EncodeToString(publicKey))
+		}
+	}
+	return out
+}
+
+func newUTXOJSON(utxo *UTXOTransaction) utxoJSON {
+	return utxoJSON{outputJSON: newOutputJSON(utxo.output()), Height: utxo.Height, Coinbase: utxo.Coinbase}
+}
+
+// hexDecoder decodes hex fields, keeping the first error. Empty fields decode to
+// nil, as a transaction leaves unset byte fields.
+type hexDecoder struct {
+	err error
+}
+
+func (d *hexDecoder) decode(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return b
+}
+
+func (d *hexDecoder) address(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return []byte(s)
+}
+
+func (d *hexDecoder) output(in outputJSON) TxOutput {
+	output := TxOutput{
+		Address:       d.address(in.Address),
+		Amount:        in.Amount,
+		LockingScript: d.decode(in.LockingScript),
+		LockHeight:    in.LockHeight,
+		LockTime:      in.LockTime,
+	}
+	if in.Escrow != nil {
+		output.Escrow = &EscrowTerms{BuyerAddress: d.address(in.Escrow.Buyer), SellerAddress: d.address(in.Escrow.Seller), Timeout: in.Escrow.Timeout}
+	}
+	if in.Multisig != nil {
+		output.Multisig = &MultisigTerms{Threshold: in.Multisig.Threshold}
+		for _, publicKey := range in.Multisig.PublicKeys {
+			output.Multisig.PublicKeys = append(output.Multisig.PublicKeys, d.decode(publicKey))
+		}
+	}
+	return output
+}
+
+// tx decodes a transaction, which must hash to the ID it was written with
+func (d *hexDecoder) tx(in *txJSON) (*Transaction, error) {
+	tx := &Transaction{Type: in.Type, Replaceable: in.Replaceable}
+	for _, input := range in.Inputs {
+		tx.Inputs = append(tx.Inputs, TxInput{
+			PrevOut:        UTXOTransactionID{TxID: d.decode(input.PrevOut.TxID), Index: input.PrevOut.Index},
+			RelativeHeight: input.RelativeHeight,
+			RelativeTime:   input.RelativeTime,
+		})
+	}
+	for _, output := range in.Outputs {
+		tx.Outputs = append(tx.Outputs, d.output(output))
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPartialTransaction, d.err)
+	}
+	data, err := unmarshalPayload(in.Type, in.Data)
+	if err != nil {
+		return nil, err
+	}
+	tx.Data = data
+	tx.ID = tx.Hash()
+	if hex.EncodeToString(tx.ID) != in.ID {
+		return nil, fmt.Errorf("%w: previous transaction hashes to %x, not %s", ErrInvalidPartialTransaction, tx.ID, in.ID)
+	}
+	return tx, nil
+}
@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"trustify/crypto"
+	"trustify/types"
+)
+
+// newTestPartial returns a wallet and a partial transaction spending 100 it received
+// in a previous transaction, paying 90 on and leaving a fee of 10
+func newTestPartial(t *testing.T) (*Wallet, *Transaction, *PartialTransaction) {
+	t.Helper()
+	keys, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWallet(keys.PrivateKey, keys.PublicKey, crypto.AddressFromPublicKey(keys.PublicKey))
+	prevTx := &Transaction{
+		Type:    types.TransactionTypeTransfer,
+		Inputs:  []TxInput{{PrevOut: UTXOTransactionID{TxID: make([]byte, 32), Index: 0}}},
+		Outputs: []TxOutput{{Address: []byte("1BoatSLRHtKNngkdXEeobR76b53LETtpyT"), Amount: 50}, {Address: w.BitcoinAddress, Amount: 100}},
+		Data:    &TransferTransactionData{Memo: "previous"},
+	}
+	prevTx.ID = prevTx.Hash()
+	tx := &Transaction{
+		Type:    types.TransactionTypeTransfer,
+		Inputs:  []TxInput{{PrevOut: UTXOTransactionID{TxID: prevTx.ID, Index: 1}}},
+		Outputs: []TxOutput{{Address: []byte("1BoatSLRHtKNngkdXEeobR76b53LETtpyT"), Amount: 90}},
+		Data:    &TransferTransactionData{},
+	}
+	lookup := func(id *UTXOTransactionID) (*UTXOTransaction, bool) {
+		return prevTx.UTXOs()[id.Index], true
+	}
+	source := func(txID []byte) (*Transaction, bool) { return prevTx, true }
+	p, err := NewPartialTransaction(nil, tx, lookup, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w, prevTx, p
+}
+
+func TestSignPartialVerifiesInputs(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(w *Wallet, prevTx *Transaction, p *PartialTransaction)
+		maxFee int
+		want   error
+	}{
+		{"previous transaction", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {}, 10, nil},
+		{"fee above the cap", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {}, 9, ErrFeeTooHigh},
+		{"amount misdescribed", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {
+			p.Inputs[0].UTXO.Amount = 1000
+		}, 1000, ErrInvalidPartialTransaction},
+		{"address misdescribed", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {
+			p.Inputs[0].UTXO.Address = []byte("1BoatSLRHtKNngkdXEeobR76b53LETtpyT")
+		}, 10, ErrInvalidPartialTransaction},
+		{"previous transaction altered", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {
+			altered := *prevTx
+			altered.Outputs = []TxOutput{prevTx.Outputs[0], {Address: w.BitcoinAddress, Amount: 1000}}
+			p.Inputs[0].PrevTx = &altered
+			p.Inputs[0].UTXO.Amount = 1000
+		}, 1000, ErrInvalidPartialTransaction},
+		{"no previous transaction", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {
+			p.Inputs[0].PrevTx = nil
+		}, 10, ErrInvalidPartialTransaction},
+		{"wallet output", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {
+			p.Inputs[0].PrevTx = nil
+			w.UTXOs = append(w.UTXOs, prevTx.UTXOs()[1])
+		}, 10, nil},
+		{"wallet output misdescribed", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {
+			p.Inputs[0].PrevTx = nil
+			w.UTXOs = append(w.UTXOs, prevTx.UTXOs()[1])
+			p.Inputs[0].UTXO.Amount = 1000
+		}, 1000, ErrInvalidPartialTransaction},
+		{"outputs above inputs", func(w *Wallet, prevTx *Transaction, p *PartialTransaction) {
+			p.Tx.Outputs[0].Amount = 110
+			p.Tx.ID = p.Tx.Hash()
+		}, 10, ErrInvalidPartialTransaction},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w, prevTx, p := newTestPartial(t)
+			test.modify(w, prevTx, p)
+			signed, err := w.SignPartial(p, test.maxFee)
+			if test.want != nil {
+				if !errors.Is(err, test.want) {
+					t.Fatalf("got %v, want %v", err, test.want)
+				}
+				if signed != 0 || len(p.Tx.Inputs[0].Signers()) != 0 {
+					t.Error("signed although the input was rejected")
+				}
+				return
+			}
+			if err != nil || signed != 1 {
+				t.Fatalf("signed %d, %v", signed, err)
+			}
+		})
+	}
+}
+
+func TestPartialTransactionEncodings(t *testing.T) {
+	w, prevTx, p := newTestPartial(t)
+
+	data, err := p.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParsePartialTransaction(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Inputs[0].PrevTx == nil || string(parsed.Inputs[0].PrevTx.Hash()) != string(prevTx.ID) {
+		t.Fatal("binary encoding lost the previous transaction")
+	}
+
+	data, err = json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err = ParsePartialTransaction(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Inputs[0].PrevTx == nil || string(parsed.Inputs[0].PrevTx.Hash()) != string(prevTx.ID) {
+		t.Fatal("JSON encoding lost the previous transaction")
+	}
+	if signed, err := w.SignPartial(parsed, 10); err != nil || signed != 1 {
+		t.Fatalf("signed %d, %v after the JSON round trip", signed, err)
+	}
+
+	// An amount changed in the previous transaction no longer matches its ID
+	at := strings.Index(string(data), `"prev_tx"`)
+	if at < 0 {
+		t.Fatal("no previous transaction in the JSON encoding")
+	}
+	tampered := string(data[:at]) + strings.Replace(string(data[at:]), `"amount":100`, `"amount":1000`, 1)
+	if tampered == string(data) {
+		t.Fatal("amount not found in the previous transaction")
+	}
+	if _, err := ParsePartialTransaction([]byte(tampered)); !errors.Is(err, ErrInvalidPartialTransaction) {
+		t.Errorf("got %v for a tampered previous transaction", err)
+	}
+}
@@ -0,0 +1,273 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"sync"
+)
+
+// RatingIndex keeps the rating aggregates of every product and seller as blocks
+// connect and disconnect, so they are answered without scanning the ledger
+// Each review counts with the rating of its latest version and stops counting once
+// retracted or once its purchase is refunded in full. A review's seller is the registered
+// seller of the product, looked up in products, and its purchase is looked up in
+// the review index. Both must be connected before this index.
+type RatingIndex struct {
+	products  map[string]*RatingSummary // product ID -> aggregate of its reviews
+	sellers   map[string]*RatingSummary // seller address -> aggregate over its products
+	reviews   map[string]*ratedReview   // hex review ID -> the review's ratings
+	purchases map[string]string         // hex purchase ID -> hex ID of the review it authorized
+	registry  *ProductIndex
+	index     *ReviewIndex
+	Mutex     sync.RWMutex
+}
+
+// RatingSummary aggregates a set of ratings
+type RatingSummary struct {
+	Count int
+	Sum   int
+	// Distribution[r] is the number of ratings of r, for MinRating <= r <= MaxRating
+	Distribution [MaxRating + 1]int
+}
+
+// RatingAggregate is a summary from the confirmed chain alone, and the same summary
+// with the reviews, amendments and retractions waiting in the mempool applied on top
+type RatingAggregate struct {
+	Confirmed   RatingSummary
+	Unconfirmed RatingSummary
+}
+
+type ratedReview struct {
+	productID string
+	seller    string
+	ratings   []int  // rating after each confirmed version, 0 once retracted
+	purchase  string // hex ID of the purchase that authorized the review
+	refunded  bool   // whether the purchase has been refunded in full
+}
+
+func NewRatingIndex(registry *ProductIndex, index *ReviewIndex) *RatingIndex {
+	return &RatingIndex{
+		products:  make(map[string]*RatingSummary),
+		sellers:   make(map[string]*RatingSummary),
+		reviews:   make(map[string]*ratedReview),
+		purchases: make(map[string]string),
+		registry:  registry,
+		index:     index,
+	}
+}
+
+// Average is the mean rating, 0 when there are no ratings
+func (s RatingSummary) Average() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Sum) / float64(s.Count)
+}
+
+// replace swaps rating old for rating new, 0 standing for no rating
+func (s *RatingSummary) replace(old int, new int) {
+	if old != 0 {
+		s.Count--
+		s.Sum -= old
+		s.Distribution[old]--
+	}
+	if new != 0 {
+		s.Count++
+		s.Sum += new
+		s.Distribution[new]++
+	}
+}
+
+func (ri *RatingIndex) ConnectBlock(b *Block, height int) {
+	ri.Mutex.Lock()
+	defer ri.Mutex.Unlock()
+	for _, tx := range b.Transactions {
+		if purchaseID, ok := refundedPurchase(tx); ok {
+			// A purchase is refunded at most once per block, so the review index
+			// holds what is left of it after this refund
+			_, remaining := ri.index.Refund(purchaseID)
+			ri.setRefunded(hex.EncodeToString(purchaseID), remaining <= 0)
+		}
+		switch data := tx.Data.(type) {
+		case *ReviewTransactionData:
+			// The review index, connected first, already reflects a refund later in
+			// the block, so marking the review again when the refund comes is a no-op
+			key := hex.EncodeToString(tx.ID)
+			review := &ratedReview{productID: data.ProductID, seller: ri.sellerOf(data.ProductID)}
+			if record, exists := ri.index.History(tx.ID); exists {
+				review.purchase = hex.EncodeToString(record.PurchaseID)
+				review.refunded = record.Refunded
+				ri.purchases[review.purchase] = key
+			}
+			ri.reviews[key] = review
+			ri.push(review, data.Rating)
+		case *ReviewAmendTransactionData:
+			ri.push(ri.reviews[hex.EncodeToString(data.ReviewID)], data.Rating)
+		case *ReviewRetractTransactionData:
+			ri.push(ri.reviews[hex.EncodeToString(data.ReviewID)], 0)
+		}
+	}
+}
+
+func (ri *RatingIndex) DisconnectBlock(b *Block, height int) {
+	ri.Mutex.Lock()
+	defer ri.Mutex.Unlock()
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		tx := b.Transactions[i]
+		switch data := tx.Data.(type) {
+		case *ReviewTransactionData:
+			key := hex.EncodeToString(tx.ID)
+			review := ri.reviews[key]
+			ri.pop(review)
+			delete(ri.purchases, review.purchase)
+			delete(ri.reviews, key)
+		case *ReviewAmendTransactionData:
+			ri.pop(ri.reviews[hex.EncodeToString(data.ReviewID)])
+		case *ReviewRetractTransactionData:
+			ri.pop(ri.reviews[hex.EncodeToString(data.ReviewID)])
+		}
+		// Nothing refunds a purchase refunded in full, so before this refund it was not
+		if purchaseID, ok := refundedPurchase(tx); ok {
+			ri.setRefunded(hex.EncodeToString(purchaseID), false)
+		}
+	}
+}
+
+// push records a new version of review with the given rating
+func (ri *RatingIndex) push(review *ratedReview, rating int) {
+	old := review.current()
+	review.ratings = append(review.ratings, rating)
+	ri.update(review.productID, review.seller, old, review.current())
+}
+
+// pop undoes the latest version of review
+func (ri *RatingIndex) pop(review *ratedReview) {
+	old := review.current()
+	review.ratings = review.ratings[:len(review.ratings)-1]
+	ri.update(review.productID, review.seller, old, review.current())
+}
+
+// setRefunded marks the review authorized by the purchase, if any, refunded or not
+func (ri *RatingIndex) setRefunded(purchaseID string, refunded bool) {
+	review, exists := ri.reviews[ri.purchases[purchaseID]]
+	if !exists {
+		return
+	}
+	old := review.current()
+	review.refunded = refunded
+	ri.update(review.productID, review.seller, old, review.current())
+}
+
+func (ri *RatingIndex) update(productID string, seller string, old int, new int) {
+	summary, exists := ri.products[productID]
+	if !exists {
+		summary = &RatingSummary{}
+		ri.products[productID] = summary
+	}
+	summary.replace(old, new)
+	if summary.Count == 0 {
+		delete(ri.products, productID)
+	}
+
+	if seller == "" {
+		return
+	}
+	summary, exists = ri.sellers[seller]
+	if !exists {
+		summary = &RatingSummary{}
+		ri.sellers[seller] = summary
+	}
+	summary.replace(old, new)
+	if summary.Count == 0 {
+		delete(ri.sellers, seller)
+	}
+}
+
+// current is the rating the review counts with, 0 if it does not count
+func (r *ratedReview) current() int {
+	if len(r.ratings) == 0 || r.refunded {
+		return 0
+	}
+	return r.ratings[len(r.ratings)-1]
+}
+
+func (ri *RatingIndex) sellerOf(productID string) string {
+	if product, exists := ri.registry.Product(productID); exists {
+		return string(product.SellerAddress)
+	}
+	return ""
+}
+
+// ProductRatings aggregates the ratings of productID, with pending, the transactions
+// waiting in the mempool, applied for the unconfirmed summary
+func (ri *RatingIndex) ProductRatings(productID string, pending []*Transaction) RatingAggregate {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	return ri.aggregate(func(review *ratedReview) bool {
+		return review.productID == productID
+	}, ri.products[productID], pending)
+}
+
+// SellerRatings aggregates the ratings of every product sold by seller, with pending
+// applied for the unconfirmed summary
+func (ri *RatingIndex) SellerRatings(seller []byte, pending []*Transaction) RatingAggregate {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	return ri.aggregate(func(review *ratedReview) bool {
+		return review.seller == string(seller)
+	}, ri.sellers[string(seller)], pending)
+}
+
+// aggregate starts from the confirmed summary and applies every pending review,
+// amendment, retraction and full refund of a review matching match
+func (ri *RatingIndex) aggregate(match func(review *ratedReview) bool, confirmed *RatingSummary, pending []*Transaction) RatingAggregate {
+	var aggregate RatingAggregate
+	if confirmed != nil {
+		aggregate.Confirmed = *confirmed
+	}
+	aggregate.Unconfirmed = aggregate.Confirmed
+
+	// Ratings of confirmed reviews as revised by earlier pending transactions
+	revised := make(map[string]int)
+	refunded := make(map[string]bool)
+	revise := func(key string, rating int) {
+		review, exists := ri.reviews[key]
+		if !exists || !match(review) {
+			return
+		}
+		old, exists := revised[key]
+		if !exists {
+			old = review.current()
+		}
+		if review.refunded || refunded[key] {
+			rating = 0
+		}
+		aggregate.Unconfirmed.replace(old, rating)
+		revised[key] = rating
+	}
+
+	for _, tx := range pending {
+		switch data := tx.Data.(type) {
+		case *ReviewTransactionData:
+			review := &ratedReview{productID: data.ProductID, seller: ri.sellerOf(data.ProductID)}
+			if match(review) {
+				aggregate.Unconfirmed.replace(0, data.Rating)
+			}
+		case *ReviewAmendTransactionData:
+			revise(hex.EncodeToString(data.ReviewID), data.Rating)
+		case *ReviewRetractTransactionData:
+			revise(hex.EncodeToString(data.ReviewID), 0)
+		}
+		if purchaseID, ok := refundedPurchase(tx); ok {
+			if data, ok := tx.Data.(*RefundTransactionData); ok {
+				if _, remaining := ri.index.Refund(purchaseID); data.Amount < remaining {
+					continue
+				}
+			}
+			if key, exists := ri.purchases[hex.EncodeToString(purchaseID)]; exists {
+				refunded[key] = true
+				revise(key, 0)
+			}
+		}
+	}
+	return aggregate
+}
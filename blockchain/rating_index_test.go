@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+	"bytes"
+	"testing"
+)
+
+// reviewIndexes are the product, review and rating indexes, connected a block at a
+// time the way the chain does, without validating the transactions
+type reviewIndexes struct {
+	t        *testing.T
+	products *ProductIndex
+	reviews  *ReviewIndex
+	ratings  *RatingIndex
+	blocks   []*Block
+}
+
+func newReviewIndexes(t *testing.T) *reviewIndexes {
+	products, reviews := NewProductIndex(), NewReviewIndex()
+	return &reviewIndexes{t: t, products: products, reviews: reviews, ratings: NewRatingIndex(products, reviews)}
+}
+
+func (ri *reviewIndexes) indexes() []ChainIndex {
+	return []ChainIndex{ri.products, ri.reviews, ri.ratings}
+}
+
+func (ri *reviewIndexes) connect(txs ...*Transaction) {
+	b := &Block{Transactions: txs, TransactionCount: len(txs)}
+	ri.blocks = append(ri.blocks, b)
+	for _, index := range ri.indexes() {
+		index.ConnectBlock(b, len(ri.blocks))
+	}
+}
+
+func (ri *reviewIndexes) disconnect() {
+	b := ri.blocks[len(ri.blocks)-1]
+	indexes := ri.indexes()
+	for i := len(indexes) - 1; i >= 0; i-- {
+		indexes[i].DisconnectBlock(b, len(ri.blocks))
+	}
+	ri.blocks = ri.blocks[:len(ri.blocks)-1]
+}
+
+// expect checks the confirmed aggregates of the product and of its seller
+func (ri *reviewIndexes) expect(productID string, seller []byte, want RatingSummary) {
+	ri.t.Helper()
+	if got := ri.ratings.ProductRatings(productID, nil).Confirmed; got != want {
+		ri.t.Errorf("product ratings %+v, want %+v", got, want)
+	}
+	if got := ri.ratings.SellerRatings(seller, nil).Confirmed; got != want {
+		ri.t.Errorf("seller ratings %+v, want %+v", got, want)
+	}
+}
+
+func testTx(data TransactionData) *Transaction {
+	tx := &Transaction{Data: data}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func summary(ratings ...int) RatingSummary {
+	var s RatingSummary
+	for _, rating := range ratings {
+		s.replace(0, rating)
+	}
+	return s
+}
+
+func TestRatingIndexPartialRefund(t *testing.T) {
+	ri := newReviewIndexes(t)
+	seller, alice, bob := []byte("seller"), []byte("alice"), []byte("bob")
+	purchase := testTx(&PurchaseTransactionData{BuyerAddress: alice, SellerAddress: seller, ProductID: "p", Amount: 10})
+	review := testTx(&ReviewTransactionData{ReviewerAddress: alice, ProductID: "p", Rating: 1, Title: "bad"})
+	ri.connect(
+		testTx(&ProductListingTransactionData{ProductID: "p", SellerAddress: seller, Price: 10}),
+		purchase,
+		testTx(&PurchaseTransactionData{BuyerAddress: bob, SellerAddress: seller, ProductID: "p", Amount: 10}),
+	)
+	ri.connect(review, testTx(&ReviewTransactionData{ReviewerAddress: bob, ProductID: "p", Rating: 5, Title: "good"}))
+	ri.expect("p", seller, summary(1, 5))
+
+	// A partial refund marks the review but leaves its rating counted
+	partial := testTx(&RefundTransactionData{PurchaseID: purchase.ID, BuyerAddress: alice, SellerAddress: seller, Amount: 3})
+	ri.connect(partial)
+	ri.expect("p", seller, summary(1, 5))
+	record, _ := ri.reviews.History(review.ID)
+	if !bytes.Equal(record.RefundID, partial.ID) || record.Refunded {
+		t.Errorf("review refunded by %x, in full %v, after a partial refund", record.RefundID, record.Refunded)
+	}
+	if _, remaining := ri.reviews.Refund(purchase.ID); remaining != 7 {
+		t.Errorf("%d left of the purchase", remaining)
+	}
+	if ri.reviews.Refunded(alice, "p") {
+		t.Error("purchase refunded after a partial refund")
+	}
+
+	// Pending refunds only count when they pay back the rest
+	short := testTx(&RefundTransactionData{PurchaseID: purchase.ID, BuyerAddress: alice, SellerAddress: seller, Amount: 6})
+	if got := ri.ratings.ProductRatings("p", []*Transaction{short}).Unconfirmed; got != summary(1, 5) {
+		t.Errorf("ratings %+v with a pending partial refund", got)
+	}
+	full := testTx(&RefundTransactionData{PurchaseID: purchase.ID, BuyerAddress: alice, SellerAddress: seller, Amount: 7})
+	if got := ri.ratings.ProductRatings("p", []*Transaction{full}).Unconfirmed; got != summary(5) {
+		t.Errorf("ratings %+v with a pending full refund", got)
+	}
+
+	// Refunding the rest drops the review
+	ri.connect(full)
+	ri.expect("p", seller, summary(5))
+	record, _ = ri.reviews.History(review.ID)
+	if !bytes.Equal(record.RefundID, full.ID) || !record.Refunded {
+		t.Errorf("review refunded by %x, in full %v, after a full refund", record.RefundID, record.Refunded)
+	}
+	if !ri.reviews.Refunded(alice, "p") {
+		t.Error("purchase not refunded after a full refund")
+	}
+
+	ri.disconnect()
+	ri.expect("p", seller, summary(1, 5))
+	record, _ = ri.reviews.History(review.ID)
+	if !bytes.Equal(record.RefundID, partial.ID) || record.Refunded {
+		t.Errorf("review refunded by %x, in full %v, once the full refund is disconnected", record.RefundID, record.Refunded)
+	}
+	ri.disconnect()
+	record, _ = ri.reviews.History(review.ID)
+	if record.RefundID != nil {
+		t.Errorf("review refunded by %x with no refund connected", record.RefundID)
+	}
+	if _, remaining := ri.reviews.Refund(purchase.ID); remaining != 10 {
+		t.Errorf("%d left of the purchase with no refund connected", remaining)
+	}
+}
+
+func TestRatingIndexDisconnect(t *testing.T) {
+	ri := newReviewIndexes(t)
+	seller, alice, bob, carol := []byte("seller"), []byte("alice"), []byte("bob"), []byte("carol")
+	bobPurchase := testTx(&PurchaseTransactionData{BuyerAddress: bob, SellerAddress: seller, ProductID: "p", Amount: 10})
+	aliceReview := testTx(&ReviewTransactionData{ReviewerAddress: alice, ProductID: "p", Rating: 4, Title: "fine"})
+	carolReview := testTx(&ReviewTransactionData{ReviewerAddress: carol, ProductID: "q", Rating: 2, Title: "poor"})
+	blocks := [][]*Transaction{
+		{
+			testTx(&ProductListingTransactionData{ProductID: "p", SellerAddress: seller, Price: 10}),
+			testTx(&ProductListingTransactionData{ProductID: "q", SellerAddress: seller, Price: 10}),
+			testTx(&PurchaseTransactionData{BuyerAddress: alice, SellerAddress: seller, ProductID: "p", Amount: 10}),
+			bobPurchase,
+			testTx(&PurchaseTransactionData{BuyerAddress: carol, SellerAddress: seller, ProductID: "q", Amount: 10}),
+		},
+		{aliceReview, carolReview},
+		{
+			testTx(&ReviewTransactionData{ReviewerAddress: bob, ProductID: "p", Rating: 5, Title: "great"}),
+			testTx(&ReviewAmendTransactionData{ReviewID: aliceReview.ID, ReviewerAddress: alice, Rating: 2, Title: "worse"}),
+		},
+		{
+			testTx(&RefundTransactionData{PurchaseID: bobPurchase.ID, BuyerAddress: bob, SellerAddress: seller, Amount: 10}),
+			testTx(&ReviewRetractTransactionData{ReviewID: carolReview.ID, ReviewerAddress: carol}),
+		},
+		{testTx(&ReviewAmendTransactionData{ReviewID: aliceReview.ID, ReviewerAddress: alice, Rating: 3, Title: "better"})},
+	}
+	type snapshot struct{ p, q, seller RatingSummary }
+	take := func() snapshot {
+		return snapshot{
+			ri.ratings.ProductRatings("p", nil).Confirmed,
+			ri.ratings.ProductRatings("q", nil).Confirmed,
+			ri.ratings.SellerRatings(seller, nil).Confirmed,
+		}
+	}
+	want := []snapshot{
+		{},
+		{},
+		{summary(4), summary(2), summary(2, 4)},
+		{summary(2, 5), summary(2), summary(2, 2, 5)},
+		{summary(2), summary(), summary(2)},
+		{summary(3), summary(), summary(3)},
+	}
+
+	for i, txs := range blocks {
+		ri.connect(txs...)
+		if got := take(); got != want[i+1] {
+			t.Fatalf("after block %d: %+v, want %+v", i+1, got, want[i+1])
+		}
+	}
+
+	// Pending transactions apply on top of the confirmed ratings
+	pending := []*Transaction{
+		testTx(&ReviewTransactionData{ReviewerAddress: []byte("dave"), ProductID: "p", Rating: 5, Title: "great"}),
+		testTx(&ReviewAmendTransactionData{ReviewID: aliceReview.ID, ReviewerAddress: alice, Rating: 1, Title: "awful"}),
+	}
+	if got := ri.ratings.ProductRatings("p", pending); got.Confirmed != summary(3) || got.Unconfirmed != summary(1, 5) {
+		t.Errorf("product ratings %+v with pending transactions", got)
+	}
+	if got := ri.ratings.SellerRatings(seller, pending); got.Unconfirmed != summary(1, 5) {
+		t.Errorf("seller ratings %+v with pending transactions", got)
+	}
+	retract := testTx(&ReviewRetractTransactionData{ReviewID: aliceReview.ID, ReviewerAddress: alice})
+	if got := ri.ratings.ProductRatings("p", append(pending, retract)).Unconfirmed; got != summary(5) {
+		t.Errorf("product ratings %+v with a pending retraction", got)
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		ri.disconnect()
+		if got := take(); got != want[i] {
+			t.Errorf("after disconnecting block %d: %+v, want %+v", i+1, got, want[i])
+		}
+	}
+	if len(ri.ratings.products) != 0 || len(ri.ratings.sellers) != 0 || len(ri.ratings.reviews) != 0 || len(ri.ratings.purchases) != 0 {
+		t.Errorf("index not empty once every block is disconnected: %+v", ri.ratings)
+	}
+}
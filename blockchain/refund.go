@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"trustify/crypto"
+	"trustify/logger"
+	"trustify/types"
+)
+
+// A refund returns up to the amount of the confirmed purchase named by PurchaseID to
+// its buyer. The seller pays it from their own coins and signs its inputs.
+// Purchases paid into escrow are refunded from the escrow instead, in full. Once
+// its refunds add up to its amount the purchase is refunded, which the review and
+// rating indexes act on. Partial refunds are only recorded against the review.
+type RefundTransactionData struct {
+	PurchaseID    []byte
+	BuyerAddress  []byte
+	SellerAddress []byte
+	Amount        int
+}
+
+func init() {
+	gob.Register(&RefundTransactionData{})
+}
+
+func (d *RefundTransactionData) writeHash(w *hashWriter) {
+	w.writeBytes(d.PurchaseID)
+	w.writeBytes(d.BuyerAddress)
+	w.writeBytes(d.SellerAddress)
+	w.writeInt(d.Amount)
+}
+
+// refundedPurchase returns the ID of the purchase a refund or escrow refund pays back
+// Escrow outputs are only created by purchases, so an escrow names its purchase.
+func refundedPurchase(tx *Transaction) ([]byte, bool) {
+	switch data := tx.Data.(type) {
+	case *RefundTransactionData:
+		return data.PurchaseID, true
+	case *EscrowRefundTransactionData:
+		return data.Escrow.TxID, true
+	}
+	return nil, false
+}
+
+// checkRefund applies the refund rules that depend on the chain: the purchase must
+// be confirmed, between the same buyer and seller, paid directly rather than into
+// escrow, and not refunded in full already, and the amount refunded must not
+// exceed what earlier refunds left of it
+func (bc *Blockchain) checkRefund(data *RefundTransactionData) error {
+	purchase, _, exists := bc.transaction(data.PurchaseID)
+	if !exists {
+		return fmt.Errorf("%w: purchase %x not confirmed", ErrTransactionInvalid, data.PurchaseID)
+	}
+	purchaseData, ok := purchase.Data.(*PurchaseTransactionData)
+	if !ok {
+		return fmt.Errorf("%w: %x is not a purchase", ErrTransactionInvalid, data.PurchaseID)
+	}
+	if !bytes.Equal(purchaseData.BuyerAddress, data.BuyerAddress) || !bytes.Equal(purchaseData.SellerAddress, data.SellerAddress) {
+		return fmt.Errorf("%w: purchase %x is between %s and %s", ErrTransactionInvalid, data.PurchaseID, purchaseData.BuyerAddress, purchaseData.SellerAddress)
+	}
+	for _, output := range purchase.Outputs {
+		if output.Escrow != nil {
+			return fmt.Errorf("%w: purchase %x is refunded from its escrow", ErrTransactionInvalid, data.PurchaseID)
+		}
+	}
+	refund, remaining := bc.Reviews.Refund(data.PurchaseID)
+	if remaining <= 0 {
+		return fmt.Errorf("%w: %x in %x", ErrPurchaseRefunded, data.PurchaseID, refund)
+	}
+	if data.Amount > remaining {
+		return fmt.Errorf("%w: refund of %d exceeds the %d left of purchase of %d", ErrTransactionInvalid, data.Amount, remaining, purchaseData.Amount)
+	}
+	return nil
+}
+
+// NewRefundTransaction pays amount of the confirmed purchase back to its buyer from
+// the wallet's UTXOs, plus fee to the miner, with the wallet as the seller
+func NewRefundTransaction(w *Wallet, purchase *Transaction, amount int, fee int) (*Transaction, error) {
+	purchaseData, ok := purchase.Data.(*PurchaseTransactionData)
+	if !ok {
+		return nil, fmt.Errorf("%w: %x is not a purchase", ErrTransactionInvalid, purchase.ID)
+	}
+	if amount <= 0 || amount > purchaseData.Amount || fee < 0 {
+		return nil, fmt.Errorf("%w: amount %d of %d, fee %d", ErrTransactionInvalid, amount, purchaseData.Amount, fee)
+	}
+	if !crypto.ValidateAddress(purchaseData.BuyerAddress) {
+		return nil, fmt.Errorf("%w: buyer %s", crypto.ErrInvalidAddress, purchaseData.BuyerAddress)
+	}
+
+	// The seller signs for the refund by paying it from the address it sold from
+	inputs, change, err := w.createInputs(amount+fee, w.BitcoinAddress)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to create inputs for refund transaction:", err)
+		return nil, err
+	}
+
+	outputs := []TxOutput{
+		{Address: purchaseData.BuyerAddress, Amount: amount},
+	}
+	if change > 0 {
+		changeAddress, err := w.ChangeAddress()
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, TxOutput{Address: changeAddress, Amount: change})
+	}
+
+	tx := &Transaction{
+		Type:    types.TransactionTypeRefund,
+		Inputs:  inputs,
+		Outputs: outputs,
+		Data: &RefundTransactionData{
+			PurchaseID:    purchase.ID,
+			BuyerAddress:  purchaseData.BuyerAddress,
+			SellerAddress: w.BitcoinAddress,
+			Amount:        amount,
+		},
+	}
+
+	if err := w.SignTransaction(tx); err != nil {
+		logger.ErrorLogger.Println("Failed to sign refund transaction:", err)
+		return nil, err
+	}
+	logger.InfoLogger.Printf("New refund transaction created: %x\n", tx.ID)
+	return tx, nil
+}
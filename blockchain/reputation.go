@@ -0,0 +1,266 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"sync"
+	"trustify/crypto"
+)
+
+// ReviewerStats is what the chain says about an address as a reviewer
+type ReviewerStats struct {
+	Address []byte
+	// Age is the number of blocks since the address first appeared on chain,
+	// receiving coins or authoring a transaction, -1 if it never has
+	Age       int
+	Purchases int // confirmed purchases made
+	Spend     int // total amount of those purchases
+	Reviews   int // confirmed reviews not retracted
+	// Deviation is the mean absolute difference, in hundredths of a star, between
+	// the address's ratings and the unweighted average rating of each product
+	Deviation int
+}
+
+// ReputationModel turns a reviewer's stats into a weight between 0 and MaxReputation
+// Models must use integer arithmetic only, so every node derives the same weights
+type ReputationModel func(stats ReviewerStats) int
+
+// Weights are in basis points
+const MaxReputation = 10000
+
+var ReputationModels = map[string]ReputationModel{
+	"default": DefaultReputation,
+	"uniform": UniformReputation,
+}
+
+// Saturation points of the default model, beyond which more of a stat adds nothing
+const (
+	reputationAgeBlocks = 100
+	reputationPurchases = 10
+	reputationSpend     = 500
+	reputationReviews   = 10
+)
+
+// DefaultReputation starts every reviewer at a tenth of the maximum weight and adds
+// up to the rest for account age (20%), purchases (25%), spend (15%), reviews
+// written (10%) and agreement with other reviewers (30%). Reviewers without
+// reviews count as agreeing half way.
+func DefaultReputation(stats ReviewerStats) int {
+	if stats.Age < 0 {
+		return MaxReputation / 10
+	}
+	age := saturate(stats.Age, reputationAgeBlocks)
+	purchases := saturate(stats.Purchases, reputationPurchases)
+	spend := saturate(stats.Spend, reputationSpend)
+	reviews := saturate(stats.Reviews, reputationReviews)
+	agreement := MaxReputation / 2
+	if stats.Reviews > 0 {
+		agreement = MaxReputation - saturate(stats.Deviation, (MaxRating-MinRating)*100)
+	}
+
+	combined := (2000*age + 2500*purchases + 1500*spend + 1000*reviews + 3000*agreement) / MaxReputation
+	return MaxReputation/10 + combined*9/10
+}
+
+// UniformReputation weighs every reviewer the same, making weighted scores plain averages
+func UniformReputation(stats ReviewerStats) int {
+	return MaxReputation
+}
+
+// saturate scales value to 0-MaxReputation, reaching the maximum at limit
+func saturate(value int, limit int) int {
+	if value >= limit {
+		return MaxReputation
+	}
+	if value <= 0 {
+		return 0
+	}
+	return value * MaxReputation / limit
+}
+
+// WeightedScore is a product's rating with each review weighted by its reviewer's
+// reputation. The sums are exact, Score is derived from them for display.
+type WeightedScore struct {
+	Reviews     int
+	Excluded    int // flagged reviews left out
+	WeightedSum int64
+	TotalWeight int64
+	Score       float64
+}
+
+// AccountIndex records when each address first appeared on chain and what it has
+// bought, the account history reputation is computed from
+type AccountIndex struct {
+	accounts map[string]*accountStats
+	height   int
+	Mutex    sync.RWMutex
+}
+
+type accountStats struct {
+	firstSeen int
+	purchases int
+	spend     int
+}
+
+func NewAccountIndex() *AccountIndex {
+	return &AccountIndex{
+		accounts: make(map[string]*accountStats),
+	}
+}
+
+func (ai *AccountIndex) ConnectBlock(b *Block, height int) {
+	ai.Mutex.Lock()
+	defer ai.Mutex.Unlock()
+	ai.height = height
+	for _, tx := range b.Transactions {
+		for _, address := range transactionAddresses(tx) {
+			if _, exists := ai.accounts[string(address)]; !exists {
+				ai.accounts[string(address)] = &accountStats{firstSeen: height}
+			}
+		}
+		// The buyer may only have cosigned, so it need not be among the addresses
+		if data, ok := tx.Data.(*PurchaseTransactionData); ok {
+			account, exists := ai.accounts[string(data.BuyerAddress)]
+			if !exists {
+				account = &accountStats{firstSeen: height}
+				ai.accounts[string(data.BuyerAddress)] = account
+			}
+			account.purchases++
+			account.spend += data.Amount
+		}
+	}
+}
+
+func (ai *AccountIndex) DisconnectBlock(b *Block, height int) {
+	ai.Mutex.Lock()
+	defer ai.Mutex.Unlock()
+	ai.height = height - 1
+	for _, tx := range b.Transactions {
+		if data, ok := tx.Data.(*PurchaseTransactionData); ok {
+			if account, exists := ai.accounts[string(data.BuyerAddress)]; exists {
+				account.purchases--
+				account.spend -= data.Amount
+			}
+		}
+	}
+	// Addresses first seen in this block were not on chain before it
+	for _, tx := range b.Transactions {
+		addresses := transactionAddresses(tx)
+		if data, ok := tx.Data.(*PurchaseTransactionData); ok {
+			addresses = append(addresses, data.BuyerAddress)
+		}
+		for _, address := range addresses {
+			if account, exists := ai.accounts[string(address)]; exists && account.firstSeen == height {
+				delete(ai.accounts, string(address))
+			}
+		}
+	}
+}
+
+// Account returns the age of address in blocks and its purchases and spend
+func (ai *AccountIndex) Account(address []byte) (age int, purchases int, spend int, exists bool) {
+	ai.Mutex.RLock()
+	defer ai.Mutex.RUnlock()
+	account, exists := ai.accounts[string(address)]
+	if !exists {
+		return 0, 0, 0, false
+	}
+	return ai.height - account.firstSeen, account.purchases, account.spend, true
+}
+
+// transactionAddresses lists the addresses a transaction pays or is authored by,
+// and those of the keys signing its inputs, cosigners included. Inputs unlocked by
+// a script alone have no signing key.
+func transactionAddresses(tx *Transaction) [][]byte {
+	var addresses [][]byte
+	for _, input := range tx.Inputs {
+		for _, publicKey := range input.Signers() {
+			if len(publicKey) > 0 {
+				addresses = append(addresses, crypto.AddressFromPublicKey(publicKey))
+			}
+		}
+	}
+	for _, output := range tx.Outputs {
+		addresses = append(addresses, output.Address)
+	}
+	if data, ok := tx.Data.(authoredData); ok {
+		address, _, _ := data.author()
+		addresses = append(addresses, address)
+	}
+	return addresses
+}
+
+// ReviewerStats gathers the stats of address from the account, review and rating indexes
+func (bc *Blockchain) ReviewerStats(address []byte) ReviewerStats {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	return bc.reviewerStats(address)
+}
+
+func (bc *Blockchain) reviewerStats(address []byte) ReviewerStats {
+	stats := ReviewerStats{Address: address, Age: -1}
+	if age, purchases, spend, exists := bc.Accounts.Account(address); exists {
+		stats.Age, stats.Purchases, stats.Spend = age, purchases, spend
+	}
+
+	deviation := 0
+	for _, review := range bc.Reviews.ReviewerReviews(address) {
+		latest := review.Latest()
+		if latest.Retracted {
+			continue
+		}
+		consensus := bc.Ratings.ProductRatings(review.ProductID, nil).Confirmed
+		if consensus.Count == 0 {
+			continue
+		}
+		difference := latest.Rating*100 - consensus.Sum*100/consensus.Count
+		if difference < 0 {
+			difference = -difference
+		}
+		deviation += difference
+		stats.Reviews++
+	}
+	if stats.Reviews > 0 {
+		stats.Deviation = deviation / stats.Reviews
+	}
+	return stats
+}
+
+// Reputation is the weight the chain's reputation model gives address
+func (bc *Blockchain) Reputation(address []byte) int {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	return bc.ReputationModel(bc.reviewerStats(address))
+}
+
+// ProductScore weighs the latest rating of every confirmed, unretracted review of
+// productID whose purchase was not refunded in full by its reviewer's reputation,
+// leaving out the reviews flagged by the sybil analysis if excludeFlagged is set
+func (bc *Blockchain) ProductScore(productID string, excludeFlagged bool) WeightedScore {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+
+	var flagged map[string]bool
+	if excludeFlagged {
+		flagged = bc.flaggedReviews(productID)
+	}
+
+	var score WeightedScore
+	for _, review := range bc.Reviews.ProductReviews(productID) {
+		latest := review.Latest()
+		if latest.Retracted || review.Refunded {
+			continue
+		}
+		if flagged[hex.EncodeToString(review.ID)] {
+			score.Excluded++
+			continue
+		}
+		weight := int64(bc.ReputationModel(bc.reviewerStats(review.ReviewerAddress)))
+		score.Reviews++
+		score.WeightedSum += weight * int64(latest.Rating)
+		score.TotalWeight += weight
+	}
+	if score.TotalWeight > 0 {
+		score.Score = float64(score.WeightedSum) / float64(score.TotalWeight)
+	}
+	return score
+}
@@ -0,0 +1,60 @@
+package blockchain
+
+import (
+	"testing"
+	"trustify/crypto"
+)
+
+func TestAccountIndexCosignedPurchase(t *testing.T) {
+	var keys [][]byte
+	for i := 0; i < 2; i++ {
+		pair, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, pair.PublicKey)
+	}
+	partner, buyer := crypto.AddressFromPublicKey(keys[0]), crypto.AddressFromPublicKey(keys[1])
+	seller := []byte("seller")
+
+	// The buyer only cosigns the multisig input, and the other input is unlocked by
+	// a script alone
+	purchase := &Transaction{
+		Inputs: []TxInput{
+			{PrevOut: UTXOTransactionID{TxID: []byte{1}}, PublicKey: keys[0], Cosigners: []InputSignature{{PublicKey: keys[1]}}},
+			{PrevOut: UTXOTransactionID{TxID: []byte{2}}, UnlockingScript: []byte{OP_1}},
+		},
+		Outputs: []TxOutput{{Address: seller, Amount: 25}},
+		Data:    &PurchaseTransactionData{BuyerAddress: buyer, SellerAddress: seller, ProductID: "p", Amount: 25},
+	}
+	purchase.ID = purchase.Hash()
+	b := &Block{Transactions: []*Transaction{purchase}, TransactionCount: 1}
+
+	ai := NewAccountIndex()
+	ai.ConnectBlock(&Block{Transactions: []*Transaction{testTx(&TransferTransactionData{})}}, 1)
+	ai.ConnectBlock(b, 2)
+	if _, purchases, spend, exists := ai.Account(buyer); !exists || purchases != 1 || spend != 25 {
+		t.Errorf("buyer has %d purchases for %d, exists %v", purchases, spend, exists)
+	}
+	if _, _, _, exists := ai.Account(partner); !exists {
+		t.Error("no account for the other signer")
+	}
+	if _, _, _, exists := ai.Account(crypto.AddressFromPublicKey(nil)); exists {
+		t.Error("account for the script-unlocked input")
+	}
+
+	ai.DisconnectBlock(b, 2)
+	for _, address := range [][]byte{buyer, partner, seller} {
+		if _, _, _, exists := ai.Account(address); exists {
+			t.Errorf("account %s kept after the disconnect", address)
+		}
+	}
+
+	// A buyer already on chain keeps its account, without the purchase
+	ai.ConnectBlock(&Block{Transactions: []*Transaction{testTx(&ReviewTransactionData{ReviewerAddress: buyer})}}, 2)
+	ai.ConnectBlock(b, 3)
+	ai.DisconnectBlock(b, 3)
+	if age, purchases, spend, exists := ai.Account(buyer); !exists || age != 0 || purchases != 0 || spend != 0 {
+		t.Errorf("buyer of age %d has %d purchases for %d, exists %v", age, purchases, spend, exists)
+	}
+}
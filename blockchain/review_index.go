@@ -0,0 +1,399 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ReviewIndex answers the questions review validation asks in constant time:
+// has this address bought the product in a confirmed purchase, and has it
+// already reviewed it. Both maps are keyed by address and product ID.
+// It also keeps every version of each confirmed review, so amendments and
+// retractions resolve to the latest version while the history stays queryable,
+// and counts the reviews committing to each content hash, which tells the node
+// which off-chain blobs are worth accepting from peers.
+// Purchases refunded in full no longer authorize reviews. A review whose purchase
+// is refunded after the fact is marked with the refund, and with whether it paid
+// back the whole purchase.
+type ReviewIndex struct {
+	purchases map[string][][]byte      // buyer and product -> IDs of confirmed purchases, oldest first
+	amounts   map[string]int           // hex purchase ID -> amount paid
+	refunds   map[string][]refund      // hex purchase ID -> its refunds, oldest first
+	authored  map[string][]byte        // hex purchase ID -> ID of the review it authorized
+	reviews   map[string][]byte        // reviewer and product -> ID of the confirmed review
+	records   map[string]*ReviewRecord // hex review ID -> the review and its versions
+	products  map[string][][]byte      // product -> IDs of its confirmed reviews, oldest first
+	reviewers map[string][][]byte      // reviewer -> IDs of its confirmed reviews, oldest first
+	contents  map[string]int           // hex content hash -> confirmed versions committing to it
+	Mutex     sync.RWMutex
+}
+
+// ReviewRecord is a confirmed review together with every version of it
+type ReviewRecord struct {
+	ID              []byte
+	ReviewerAddress []byte
+	ProductID       string
+	PurchaseID      []byte          // the purchase that authorized the review
+	RefundID        []byte          // the latest refund of that purchase, nil unless refunded
+	Refunded        bool            // whether the purchase has been refunded in full
+	Versions        []ReviewVersion // oldest first, the original review is Versions[0]
+}
+
+// ReviewVersion is the state of a review after its original transaction or one of
+// its amendments, or its retraction
+type ReviewVersion struct {
+	TxID        []byte
+	Height      int
+	Rating      int
+	Title       string
+	Body        string
+	ContentHash []byte
+	Retracted   bool
+}
+
+type refund struct {
+	id     []byte
+	amount int
+}
+
+func NewReviewIndex() *ReviewIndex {
+	return &ReviewIndex{
+		purchases: make(map[string][][]byte),
+		amounts:   make(map[string]int),
+		refunds:   make(map[string][]refund),
+		authored:  make(map[string][]byte),
+		reviews:   make(map[string][]byte),
+		records:   make(map[string]*ReviewRecord),
+		products:  make(map[string][][]byte),
+		reviewers: make(map[string][][]byte),
+		contents:  make(map[string]int),
+	}
+}
+
+func reviewKey(address []byte, productID string) string {
+	return fmt.Sprintf("%s/%s", address, productID)
+}
+
+// Latest is the current version of the review
+func (r *ReviewRecord) Latest() ReviewVersion {
+	return r.Versions[len(r.Versions)-1]
+}
+
+func (ri *ReviewIndex) ConnectBlock(b *Block, height int) {
+	ri.Mutex.Lock()
+	defer ri.Mutex.Unlock()
+	for _, tx := range b.Transactions {
+		if purchaseID, ok := refundedPurchase(tx); ok {
+			key := hex.EncodeToString(purchaseID)
+			ri.refunds[key] = append(ri.refunds[key], refund{id: tx.ID, amount: ri.refundAmount(tx, key)})
+			ri.markRefund(purchaseID)
+		}
+		switch data := tx.Data.(type) {
+		case *PurchaseTransactionData:
+			key := reviewKey(data.BuyerAddress, data.ProductID)
+			ri.purchases[key] = append(ri.purchases[key], tx.ID)
+			ri.amounts[hex.EncodeToString(tx.ID)] = data.Amount
+		case *ReviewTransactionData:
+			key := reviewKey(data.ReviewerAddress, data.ProductID)
+			purchaseID := ri.authorizingPurchase(key)
+			ri.authored[hex.EncodeToString(purchaseID)] = tx.ID
+			ri.reviews[key] = tx.ID
+			ri.products[data.ProductID] = append(ri.products[data.ProductID], tx.ID)
+			reviewer := string(data.ReviewerAddress)
+			ri.reviewers[reviewer] = append(ri.reviewers[reviewer], tx.ID)
+			ri.records[hex.EncodeToString(tx.ID)] = &ReviewRecord{
+				ID:              tx.ID,
+				ReviewerAddress: data.ReviewerAddress,
+				ProductID:       data.ProductID,
+				PurchaseID:      purchaseID,
+			}
+			ri.markRefund(purchaseID)
+			ri.addVersion(tx.ID, ReviewVersion{
+				TxID:        tx.ID,
+				Height:      height,
+				Rating:      data.Rating,
+				Title:       data.Title,
+				Body:        data.Body,
+				ContentHash: data.ContentHash,
+			})
+		case *ReviewAmendTransactionData:
+			ri.addVersion(data.ReviewID, ReviewVersion{
+				TxID:        tx.ID,
+				Height:      height,
+				Rating:      data.Rating,
+				Title:       data.Title,
+				Body:        data.Body,
+				ContentHash: data.ContentHash,
+			})
+		case *ReviewRetractTransactionData:
+			version := ri.records[hex.EncodeToString(data.ReviewID)].Latest()
+			version.TxID = tx.ID
+			version.Height = height
+			version.ContentHash = nil
+			version.Retracted = true
+			ri.addVersion(data.ReviewID, version)
+		}
+	}
+}
+
+func (ri *ReviewIndex) DisconnectBlock(b *Block, height int) {
+	ri.Mutex.Lock()
+	defer ri.Mutex.Unlock()
+	for i := len(b.Transactions) - 1; i >= 0; i-- {
+		tx := b.Transactions[i]
+		switch data := tx.Data.(type) {
+		case *PurchaseTransactionData:
+			key := reviewKey(data.BuyerAddress, data.ProductID)
+			ri.purchases[key] = removeID(ri.purchases[key], tx.ID)
+			if len(ri.purchases[key]) == 0 {
+				delete(ri.purchases, key)
+			}
+			delete(ri.amounts, hex.EncodeToString(tx.ID))
+		case *ReviewTransactionData:
+			ri.removeVersion(tx.ID)
+			delete(ri.authored, hex.EncodeToString(ri.records[hex.EncodeToString(tx.ID)].PurchaseID))
+			delete(ri.records, hex.EncodeToString(tx.ID))
+			delete(ri.reviews, reviewKey(data.ReviewerAddress, data.ProductID))
+			ri.products[data.ProductID] = removeID(ri.products[data.ProductID], tx.ID)
+			if len(ri.products[data.ProductID]) == 0 {
+				delete(ri.products, data.ProductID)
+			}
+			reviewer := string(data.ReviewerAddress)
+			ri.reviewers[reviewer] = removeID(ri.reviewers[reviewer], tx.ID)
+			if len(ri.reviewers[reviewer]) == 0 {
+				delete(ri.reviewers, reviewer)
+			}
+		case *ReviewAmendTransactionData:
+			ri.removeVersion(data.ReviewID)
+		case *ReviewRetractTransactionData:
+			ri.removeVersion(data.ReviewID)
+		}
+		if purchaseID, ok := refundedPurchase(tx); ok {
+			key := hex.EncodeToString(purchaseID)
+			ri.refunds[key] = ri.refunds[key][:len(ri.refunds[key])-1]
+			if len(ri.refunds[key]) == 0 {
+				delete(ri.refunds, key)
+			}
+			ri.markRefund(purchaseID)
+		}
+	}
+}
+
+// authorizingPurchase picks the purchase a new review under key rests on: the
+// earliest one not refunded in full, or the earliest if a refund earlier in the
+// same block has refunded them all
+func (ri *ReviewIndex) authorizingPurchase(key string) []byte {
+	ids := ri.purchases[key]
+	for _, id := range ids {
+		if ri.remaining(hex.EncodeToString(id)) > 0 {
+			return id
+		}
+	}
+	return ids[0]
+}
+
+// refundAmount is how much of the purchase tx pays back: the amount of a refund, or
+// all that is left for an escrow refund, which returns the whole escrow
+func (ri *ReviewIndex) refundAmount(tx *Transaction, purchase string) int {
+	if data, ok := tx.Data.(*RefundTransactionData); ok {
+		return data.Amount
+	}
+	return ri.remaining(purchase)
+}
+
+// remaining is what is left of the amount of the purchase after its refunds
+func (ri *ReviewIndex) remaining(purchase string) int {
+	remaining := ri.amounts[purchase]
+	for _, refund := range ri.refunds[purchase] {
+		remaining -= refund.amount
+	}
+	return remaining
+}
+
+// markRefund updates the refund of the review authorized by purchaseID, if any
+func (ri *ReviewIndex) markRefund(purchaseID []byte) {
+	key := hex.EncodeToString(purchaseID)
+	reviewID, exists := ri.authored[key]
+	if !exists {
+		return
+	}
+	record := ri.records[hex.EncodeToString(reviewID)]
+	record.RefundID, record.Refunded = nil, false
+	if refunds := ri.refunds[key]; len(refunds) > 0 {
+		record.RefundID = refunds[len(refunds)-1].id
+		record.Refunded = ri.remaining(key) <= 0
+	}
+}
+
+func (ri *ReviewIndex) addVersion(reviewID []byte, version ReviewVersion) {
+	record := ri.records[hex.EncodeToString(reviewID)]
+	record.Versions = append(record.Versions, version)
+	if len(version.ContentHash) > 0 {
+		ri.contents[hex.EncodeToString(version.ContentHash)]++
+	}
+}
+
+func (ri *ReviewIndex) removeVersion(reviewID []byte) {
+	record := ri.records[hex.EncodeToString(reviewID)]
+	version := record.Latest()
+	record.Versions = record.Versions[:len(record.Versions)-1]
+	if len(version.ContentHash) > 0 {
+		key := hex.EncodeToString(version.ContentHash)
+		if ri.contents[key]--; ri.contents[key] <= 0 {
+			delete(ri.contents, key)
+		}
+	}
+}
+
+// Purchase returns the earliest confirmed purchase of productID by buyer
+func (ri *ReviewIndex) Purchase(buyer []byte, productID string) ([]byte, bool) {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	ids := ri.purchases[reviewKey(buyer, productID)]
+	if len(ids) == 0 {
+		return nil, false
+	}
+	return ids[0], true
+}
+
+// Refund returns the latest confirmed refund of the purchase purchaseID, nil if
+// there is none, and what is left of the purchase's amount after its refunds
+func (ri *ReviewIndex) Refund(purchaseID []byte) ([]byte, int) {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	key := hex.EncodeToString(purchaseID)
+	var id []byte
+	if refunds := ri.refunds[key]; len(refunds) > 0 {
+		id = refunds[len(refunds)-1].id
+	}
+	return id, ri.remaining(key)
+}
+
+// Refunded reports whether buyer has bought productID in confirmed purchases that
+// have all been refunded in full
+func (ri *ReviewIndex) Refunded(buyer []byte, productID string) bool {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	ids := ri.purchases[reviewKey(buyer, productID)]
+	for _, id := range ids {
+		if ri.remaining(hex.EncodeToString(id)) > 0 {
+			return false
+		}
+	}
+	return len(ids) > 0
+}
+
+// Review returns the confirmed review of productID by reviewer
+func (ri *ReviewIndex) Review(reviewer []byte, productID string) ([]byte, bool) {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	id, exists := ri.reviews[reviewKey(reviewer, productID)]
+	return id, exists
+}
+
+// History returns a copy of the confirmed review reviewID with all its versions
+func (ri *ReviewIndex) History(reviewID []byte) (*ReviewRecord, bool) {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	record, exists := ri.records[hex.EncodeToString(reviewID)]
+	if !exists {
+		return nil, false
+	}
+	return record.copy(), true
+}
+
+// ProductReviews returns copies of the confirmed reviews of productID, oldest first,
+// including retracted ones, whose latest version says so
+func (ri *ReviewIndex) ProductReviews(productID string) []*ReviewRecord {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	var records []*ReviewRecord
+	for _, id := range ri.products[productID] {
+		records = append(records, ri.records[hex.EncodeToString(id)].copy())
+	}
+	return records
+}
+
+// ReviewedProducts lists every product with a confirmed review, sorted
+func (ri *ReviewIndex) ReviewedProducts() []string {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	products := make([]string, 0, len(ri.products))
+	for productID := range ri.products {
+		products = append(products, productID)
+	}
+	sort.Strings(products)
+	return products
+}
+
+// ReviewerReviews returns copies of the confirmed reviews written by reviewer, oldest
+// first, including retracted ones
+func (ri *ReviewIndex) ReviewerReviews(reviewer []byte) []*ReviewRecord {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	var records []*ReviewRecord
+	for _, id := range ri.reviewers[string(reviewer)] {
+		records = append(records, ri.records[hex.EncodeToString(id)].copy())
+	}
+	return records
+}
+
+// ReferencesContent reports whether a confirmed review version commits to the content hash
+func (ri *ReviewIndex) ReferencesContent(hash []byte) bool {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	return ri.contents[hex.EncodeToString(hash)] > 0
+}
+
+// CheckReview applies the review rules that depend on the chain: the reviewer
+// must have a confirmed purchase of the product that has not been refunded, and no
+// confirmed review of it
+func (ri *ReviewIndex) CheckReview(data *ReviewTransactionData) error {
+	if _, purchased := ri.Purchase(data.ReviewerAddress, data.ProductID); !purchased {
+		return fmt.Errorf("%w: %s has not bought %s", ErrReviewNotPurchased, data.ReviewerAddress, data.ProductID)
+	}
+	if ri.Refunded(data.ReviewerAddress, data.ProductID) {
+		return fmt.Errorf("%w: every purchase of %s by %s", ErrPurchaseRefunded, data.ProductID, data.ReviewerAddress)
+	}
+	if id, reviewed := ri.Review(data.ReviewerAddress, data.ProductID); reviewed {
+		return fmt.Errorf("%w: %s already reviewed %s in %x", ErrReviewDuplicate, data.ReviewerAddress, data.ProductID, id)
+	}
+	return nil
+}
+
+// CheckRevision applies the rules for amending or retracting reviewID on behalf of
+// reviewer: the review must be confirmed, written by reviewer and not retracted
+// That reviewer signed the revision is checked by Transaction.Verify
+func (ri *ReviewIndex) CheckRevision(reviewID []byte, reviewer []byte) error {
+	ri.Mutex.RLock()
+	defer ri.Mutex.RUnlock()
+	record, exists := ri.records[hex.EncodeToString(reviewID)]
+	if !exists {
+		return fmt.Errorf("%w: %x", ErrReviewNotFound, reviewID)
+	}
+	if !bytes.Equal(record.ReviewerAddress, reviewer) {
+		return fmt.Errorf("%w: %x was written by %s", ErrInvalidSignature, reviewID, record.ReviewerAddress)
+	}
+	if record.Latest().Retracted {
+		return fmt.Errorf("%w: %x", ErrReviewRetracted, reviewID)
+	}
+	return nil
+}
+
+func (r *ReviewRecord) copy() *ReviewRecord {
+	record := *r
+	record.Versions = append([]ReviewVersion(nil), r.Versions...)
+	return &record
+}
+
+func removeID(ids [][]byte, id []byte) [][]byte {
+	for i := range ids {
+		if bytes.Equal(ids[i], id) {
+			return append(ids[:i:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,689 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"trustify/crypto"
+)
+
+// Scripts are a small stack language for spending conditions. An output with a
+// LockingScript pays the script address of that script, and an input spending it
+// supplies an UnlockingScript of data pushes. The unlocking script runs first, then
+// the locking script on the stack it left, and the spend is authorized if the top
+// of the stack is then true.
+//
+// There are no loops or jumps, so a script runs each opcode at most once, and the
+// limits below bound the work any script can cause.
+
+// Script opcodes, numbered as in Bitcoin where they exist there
+const (
+	OP_0                   byte = 0x00
+	OP_PUSHDATA1           byte = 0x4c
+	OP_PUSHDATA2           byte = 0x4d
+	OP_1NEGATE             byte = 0x4f
+	OP_1                   byte = 0x51
+	OP_16                  byte = 0x60
+	OP_NOP                 byte = 0x61
+	OP_IF                  byte = 0x63
+	OP_NOTIF               byte = 0x64
+	OP_ELSE                byte = 0x67
+	OP_ENDIF               byte = 0x68
+	OP_VERIFY              byte = 0x69
+	OP_RETURN              byte = 0x6a
+	OP_DROP                byte = 0x75
+	OP_DUP                 byte = 0x76
+	OP_SWAP                byte = 0x7c
+	OP_SIZE                byte = 0x82
+	OP_EQUAL               byte = 0x87
+	OP_EQUALVERIFY         byte = 0x88
+	OP_SHA256              byte = 0xa8
+	OP_HASH160             byte = 0xa9
+	OP_CHECKSIG            byte = 0xac
+	OP_CHECKSIGVERIFY      byte = 0xad
+	OP_CHECKMULTISIG       byte = 0xae
+	OP_CHECKMULTISIGVERIFY byte = 0xaf
+	OP_CHECKLOCKTIMEVERIFY byte = 0xb1
+	OP_CHECKSEQUENCEVERIFY byte = 0xb2
+)
+
+const (
+	// Limit in bytes on a locking or unlocking script
+	MaxScriptSize = 1000
+
+	// Limit in bytes on a single pushed value
+	MaxScriptElementSize = 520
+
+	// Limit on opcodes other than pushes executed by one script, counting each
+	// key of a multisig check
+	MaxScriptOps = 100
+
+	// Limit on the items on the stack at any time
+	MaxStackSize = 100
+
+	// Numbers from a script are at most this many bytes, enough for lock times
+	maxScriptNumSize = 5
+
+	// Lock times below this are block heights, at or above it Unix times
+	LockTimeThreshold = 500000000
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_1NEGATE:             "OP_1NEGATE",
+	OP_NOP:                 "OP_NOP",
+	OP_IF:                  "OP_IF",
+	OP_NOTIF:               "OP_NOTIF",
+	OP_ELSE:                "OP_ELSE",
+	OP_ENDIF:               "OP_ENDIF",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_SWAP:                "OP_SWAP",
+	OP_SIZE:                "OP_SIZE",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_SHA256:              "OP_SHA256",
+	OP_HASH160:             "OP_HASH160",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY:      "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+func init() {
+	for n := OP_1; n <= OP_16; n++ {
+		opcodeNames[n] = fmt.Sprintf("OP_%d", n-OP_1+1)
+	}
+}
+
+// scriptOp is one decoded instruction, Data set for pushes
+type scriptOp struct {
+	Opcode byte
+	Data   []byte
+}
+
+func (op scriptOp) isPush() bool {
+	return op.Opcode <= OP_16 && op.Opcode != 0x50
+}
+
+// parseScript decodes script into instructions, rejecting unknown opcodes,
+// truncated pushes and anything over the size limits
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > MaxScriptSize {
+		return nil, fmt.Errorf("%w: script of %d bytes, at most %d", ErrScriptInvalid, len(script), MaxScriptSize)
+	}
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+		size := -1
+		switch {
+		case opcode > OP_0 && opcode < OP_PUSHDATA1:
+			size = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA1", ErrScriptInvalid)
+			}
+			size = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, fmt.Errorf("%w: truncated OP_PUSHDATA2", ErrScriptInvalid)
+			}
+			size = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		default:
+			if _, known := opcodeNames[opcode]; !known {
+				return nil, fmt.Errorf("%w: unknown opcode 0x%02x", ErrScriptInvalid, opcode)
+			}
+		}
+		op := scriptOp{Opcode: opcode}
+		if size >= 0 {
+			if size > MaxScriptElementSize {
+				return nil, fmt.Errorf("%w: push of %d bytes, at most %d", ErrScriptInvalid, size, MaxScriptElementSize)
+			}
+			if i+size > len(script) {
+				return nil, fmt.Errorf("%w: push of %d bytes past the end", ErrScriptInvalid, size)
+			}
+			op.Data = script[i : i+size]
+			i += size
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// DisassembleScript renders script as opcode names and hex pushes
+func DisassembleScript(script []byte) (string, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return "", err
+	}
+	words := make([]string, len(ops))
+	for i, op := range ops {
+		if op.Data != nil {
+			words[i] = hex.EncodeToString(op.Data)
+			continue
+		}
+		words[i] = opcodeNames[op.Opcode]
+	}
+	return strings.Join(words, " "), nil
+}
+
+// ScriptBuilder assembles a script one instruction at a time
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+// AddOp appends opcodes
+func (b *ScriptBuilder) AddOp(opcodes ...byte) *ScriptBuilder {
+	b.script = append(b.script, opcodes...)
+	return b
+}
+
+// AddData appends the shortest push of data
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch size := len(data); {
+	case size == 0:
+		b.script = append(b.script, OP_0)
+	case size < int(OP_PUSHDATA1):
+		b.script = append(b.script, byte(size))
+	case size <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(size))
+	default:
+		b.script = append(b.script, OP_PUSHDATA2, byte(size), byte(size>>8))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+// AddInt appends a push of n, using the small number opcodes where they exist
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(OP_1 + byte(n-1))
+	}
+	return b.AddData(encodeScriptNum(n))
+}
+
+// Script returns the assembled script
+func (b *ScriptBuilder) Script() []byte {
+	return append([]byte(nil), b.script...)
+}
+
+// encodeScriptNum encodes n little-endian in as few bytes as possible, the sign in
+// the top bit of the last byte
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+	var result []byte
+	for n > 0 {
+		result = append(result, byte(n&0xff))
+		n >>= 8
+	}
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+// decodeScriptNum decodes a number pushed by a script, which must be minimally encoded
+func decodeScriptNum(data []byte) (int64, error) {
+	if len(data) > maxScriptNumSize {
+		return 0, fmt.Errorf("%w: number of %d bytes, at most %d", ErrScriptFailed, len(data), maxScriptNumSize)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	if data[len(data)-1]&0x7f == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) {
+		return 0, fmt.Errorf("%w: number %x not minimally encoded", ErrScriptFailed, data)
+	}
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << (8 * i)
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		n &^= int64(0x80) << (8 * (len(data) - 1))
+		return -n, nil
+	}
+	return n, nil
+}
+
+// scriptBool is the truth of a stack item: false if every byte is zero, allowing
+// for a negative zero
+func scriptBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			return i != len(data)-1 || b != 0x80
+		}
+	}
+	return false
+}
+
+// scriptEngine runs the scripts authorizing one input of tx
+type scriptEngine struct {
+	tx    *Transaction
+	input *TxInput
+	ctx   *SpendContext
+	stack [][]byte
+	ops   int
+	// The first lock not yet reached, which does not stop the rest of the script
+	// being checked
+	locked error
+}
+
+// checkScript runs the unlocking script of input against the locking script of
+// the output it spends
+func (tx *Transaction) checkScript(input *TxInput, lockingScript []byte, ctx *SpendContext) error {
+	unlocking, err := parseScript(input.UnlockingScript)
+	if err != nil {
+		return err
+	}
+	for _, op := range unlocking {
+		if !op.isPush() {
+			return fmt.Errorf("%w: unlocking script may only push data", ErrScriptInvalid)
+		}
+	}
+	locking, err := parseScript(lockingScript)
+	if err != nil {
+		return err
+	}
+
+	engine := &scriptEngine{tx: tx, input: input, ctx: ctx}
+	if err := engine.run(unlocking); err != nil {
+		return err
+	}
+	if err := engine.run(locking); err != nil {
+		return err
+	}
+	if len(engine.stack) == 0 || !scriptBool(engine.stack[len(engine.stack)-1]) {
+		return fmt.Errorf("%w: script left false", ErrScriptFailed)
+	}
+	return engine.locked
+}
+
+func (e *scriptEngine) push(data []byte) error {
+	if len(e.stack) >= MaxStackSize {
+		return fmt.Errorf("%w: stack over %d items", ErrScriptFailed, MaxStackSize)
+	}
+	e.stack = append(e.stack, data)
+	return nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack empty", ErrScriptFailed)
+	}
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return top, nil
+}
+
+func (e *scriptEngine) popInt() (int64, error) {
+	data, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data)
+}
+
+func (e *scriptEngine) pushBool(v bool) error {
+	if v {
+		return e.push([]byte{1})
+	}
+	return e.push(nil)
+}
+
+// count charges n operations against MaxScriptOps
+func (e *scriptEngine) count(n int) error {
+	e.ops += n
+	if e.ops > MaxScriptOps {
+		return fmt.Errorf("%w: over %d operations", ErrScriptFailed, MaxScriptOps)
+	}
+	return nil
+}
+
+func (e *scriptEngine) run(ops []scriptOp) error {
+	e.ops = 0
+	// One entry per open OP_IF, whether its branch being run is taken
+	var branches []bool
+	executing := func() bool {
+		for _, taken := range branches {
+			if !taken {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range ops {
+		if !op.isPush() {
+			if err := e.count(1); err != nil {
+				return err
+			}
+		}
+		switch op.Opcode {
+		case OP_IF, OP_NOTIF:
+			taken := false
+			if executing() {
+				top, err := e.pop()
+				if err != nil {
+					return err
+				}
+				taken = scriptBool(top) == (op.Opcode == OP_IF)
+			}
+			branches = append(branches, taken)
+			continue
+		case OP_ELSE:
+			if len(branches) == 0 {
+				return fmt.Errorf("%w: OP_ELSE without OP_IF", ErrScriptFailed)
+			}
+			branches[len(branches)-1] = !branches[len(branches)-1]
+			continue
+		case OP_ENDIF:
+			if len(branches) == 0 {
+				return fmt.Errorf("%w: OP_ENDIF without OP_IF", ErrScriptFailed)
+			}
+			branches = branches[:len(branches)-1]
+			continue
+		}
+		if !executing() {
+			continue
+		}
+		if err := e.step(op); err != nil {
+			return err
+		}
+	}
+	if len(branches) != 0 {
+		return fmt.Errorf("%w: OP_IF without OP_ENDIF", ErrScriptFailed)
+	}
+	return nil
+}
+
+// step executes one instruction outside the flow control opcodes
+func (e *scriptEngine) step(op scriptOp) error {
+	switch {
+	case op.Data != nil:
+		return e.push(op.Data)
+	case op.Opcode == OP_0:
+		return e.push(nil)
+	case op.Opcode == OP_1NEGATE:
+		return e.push(encodeScriptNum(-1))
+	case op.Opcode >= OP_1 && op.Opcode <= OP_16:
+		return e.push(encodeScriptNum(int64(op.Opcode - OP_1 + 1)))
+	}
+
+	switch op.Opcode {
+	case OP_NOP:
+		return nil
+	case OP_RETURN:
+		return fmt.Errorf("%w: OP_RETURN", ErrScriptFailed)
+	case OP_VERIFY:
+		return e.verify()
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		if len(e.stack) == 0 {
+			return fmt.Errorf("%w: stack empty", ErrScriptFailed)
+		}
+		return e.push(e.stack[len(e.stack)-1])
+	case OP_SWAP:
+		if len(e.stack) < 2 {
+			return fmt.Errorf("%w: OP_SWAP needs two items", ErrScriptFailed)
+		}
+		n := len(e.stack)
+		e.stack[n-1], e.stack[n-2] = e.stack[n-2], e.stack[n-1]
+		return nil
+	case OP_SIZE:
+		if len(e.stack) == 0 {
+			return fmt.Errorf("%w: stack empty", ErrScriptFailed)
+		}
+		return e.push(encodeScriptNum(int64(len(e.stack[len(e.stack)-1]))))
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if err := e.pushBool(bytes.Equal(a, b)); err != nil {
+			return err
+		}
+		if op.Opcode == OP_EQUALVERIFY {
+			return e.verify()
+		}
+		return nil
+	case OP_SHA256:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		return e.push(hash[:])
+	case OP_HASH160:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(crypto.PublicKeyHash(data))
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		publicKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if err := e.pushBool(crypto.Verify(e.tx.ID, signature, publicKey)); err != nil {
+			return err
+		}
+		if op.Opcode == OP_CHECKSIGVERIFY {
+			return e.verify()
+		}
+		return nil
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		if err := e.checkMultisig(); err != nil {
+			return err
+		}
+		if op.Opcode == OP_CHECKMULTISIGVERIFY {
+			return e.verify()
+		}
+		return nil
+	case OP_CHECKLOCKTIMEVERIFY:
+		return e.checkLockTime()
+	case OP_CHECKSEQUENCEVERIFY:
+		return e.checkSequence()
+	}
+	return fmt.Errorf("%w: unknown opcode 0x%02x", ErrScriptInvalid, op.Opcode)
+}
+
+func (e *scriptEngine) verify() error {
+	top, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if !scriptBool(top) {
+		return fmt.Errorf("%w: verify failed", ErrScriptFailed)
+	}
+	return nil
+}
+
+// checkMultisig pops n keys and m signatures, each count pushed after its items,
+// and pushes whether the signatures are by m of the keys in the same order
+func (e *scriptEngine) checkMultisig() error {
+	n, err := e.popInt()
+	if err != nil {
+		return err
+	}
+	if n < 1 || n > MaxMultisigKeys {
+		return fmt.Errorf("%w: multisig of %d keys", ErrScriptFailed, n)
+	}
+	if err := e.count(int(n)); err != nil {
+		return err
+	}
+	publicKeys := make([][]byte, n)
+	for i := int(n) - 1; i >= 0; i-- {
+		if publicKeys[i], err = e.pop(); err != nil {
+			return err
+		}
+	}
+	m, err := e.popInt()
+	if err != nil {
+		return err
+	}
+	if m < 0 || m > n {
+		return fmt.Errorf("%w: multisig threshold %d of %d", ErrScriptFailed, m, n)
+	}
+	signatures := make([][]byte, m)
+	for i := int(m) - 1; i >= 0; i-- {
+		if signatures[i], err = e.pop(); err != nil {
+			return err
+		}
+	}
+
+	key := 0
+	for _, signature := range signatures {
+		for key < len(publicKeys) && !crypto.Verify(e.tx.ID, signature, publicKeys[key]) {
+			key++
+		}
+		if key == len(publicKeys) {
+			return e.pushBool(false)
+		}
+		key++
+	}
+	return e.pushBool(true)
+}
+
+// checkLockTime requires the spend to be in a block at or after the height or time
+// on top of the stack, which it leaves there. An unreached lock makes the
+// transaction not final rather than invalid.
+func (e *scriptEngine) checkLockTime() error {
+	if len(e.stack) == 0 {
+		return fmt.Errorf("%w: stack empty", ErrScriptFailed)
+	}
+	lock, err := decodeScriptNum(e.stack[len(e.stack)-1])
+	if err != nil {
+		return err
+	}
+	var locked error
+	switch {
+	case lock < 0:
+		return fmt.Errorf("%w: negative lock time", ErrScriptFailed)
+	case lock < LockTimeThreshold && lock > int64(e.ctx.Height):
+		locked = fmt.Errorf("%w: script locked until height %d", ErrTxNotFinal, lock)
+	case lock >= LockTimeThreshold && lock > e.ctx.MedianTime:
+		locked = fmt.Errorf("%w: script locked until time %d", ErrTxNotFinal, lock)
+	}
+	if e.locked == nil {
+		e.locked = locked
+	}
+	return nil
+}
+
+// checkSequence fails unless the input carries a relative lock of at least the
+// blocks on top of the stack, which it leaves there. The lock itself is enforced
+// with the other relative locks.
+func (e *scriptEngine) checkSequence() error {
+	if len(e.stack) == 0 {
+		return fmt.Errorf("%w: stack empty", ErrScriptFailed)
+	}
+	blocks, err := decodeScriptNum(e.stack[len(e.stack)-1])
+	if err != nil {
+		return err
+	}
+	if blocks < 0 || blocks > int64(e.input.RelativeHeight) {
+		return fmt.Errorf("%w: input relative lock %d below %d blocks", ErrScriptFailed, e.input.RelativeHeight, blocks)
+	}
+	return nil
+}
+
+// PayToPubKeyHashScript locks an output to the key whose hash is pubKeyHash
+func PayToPubKeyHashScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(OP_DUP, OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY, OP_CHECKSIG).
+		Script()
+}
+
+// MultisigScript locks an output to threshold signatures by publicKeys, given in
+// the order the signatures must follow
+func MultisigScript(threshold int, publicKeys [][]byte) []byte {
+	b := NewScriptBuilder().AddInt(int64(threshold))
+	for _, publicKey := range publicKeys {
+		b.AddData(publicKey)
+	}
+	return b.AddInt(int64(len(publicKeys))).AddOp(OP_CHECKMULTISIG).Script()
+}
+
+// HashLockScript locks an output to whoever reveals the preimage of the SHA-256
+// hash and signs with the key whose hash is pubKeyHash
+func HashLockScript(hash []byte, pubKeyHash []byte) []byte {
+	return NewScriptBuilder().
+		AddOp(OP_SHA256).AddData(hash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP, OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY, OP_CHECKSIG).
+		Script()
+}
+
+// TimeLockScript locks an output to the key whose hash is pubKeyHash until lock,
+// a block height or, from LockTimeThreshold, a Unix time
+func TimeLockScript(lock int64, pubKeyHash []byte) []byte {
+	return NewScriptBuilder().
+		AddInt(lock).AddOp(OP_CHECKLOCKTIMEVERIFY, OP_DROP).
+		AddOp(OP_DUP, OP_HASH160).AddData(pubKeyHash).AddOp(OP_EQUALVERIFY, OP_CHECKSIG).
+		Script()
+}
+
+// NewScriptOutput pays amount to the address of lockingScript
+func NewScriptOutput(lockingScript []byte, amount int) (TxOutput, error) {
+	if _, err := parseScript(lockingScript); err != nil {
+		return TxOutput{}, err
+	}
+	return TxOutput{Address: crypto.ScriptAddress(lockingScript), Amount: amount, LockingScript: lockingScript}, nil
+}
+
+// ScriptSignature signs tx as it stands, for a signature to push in an unlocking
+// script. Unlocking scripts are not part of the ID, so they can be filled in after.
+func (tx *Transaction) ScriptSignature(privKey []byte) ([]byte, error) {
+	tx.ID = tx.Hash()
+	return crypto.Sign(tx.ID, privKey)
+}
+
+// UnlockingScript pushes items in order, for an input's UnlockingScript
+func UnlockingScript(items ...[]byte) []byte {
+	b := NewScriptBuilder()
+	for _, item := range items {
+		b.AddData(item)
+	}
+	return b.Script()
+}
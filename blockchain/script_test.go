@@ -0,0 +1,155 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"trustify/crypto"
+	"trustify/types"
+)
+
+func TestScriptVectors(t *testing.T) {
+	tx := &Transaction{
+		Type:    types.TransactionTypeTransfer,
+		Inputs:  []TxInput{{PrevOut: UTXOTransactionID{TxID: make([]byte, 32), Index: 0}}},
+		Outputs: []TxOutput{{Address: []byte("1BoatSLRHtKNngkdXEeobR76b53LETtpyT"), Amount: 1}},
+		Data:    &TransferTransactionData{},
+	}
+	var publicKeys, signatures [][]byte
+	for i := 0; i < 3; i++ {
+		keys, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := tx.ScriptSignature(keys.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicKeys = append(publicKeys, keys.PublicKey)
+		signatures = append(signatures, signature)
+	}
+	pkh := crypto.PublicKeyHash(publicKeys[0])
+	preimage := []byte("swap secret")
+	hash := sha256.Sum256(preimage)
+	maxKeys := make([][]byte, MaxMultisigKeys)
+	for i := range maxKeys {
+		maxKeys[i] = publicKeys[i%len(publicKeys)]
+	}
+	// Keys too short to verify, as n is checked before any key is used and real ones
+	// would not fit in a script
+	tooManyKeys := make([][]byte, MaxMultisigKeys+1)
+	for i := range tooManyKeys {
+		tooManyKeys[i] = []byte{byte(i + 1)}
+	}
+	nops := func(n int) []byte {
+		return append(bytes.Repeat([]byte{OP_NOP}, n), OP_1)
+	}
+	ones := func(n int) []byte { return bytes.Repeat([]byte{OP_1}, n) }
+	build := func() *ScriptBuilder { return NewScriptBuilder() }
+
+	tests := []struct {
+		name           string
+		unlocking      []byte
+		locking        []byte
+		relativeHeight int
+		height         int
+		medianTime     int64
+		want           error
+	}{
+		{name: "p2pkh", unlocking: UnlockingScript(signatures[0], publicKeys[0]), locking: PayToPubKeyHashScript(pkh)},
+		{name: "p2pkh other key", unlocking: UnlockingScript(signatures[1], publicKeys[1]), locking: PayToPubKeyHashScript(pkh), want: ErrScriptFailed},
+		{name: "p2pkh other signature", unlocking: UnlockingScript(signatures[1], publicKeys[0]), locking: PayToPubKeyHashScript(pkh), want: ErrScriptFailed},
+		{name: "p2pkh no signature", unlocking: UnlockingScript(publicKeys[0]), locking: PayToPubKeyHashScript(pkh), want: ErrScriptFailed},
+
+		{name: "multisig in order", unlocking: UnlockingScript(signatures[0], signatures[2]), locking: MultisigScript(2, publicKeys)},
+		{name: "multisig out of order", unlocking: UnlockingScript(signatures[2], signatures[0]), locking: MultisigScript(2, publicKeys), want: ErrScriptFailed},
+		{name: "multisig signature repeated", unlocking: UnlockingScript(signatures[0], signatures[0]), locking: MultisigScript(2, publicKeys), want: ErrScriptFailed},
+		{name: "multisig too few signatures", unlocking: UnlockingScript(signatures[0]), locking: MultisigScript(2, publicKeys), want: ErrScriptFailed},
+		{name: "multisig m=0", locking: MultisigScript(0, publicKeys)},
+		{name: "multisig m above n", unlocking: UnlockingScript(signatures[0], signatures[1], signatures[2]), locking: MultisigScript(3, publicKeys[:2]), want: ErrScriptFailed},
+		{name: "multisig n=0", locking: build().AddOp(OP_0, OP_0, OP_CHECKMULTISIG).Script(), want: ErrScriptFailed},
+		{name: "multisig n above the limit", unlocking: UnlockingScript(signatures[0]), locking: MultisigScript(1, tooManyKeys), want: ErrScriptFailed},
+		{name: "multisig n at the limit", unlocking: UnlockingScript(signatures[0]), locking: MultisigScript(1, maxKeys)},
+
+		{name: "hash lock", unlocking: UnlockingScript(signatures[0], publicKeys[0], preimage), locking: HashLockScript(hash[:], pkh)},
+		{name: "hash lock wrong preimage", unlocking: UnlockingScript(signatures[0], publicKeys[0], []byte("guess")), locking: HashLockScript(hash[:], pkh), want: ErrScriptFailed},
+		{name: "hash lock other key", unlocking: UnlockingScript(signatures[1], publicKeys[1], preimage), locking: HashLockScript(hash[:], pkh), want: ErrScriptFailed},
+
+		{name: "cltv height reached", unlocking: UnlockingScript(signatures[0], publicKeys[0]), locking: TimeLockScript(100, pkh), height: 100},
+		{name: "cltv height not reached", unlocking: UnlockingScript(signatures[0], publicKeys[0]), locking: TimeLockScript(100, pkh), height: 99, want: ErrTxNotFinal},
+		{name: "cltv time reached", unlocking: UnlockingScript(signatures[0], publicKeys[0]), locking: TimeLockScript(LockTimeThreshold+1000, pkh), height: 1, medianTime: LockTimeThreshold + 1000},
+		{name: "cltv time not reached", unlocking: UnlockingScript(signatures[0], publicKeys[0]), locking: TimeLockScript(LockTimeThreshold+1000, pkh), height: 1_000_000, medianTime: LockTimeThreshold + 999, want: ErrTxNotFinal},
+		{name: "cltv negative", locking: build().AddInt(-1).AddOp(OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_1).Script(), height: 100, want: ErrScriptFailed},
+		{name: "cltv empty stack", locking: []byte{OP_CHECKLOCKTIMEVERIFY}, want: ErrScriptFailed},
+		{name: "cltv locked but otherwise failing", unlocking: UnlockingScript(signatures[1], publicKeys[1]), locking: TimeLockScript(100, pkh), height: 99, want: ErrScriptFailed},
+
+		{name: "csv", locking: build().AddInt(10).AddOp(OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1).Script(), relativeHeight: 10},
+		{name: "csv longer input lock", locking: build().AddInt(10).AddOp(OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1).Script(), relativeHeight: 11},
+		{name: "csv input lock too short", locking: build().AddInt(10).AddOp(OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1).Script(), relativeHeight: 9, want: ErrScriptFailed},
+		{name: "csv negative", locking: build().AddInt(-1).AddOp(OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1).Script(), relativeHeight: 10, want: ErrScriptFailed},
+
+		{name: "ops at the limit", locking: nops(MaxScriptOps)},
+		{name: "ops over the limit", locking: nops(MaxScriptOps + 1), want: ErrScriptFailed},
+		{name: "multisig keys count as ops", unlocking: UnlockingScript(signatures[0]), locking: append(bytes.Repeat([]byte{OP_NOP}, MaxScriptOps-3), MultisigScript(1, publicKeys)...), want: ErrScriptFailed},
+		{name: "stack at the limit", unlocking: ones(MaxStackSize)},
+		{name: "stack over the limit", unlocking: ones(MaxStackSize), locking: []byte{OP_1}, want: ErrScriptFailed},
+		{name: "element at the limit", locking: build().AddData(bytes.Repeat([]byte{1}, MaxScriptElementSize)).Script()},
+		{name: "element over the limit", locking: build().AddData(bytes.Repeat([]byte{1}, MaxScriptElementSize+1)).Script(), want: ErrScriptInvalid},
+		{name: "script over the limit", locking: nops(MaxScriptSize), want: ErrScriptInvalid},
+
+		{name: "minimal number", locking: build().AddData([]byte{0x64}).AddOp(OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_1).Script(), height: 100},
+		{name: "number padded with zero", locking: build().AddData([]byte{0x64, 0x00}).AddOp(OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_1).Script(), height: 100, want: ErrScriptFailed},
+		{name: "number negative zero", locking: build().AddData([]byte{0x80}).AddOp(OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1).Script(), want: ErrScriptFailed},
+		{name: "number zero byte", locking: build().AddData([]byte{0x00}).AddOp(OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1).Script(), want: ErrScriptFailed},
+		{name: "number with sign byte", locking: build().AddData([]byte{0xff, 0x00}).AddOp(OP_CHECKSEQUENCEVERIFY, OP_DROP, OP_1).Script(), relativeHeight: 255},
+		{name: "number too long", locking: build().AddData([]byte{1, 2, 3, 4, 5, 6}).AddOp(OP_CHECKLOCKTIMEVERIFY, OP_DROP, OP_1).Script(), want: ErrScriptFailed},
+
+		{name: "if else taken", locking: []byte{OP_1, OP_IF, OP_1, OP_ELSE, OP_0, OP_ENDIF}},
+		{name: "if else not taken", locking: []byte{OP_0, OP_IF, OP_0, OP_ELSE, OP_1, OP_ENDIF}},
+		{name: "notif", locking: []byte{OP_0, OP_NOTIF, OP_1, OP_ELSE, OP_0, OP_ENDIF}},
+		{name: "nested if", locking: []byte{OP_1, OP_IF, OP_0, OP_IF, OP_0, OP_ELSE, OP_1, OP_ENDIF, OP_ENDIF}},
+		{name: "if without endif", locking: []byte{OP_1, OP_IF, OP_1}, want: ErrScriptFailed},
+		{name: "if without endif not taken", locking: []byte{OP_1, OP_0, OP_IF, OP_1}, want: ErrScriptFailed},
+		{name: "else without if", locking: []byte{OP_1, OP_ELSE, OP_1}, want: ErrScriptFailed},
+		{name: "endif without if", locking: []byte{OP_1, OP_ENDIF}, want: ErrScriptFailed},
+		{name: "if on empty stack", locking: []byte{OP_IF, OP_1, OP_ENDIF}, want: ErrScriptFailed},
+		{name: "if in unlocking closed in locking", unlocking: []byte{OP_1}, locking: []byte{OP_IF, OP_1, OP_ENDIF}},
+
+		{name: "unlocking script with opcode", unlocking: []byte{OP_1, OP_DUP}, locking: []byte{OP_EQUAL}, want: ErrScriptInvalid},
+		{name: "unlocking script with if", unlocking: []byte{OP_1, OP_IF, OP_1, OP_ENDIF}, want: ErrScriptInvalid},
+		{name: "unlocking script pushing numbers", unlocking: []byte{OP_1NEGATE, OP_16}, locking: []byte{OP_DROP}},
+
+		{name: "return", locking: []byte{OP_1, OP_RETURN}, want: ErrScriptFailed},
+		{name: "unknown opcode", locking: []byte{OP_1, 0xff}, want: ErrScriptInvalid},
+		{name: "truncated push", locking: []byte{0x05, 1, 2}, want: ErrScriptInvalid},
+		{name: "empty scripts", want: ErrScriptFailed},
+		{name: "false left", locking: []byte{OP_0}, want: ErrScriptFailed},
+		{name: "negative zero left", locking: build().AddData([]byte{0x80}).Script(), want: ErrScriptFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := tx.Inputs[0]
+			input.UnlockingScript = test.unlocking
+			input.RelativeHeight = test.relativeHeight
+			ctx := &SpendContext{Height: test.height, MedianTime: test.medianTime}
+			err := tx.checkScript(&input, test.locking, ctx)
+			if test.want == nil && err != nil {
+				t.Fatalf("got %v, want success", err)
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestScriptNumbers(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 16, 127, 128, -128, 255, 256, -32768, LockTimeThreshold, 1<<31 - 1, -(1<<31 - 1)} {
+		encoded := encodeScriptNum(n)
+		decoded, err := decodeScriptNum(encoded)
+		if err != nil || decoded != n {
+			t.Errorf("%d encoded as %x decodes to %d, %v", n, encoded, decoded, err)
+		}
+	}
+}
@@ -2,18 +2,19 @@ package blockchain
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 )
 
-func SerializeTransaction(tx *UTXOTransaction) []byte {
+func SerializeTransaction(tx *Transaction) []byte {
 	var buff bytes.Buffer
 	enc := gob.NewEncoder(&buff)
 	enc.Encode(tx)
 	return buff.Bytes()
 }
 
-func DeserializeTransaction(data []byte) *UTXOTransaction {
-	var tx UTXOTransaction
+func DeserializeTransaction(data []byte) *Transaction {
+	var tx Transaction
 	dec := gob.NewDecoder(bytes.NewReader(data))
 	dec.Decode(&tx)
 	return &tx
@@ -32,3 +33,33 @@ func DeserializeBlock(data []byte) *Block {
 	dec.Decode(&b)
 	return &b
 }
+
+// hashWriter builds the canonical encoding that transaction hashes are computed over
+// Unlike gob, the encoding depends only on the field values, never on encoder state
+type hashWriter struct {
+	bytes.Buffer
+}
+
+func (w *hashWriter) writeInt(v int) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	w.Write(buf[:])
+}
+
+func (w *hashWriter) writeBool(v bool) {
+	if v {
+		w.WriteByte(1)
+	} else {
+		w.WriteByte(0)
+	}
+}
+
+// Variable length fields are prefixed with their length so adjacent fields cannot run together
+func (w *hashWriter) writeBytes(b []byte) {
+	w.writeInt(len(b))
+	w.Write(b)
+}
+
+func (w *hashWriter) writeString(s string) {
+	w.writeBytes([]byte(s))
+}
@@ -0,0 +1,291 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"trustify/crypto"
+)
+
+type SybilFlagKind string
+
+const (
+	// The seller paid the reviewer, directly or through intermediaries, before the
+	// reviewer bought the product
+	FlagSellerFunding SybilFlagKind = "seller_funding"
+	// Reviewers of one product whose purchases were funded by a common transaction
+	FlagSharedAncestry SybilFlagKind = "shared_ancestry"
+	// Unusually many reviews of one product within a few blocks
+	FlagReviewBurst SybilFlagKind = "review_burst"
+)
+
+// SybilFlag reports a suspicious pattern among the confirmed reviews of a product
+type SybilFlag struct {
+	Kind      SybilFlagKind
+	ProductID string
+	ReviewIDs [][]byte
+	Detail    string
+}
+
+// fundingEdge is a payment from one address to another in the block at height
+type fundingEdge struct {
+	to     string
+	height int
+}
+
+// ledgerGraph is the payment history of the chain, built once per analysis
+type ledgerGraph struct {
+	txs     map[string]*Transaction // hex transaction ID -> transaction
+	funding map[string][]fundingEdge
+}
+
+func (bc *Blockchain) buildLedgerGraph() *ledgerGraph {
+	graph := &ledgerGraph{
+		txs:     make(map[string]*Transaction),
+		funding: make(map[string][]fundingEdge),
+	}
+	for height, b := range bc.Ledger {
+		for _, tx := range b.Transactions {
+			graph.txs[hex.EncodeToString(tx.ID)] = tx
+			payers := make(map[string]bool)
+			for _, input := range tx.Inputs {
+				payers[string(crypto.AddressFromPublicKey(input.PublicKey))] = true
+			}
+			for payer := range payers {
+				for _, output := range tx.Outputs {
+					// Change is not funding
+					if !payers[string(output.Address)] {
+						graph.funding[payer] = append(graph.funding[payer], fundingEdge{to: string(output.Address), height: height})
+					}
+				}
+			}
+		}
+	}
+	return graph
+}
+
+// funded reports whether coins moved from source to target in at most hops payments,
+// each no earlier than the one before and none after height
+func (g *ledgerGraph) funded(source string, target string, hops int, height int) bool {
+	// Earliest height at which coins from source reached each address
+	arrival := map[string]int{source: 0}
+	frontier := []string{source}
+	for hop := 0; hop < hops && len(frontier) > 0; hop++ {
+		var next []string
+		for _, address := range frontier {
+			for _, edge := range g.funding[address] {
+				if edge.height < arrival[address] || edge.height > height {
+					continue
+				}
+				if edge.to == target {
+					return true
+				}
+				if best, seen := arrival[edge.to]; !seen || edge.height < best {
+					arrival[edge.to] = edge.height
+					next = append(next, edge.to)
+				}
+			}
+		}
+		frontier = next
+	}
+	return false
+}
+
+// ancestry returns the IDs of the transactions tx spends from, up to depth generations
+// back. Coinbases are left out: every coin descends from one.
+func (g *ledgerGraph) ancestry(tx *Transaction, depth int) map[string]bool {
+	ancestors := make(map[string]bool)
+	generation := []*Transaction{tx}
+	for i := 0; i < depth && len(generation) > 0; i++ {
+		var parents []*Transaction
+		for _, child := range generation {
+			for _, input := range child.Inputs {
+				key := hex.EncodeToString(input.PrevOut.TxID)
+				parent, exists := g.txs[key]
+				if !exists || parent.IsCoinbase() || ancestors[key] {
+					continue
+				}
+				ancestors[key] = true
+				parents = append(parents, parent)
+			}
+		}
+		generation = parents
+	}
+	return ancestors
+}
+
+// SybilReport analyses the confirmed reviews of productID, or of every reviewed
+// product when productID is empty, for signs of review farming
+func (bc *Blockchain) SybilReport(productID string) []SybilFlag {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+	return bc.sybilReport(productID)
+}
+
+func (bc *Blockchain) sybilReport(productID string) []SybilFlag {
+	products := []string{productID}
+	if productID == "" {
+		products = bc.Reviews.ReviewedProducts()
+	}
+
+	graph := bc.buildLedgerGraph()
+	var flags []SybilFlag
+	for _, product := range products {
+		var reviews []*ReviewRecord
+		for _, review := range bc.Reviews.ProductReviews(product) {
+			if !review.Latest().Retracted {
+				reviews = append(reviews, review)
+			}
+		}
+		if len(reviews) == 0 {
+			continue
+		}
+		flags = append(flags, bc.sellerFundingFlags(graph, product, reviews)...)
+		flags = append(flags, bc.sharedAncestryFlags(graph, product, reviews)...)
+		flags = append(flags, bc.burstFlags(product, reviews)...)
+	}
+	return flags
+}
+
+// purchaseOf returns the purchase that authorized review, and its height
+func (bc *Blockchain) purchaseOf(graph *ledgerGraph, review *ReviewRecord) (*Transaction, int, bool) {
+	key := hex.EncodeToString(review.PurchaseID)
+	purchase, exists := graph.txs[key]
+	if !exists {
+		return nil, 0, false
+	}
+	return purchase, bc.txHeights[key], true
+}
+
+func (bc *Blockchain) sellerFundingFlags(graph *ledgerGraph, productID string, reviews []*ReviewRecord) []SybilFlag {
+	product, exists := bc.Products.Product(productID)
+	if !exists || bc.Sybil.FundingHops <= 0 {
+		return nil
+	}
+	var flags []SybilFlag
+	for _, review := range reviews {
+		_, height, exists := bc.purchaseOf(graph, review)
+		if !exists {
+			continue
+		}
+		if graph.funded(string(product.SellerAddress), string(review.ReviewerAddress), bc.Sybil.FundingHops, height) {
+			flags = append(flags, SybilFlag{
+				Kind:      FlagSellerFunding,
+				ProductID: productID,
+				ReviewIDs: [][]byte{review.ID},
+				Detail:    fmt.Sprintf("seller %s funded reviewer %s before the purchase", product.SellerAddress, review.ReviewerAddress),
+			})
+		}
+	}
+	return flags
+}
+
+// sharedAncestryFlags groups the reviewers whose purchases descend from a common
+// transaction, or from each other's purchases, and flags every group of two or more
+func (bc *Blockchain) sharedAncestryFlags(graph *ledgerGraph, productID string, reviews []*ReviewRecord) []SybilFlag {
+	if bc.Sybil.AncestryDepth <= 0 {
+		return nil
+	}
+
+	// Union-find over the reviews, joined through the ancestors they share
+	parent := make([]int, len(reviews))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	owner := make(map[string]int) // ancestor transaction -> first review descending from it
+	for i, review := range reviews {
+		purchase, _, exists := bc.purchaseOf(graph, review)
+		if !exists {
+			continue
+		}
+		ancestors := graph.ancestry(purchase, bc.Sybil.AncestryDepth)
+		ancestors[hex.EncodeToString(purchase.ID)] = true
+		for ancestor := range ancestors {
+			if j, seen := owner[ancestor]; seen {
+				parent[find(i)] = find(j)
+			} else {
+				owner[ancestor] = i
+			}
+		}
+	}
+
+	groups := make(map[int][]int)
+	for i := range reviews {
+		root := find(i)
+		groups[root] = append(groups[root], i)
+	}
+	var flags []SybilFlag
+	for i := range reviews {
+		group := groups[i]
+		if len(group) < 2 {
+			continue
+		}
+		flag := SybilFlag{Kind: FlagSharedAncestry, ProductID: productID}
+		for _, member := range group {
+			flag.ReviewIDs = append(flag.ReviewIDs, reviews[member].ID)
+		}
+		flag.Detail = fmt.Sprintf("%d reviewers bought with coins from a common transaction", len(group))
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+// burstFlags flags every run of reviews in which each review falls within
+// BurstWindow blocks of BurstSize-1 others
+func (bc *Blockchain) burstFlags(productID string, reviews []*ReviewRecord) []SybilFlag {
+	window, size := bc.Sybil.BurstWindow, bc.Sybil.BurstSize
+	if window <= 0 || size <= 1 || len(reviews) < size {
+		return nil
+	}
+	sorted := append([]*ReviewRecord(nil), reviews...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Versions[0].Height < sorted[j].Versions[0].Height
+	})
+
+	inBurst := make([]bool, len(sorted))
+	for start, end := 0, 0; end < len(sorted); end++ {
+		for sorted[end].Versions[0].Height-sorted[start].Versions[0].Height >= window {
+			start++
+		}
+		if end-start+1 >= size {
+			for i := start; i <= end; i++ {
+				inBurst[i] = true
+			}
+		}
+	}
+
+	var flags []SybilFlag
+	for i := 0; i < len(sorted); i++ {
+		if !inBurst[i] {
+			continue
+		}
+		flag := SybilFlag{Kind: FlagReviewBurst, ProductID: productID}
+		first := sorted[i].Versions[0].Height
+		for ; i < len(sorted) && inBurst[i]; i++ {
+			flag.ReviewIDs = append(flag.ReviewIDs, sorted[i].ID)
+		}
+		last := sorted[i-1].Versions[0].Height
+		flag.Detail = fmt.Sprintf("%d reviews between heights %d and %d", len(flag.ReviewIDs), first, last)
+		flags = append(flags, flag)
+	}
+	return flags
+}
+
+// flaggedReviews returns the hex IDs of the reviews of productID named by any flag
+func (bc *Blockchain) flaggedReviews(productID string) map[string]bool {
+	flagged := make(map[string]bool)
+	for _, flag := range bc.sybilReport(productID) {
+		for _, id := range flag.ReviewIDs {
+			flagged[hex.EncodeToString(id)] = true
+		}
+	}
+	return flagged
+}
@@ -1,129 +1,852 @@
 package blockchain
 
-// import (
-//     "trustify/crypto"
-// )
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"trustify/crypto"
+	"trustify/logger"
+	"trustify/types"
+	"unicode/utf8"
+)
 
+// Transaction is the single transaction format carried in blocks, the mempool and on the wire
+// Its ID is the hash of everything except the input signatures, so the ID is known
+// before signing and signatures commit to it
 type Transaction struct {
-	ID      string
-	Inputs  []UTXOTransaction
-	Outputs []UTXOTransaction
+	ID      []byte
+	Type    types.TransactionType
+	Inputs  []TxInput
+	Outputs []TxOutput
 	Data    TransactionData
+	// Replaceable opts in to replace-by-fee while the transaction is unconfirmed
+	Replaceable bool
 }
 
-type TransactionData interface{}
+// TxInput spends the output named by PrevOut, proving ownership with a signature
+// over the transaction ID by the key the output's address was derived from
+// Outputs that need more than one key, such as escrows, take the signatures of the
+// other parties in Cosigners, and outputs with a locking script are unlocked by
+// UnlockingScript instead. Like Signature, both are left out of the ID.
+// RelativeHeight and RelativeTime, when set, hold the transaction back until the
+// spent output has been confirmed for that many blocks, or seconds of median time.
+type TxInput struct {
+	PrevOut         UTXOTransactionID
+	Signature       []byte
+	PublicKey       []byte
+	Cosigners       []InputSignature
+	UnlockingScript []byte
+	RelativeHeight  int
+	RelativeTime    int64
+}
+
+type InputSignature struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+// TxOutput pays Amount to Address. An escrow or multisig output pays the script
+// address of its Escrow or Multisig terms, which decide who may spend it, and a
+// script output the script address of its LockingScript.
+// An output with LockHeight or LockTime cannot be spent in a block below that
+// height, or whose median time past is before that Unix time.
+type TxOutput struct {
+	Address       []byte
+	Amount        int
+	Escrow        *EscrowTerms
+	Multisig      *MultisigTerms
+	LockingScript []byte
+	LockHeight    int
+	LockTime      int64
+}
+
+// TransactionData is the typed payload matching a transaction's Type
+type TransactionData interface {
+	// writeHash writes the fields of the payload that the transaction ID commits to
+	writeHash(w *hashWriter)
+}
+
+// Coinbase transactions carry the height of their block so that two rewards
+// paying the same address the same amount still have distinct IDs
+type CoinbaseTransactionData struct {
+	Height int
+}
 
 type PurchaseTransactionData struct {
-	TransactionData
 	BuyerAddress  []byte
 	SellerAddress []byte
 	ProductID     string
 	Amount        int
 }
 
+// Reviews spend nothing, so the reviewer signs the payload itself
+// PublicKey and Signature are excluded from the transaction ID, which the signature covers
+// Longer text and media stay off chain: ContentHash commits to them by their sha256
+// hash and nodes serve them from their ContentStore
 type ReviewTransactionData struct {
-	TransactionData
 	ReviewerAddress []byte
 	Rating          int
 	ProductID       string
+	Title           string
+	Body            string
+	ContentHash     []byte
+	PublicKey       []byte
+	Signature       []byte
+}
+
+// An amendment replaces the rating and text of the confirmed review named by ReviewID
+// and a retraction withdraws it. Only the original reviewer may do either, signing
+// the payload the same way as the review. Earlier versions stay on chain.
+type ReviewAmendTransactionData struct {
+	ReviewID        []byte
+	ReviewerAddress []byte
+	Rating          int
+	Title           string
+	Body            string
+	ContentHash     []byte
+	PublicKey       []byte
+	Signature       []byte
+}
+
+type ReviewRetractTransactionData struct {
+	ReviewID        []byte
+	ReviewerAddress []byte
+	PublicKey       []byte
+	Signature       []byte
+}
+
+// authoredData is a payload that spends nothing and is signed by its author instead
+type authoredData interface {
+	TransactionData
+	author() (address []byte, publicKey []byte, signature []byte)
+	setSignature(publicKey []byte, signature []byte)
+}
+
+const (
+	MinRating = 1
+	MaxRating = 5
+
+	// Limits in bytes on the review text kept on chain
+	MaxReviewTitleLength = 120
+	MaxReviewBodyLength  = 1024
+)
+
+func init() {
+	// Payloads travel behind the TransactionData interface
+	gob.Register(&CoinbaseTransactionData{})
+	gob.Register(&PurchaseTransactionData{})
+	gob.Register(&ReviewTransactionData{})
+	gob.Register(&ReviewAmendTransactionData{})
+	gob.Register(&ReviewRetractTransactionData{})
+}
+
+func (d *CoinbaseTransactionData) writeHash(w *hashWriter) {
+	w.writeInt(d.Height)
+}
+
+func (d *PurchaseTransactionData) writeHash(w *hashWriter) {
+	w.writeBytes(d.BuyerAddress)
+	w.writeBytes(d.SellerAddress)
+	w.writeString(d.ProductID)
+	w.writeInt(d.Amount)
+}
+
+func (d *ReviewTransactionData) writeHash(w *hashWriter) {
+	w.writeBytes(d.ReviewerAddress)
+	w.writeInt(d.Rating)
+	w.writeString(d.ProductID)
+	w.writeString(d.Title)
+	w.writeString(d.Body)
+	w.writeBytes(d.ContentHash)
+}
+
+func (d *ReviewAmendTransactionData) writeHash(w *hashWriter) {
+	w.writeBytes(d.ReviewID)
+	w.writeBytes(d.ReviewerAddress)
+	w.writeInt(d.Rating)
+	w.writeString(d.Title)
+	w.writeString(d.Body)
+	w.writeBytes(d.ContentHash)
+}
+
+func (d *ReviewRetractTransactionData) writeHash(w *hashWriter) {
+	w.writeBytes(d.ReviewID)
+	w.writeBytes(d.ReviewerAddress)
+}
+
+func (d *ReviewTransactionData) author() ([]byte, []byte, []byte) {
+	return d.ReviewerAddress, d.PublicKey, d.Signature
+}
+
+func (d *ReviewAmendTransactionData) author() ([]byte, []byte, []byte) {
+	return d.ReviewerAddress, d.PublicKey, d.Signature
+}
+
+func (d *ReviewRetractTransactionData) author() ([]byte, []byte, []byte) {
+	return d.ReviewerAddress, d.PublicKey, d.Signature
+}
+
+func (d *ReviewTransactionData) setSignature(publicKey []byte, signature []byte) {
+	d.PublicKey, d.Signature = publicKey, signature
+}
+
+func (d *ReviewAmendTransactionData) setSignature(publicKey []byte, signature []byte) {
+	d.PublicKey, d.Signature = publicKey, signature
+}
+
+func (d *ReviewRetractTransactionData) setSignature(publicKey []byte, signature []byte) {
+	d.PublicKey, d.Signature = publicKey, signature
+}
+
+// VerifyContent checks that content is the off-chain content the review commits to
+func (d *ReviewTransactionData) VerifyContent(content []byte) error {
+	return verifyContent(d.ContentHash, content)
+}
+
+// VerifyContent checks that content is the off-chain content the amendment commits to
+func (d *ReviewAmendTransactionData) VerifyContent(content []byte) error {
+	return verifyContent(d.ContentHash, content)
+}
+
+func verifyContent(hash []byte, content []byte) error {
+	if len(hash) == 0 {
+		return fmt.Errorf("%w: review has no content", ErrContentNotFound)
+	}
+	if !bytes.Equal(ContentHash(content), hash) {
+		return fmt.Errorf("%w: %x", ErrContentMismatch, hash)
+	}
+	return nil
+}
+
+// NewPurchaseTransaction pays amount to the seller at address to for productID, plus fee
+// to the miner, from the wallet's UTXOs. Whatever the selected inputs hold beyond
+// amount and fee is returned to the buyer as a change output. Every input is signed.
+func NewPurchaseTransaction(w *Wallet, to string, amount int, fee int, productID string) (*Transaction, error) {
+	return newPurchaseTransaction(w, to, amount, fee, productID, nil)
+}
+
+// newPurchaseTransaction pays the seller directly, or into escrow when escrow is set
+func newPurchaseTransaction(w *Wallet, to string, amount int, fee int, productID string, escrow *EscrowTerms) (*Transaction, error) {
+	if amount <= 0 || fee < 0 {
+		return nil, fmt.Errorf("%w: amount %d, fee %d", ErrTransactionInvalid, amount, fee)
+	}
+	if !crypto.ValidateAddress([]byte(to)) {
+		return nil, fmt.Errorf("%w: seller %s", crypto.ErrInvalidAddress, to)
+	}
+
+	inputs, change, err := w.CreateInputs(amount + fee)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to create inputs for purchase transaction:", err)
+		return nil, err
+	}
+
+	// The buyer is the address of the first input, which signs for it
+	buyer := w.ownerOf(inputs[0])
+	outputs := []TxOutput{
+		{Address: []byte(to), Amount: amount},
+	}
+	if escrow != nil {
+		escrow.BuyerAddress = buyer
+		outputs[0] = TxOutput{Address: escrow.Address(), Amount: amount, Escrow: escrow}
+	}
+	if change > 0 {
+		changeAddress, err := w.ChangeAddress()
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, TxOutput{Address: changeAddress, Amount: change})
+	}
+
+	tx := &Transaction{
+		Type:    types.TransactionTypePurchase,
+		Inputs:  inputs,
+		Outputs: outputs,
+		Data: &PurchaseTransactionData{
+			BuyerAddress:  buyer,
+			SellerAddress: []byte(to),
+			ProductID:     productID,
+			Amount:        amount,
+		},
+	}
+
+	if err := w.SignTransaction(tx); err != nil {
+		logger.ErrorLogger.Println("Failed to sign purchase transaction:", err)
+		return nil, err
+	}
+	logger.InfoLogger.Printf("New purchase transaction created: %x\n", tx.ID)
+	return tx, nil
+}
+
+// NewReviewTransaction rates productID on behalf of the wallet's address that bought
+// it, which must hold a confirmed purchase of the product for the review to be accepted
+// content is the optional off-chain text or media, of which only the hash goes on chain
+func NewReviewTransaction(w *Wallet, productID string, rating int, title string, body string, content []byte) (*Transaction, error) {
+	data := &ReviewTransactionData{
+		ReviewerAddress: w.identity(purchaseRole(productID)),
+		Rating:          rating,
+		ProductID:       productID,
+		Title:           title,
+		Body:            body,
+	}
+	if content != nil {
+		data.ContentHash = ContentHash(content)
+	}
+	tx := &Transaction{
+		Type: types.TransactionTypeReview,
+		Data: data,
+	}
+	if err := signAuthored(tx, data, w); err != nil {
+		logger.ErrorLogger.Println("Failed to sign review transaction:", err)
+		return nil, err
+	}
+
+	logger.InfoLogger.Printf("New review transaction created: %x\n", tx.ID)
+	return tx, nil
+}
+
+// NewReviewAmendTransaction replaces the rating and text of the wallet's confirmed
+// review reviewID. content is the optional new off-chain content.
+func NewReviewAmendTransaction(w *Wallet, reviewID []byte, rating int, title string, body string, content []byte) (*Transaction, error) {
+	data := &ReviewAmendTransactionData{
+		ReviewID:        reviewID,
+		ReviewerAddress: w.identity(reviewRole(reviewID)),
+		Rating:          rating,
+		Title:           title,
+		Body:            body,
+	}
+	if content != nil {
+		data.ContentHash = ContentHash(content)
+	}
+	tx := &Transaction{
+		Type: types.TransactionTypeAmend,
+		Data: data,
+	}
+	if err := signAuthored(tx, data, w); err != nil {
+		logger.ErrorLogger.Println("Failed to sign review amendment:", err)
+		return nil, err
+	}
+
+	logger.InfoLogger.Printf("New review amendment created: %x\n", tx.ID)
+	return tx, nil
+}
+
+// NewReviewRetractTransaction withdraws the wallet's confirmed review reviewID
+func NewReviewRetractTransaction(w *Wallet, reviewID []byte) (*Transaction, error) {
+	data := &ReviewRetractTransactionData{
+		ReviewID:        reviewID,
+		ReviewerAddress: w.identity(reviewRole(reviewID)),
+	}
+	tx := &Transaction{
+		Type: types.TransactionTypeRetract,
+		Data: data,
+	}
+	if err := signAuthored(tx, data, w); err != nil {
+		logger.ErrorLogger.Println("Failed to sign review retraction:", err)
+		return nil, err
+	}
+
+	logger.InfoLogger.Printf("New review retraction created: %x\n", tx.ID)
+	return tx, nil
 }
 
-func NewPurchaseTransaction(w *Wallet, to string, amount int, fee int, productID string) *Transaction {
-	// Create a new purchase transaction
-	// For a purchase transaction, the user's wallet contains the list of unspent tranactions used for spending
-	// The amount is the amount to be spent
-	// The fee is the transaction fee
-	// Note that the amount does not include the transaction fee
-	// Create inputs from UTXOs
-    // inputs, change, err := w.CreateInputs(amount + fee)
-    // if err != nil {
-    //     logger.ErrorLogger.Println("Failed to create inputs for purchase transaction:", err)
-    //     return nil, err
-    // }
-
-    // // Create outputs
-    // outputs := []UTXOTransaction{
-    //     {Address: to, Amount: amount},
-    // }
-    // if change > 0 {
-    //     outputs = append(outputs, UTXOTransaction{Address: w.BitcoinAddress, Amount: change})
-    // }
-
-    // txData := &PurchaseTransactionData{
-    //     BuyerAddress:  w.BitcoinAddress,
-    //     SellerAddress: to,
-    //     ProductID:     productID,
-    //     Amount:        amount,
-    // }
-
-    // tx := &Transaction{
-    //     Inputs:  inputs,
-    //     Outputs: outputs,
-    //     Data:    txData,
-    // }
-
-    // tx.ID = tx.Hash()
-    // crypto.Sign(w.PrivateKey)
-    // logger.InfoLogger.Println("New purchase transaction created:", tx.ID)
-    // return tx, nil
-    return nil
-}
-
-func NewReviewTransaction(w *Wallet, productID string, rating int) *Transaction {
-	// Create a new review transaction
-	// txData := &ReviewTransactionData{
-    //     ReviewerAddress: w.BitcoinAddress,
-    //     Rating:          rating,
-    //     ProductID:       productID,
-    // }
-
-    // tx := &Transaction{
-    //     Data: txData,
-    // }
-
-    // tx.ID = tx.Hash()
-    // crypto.Sign(w.PrivateKey)
-    // logger.InfoLogger.Println("New review transaction created:", tx.ID)
-    // return tx, nil
-    return nil
+// signAuthored sets the ID of a transaction with an authored payload and signs it
+// with the wallet's key of the author address
+func signAuthored(tx *Transaction, data authoredData, w *Wallet) error {
+	address, _, _ := data.author()
+	key, err := w.signingKey(address)
+	if err != nil {
+		return err
+	}
+	tx.ID = tx.Hash()
+	signature, err := crypto.Sign(tx.ID, key.PrivateKey)
+	if err != nil {
+		return err
+	}
+	data.setSignature(key.PublicKey, signature)
+	return nil
 }
 
+// NewCoinbaseTransaction pays newly created coins to the given outputs
+func NewCoinbaseTransaction(height int, outputs []TxOutput) *Transaction {
+	tx := &Transaction{
+		Type:    types.TransactionTypeCoinbase,
+		Outputs: outputs,
+		Data:    &CoinbaseTransactionData{Height: height},
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+// Hash is the canonical transaction hash, used as the transaction ID
+// Input signatures, cosignatures and public keys are left out: the signatures are
+// made over this hash
 func (tx *Transaction) Hash() []byte {
-	// // Generate the hash for the transaction
-	// data := crypto.Serialize(tx)
-    // hash := sha256.Sum256(data)
-    // return hash[:]
-    return nil
+	w := &hashWriter{}
+	w.writeString(string(tx.Type))
+	w.writeInt(len(tx.Inputs))
+	for _, input := range tx.Inputs {
+		w.writeBytes(input.PrevOut.TxID)
+		w.writeInt(input.PrevOut.Index)
+		w.writeInt(input.RelativeHeight)
+		w.writeInt(int(input.RelativeTime))
+	}
+	w.writeInt(len(tx.Outputs))
+	for _, output := range tx.Outputs {
+		w.writeBytes(output.Address)
+		w.writeInt(output.Amount)
+		w.writeBool(output.Escrow != nil)
+		if output.Escrow != nil {
+			output.Escrow.writeHash(w)
+		}
+		w.writeBool(output.Multisig != nil)
+		if output.Multisig != nil {
+			output.Multisig.writeHash(w)
+		}
+		w.writeBytes(output.LockingScript)
+		w.writeInt(output.LockHeight)
+		w.writeInt(int(output.LockTime))
+	}
+	w.writeBool(tx.Replaceable)
+	w.writeBool(tx.Data != nil)
+	if tx.Data != nil {
+		tx.Data.writeHash(w)
+	}
+	return crypto.HashData(w.Bytes())
+}
+
+// Sign signs every input with privKey, for transactions spending outputs of a single address
+func (tx *Transaction) Sign(privKey []byte) error {
+	for i := range tx.Inputs {
+		if err := tx.SignInput(i, privKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SignInput signs input i with privKey, recomputing the ID first so that the
+// signature always covers the transaction as it stands
+func (tx *Transaction) SignInput(i int, privKey []byte) error {
+	pubKey, err := crypto.PublicKeyFromPrivate(privKey)
+	if err != nil {
+		return err
+	}
+	tx.ID = tx.Hash()
+	signature, err := crypto.Sign(tx.ID, privKey)
+	if err != nil {
+		return err
+	}
+	tx.Inputs[i].Signature = signature
+	tx.Inputs[i].PublicKey = pubKey
+	return nil
 }
 
-func (tx *Transaction) Sign(privKey []byte) []byte {
-	// Digitally sign the transaction using the private key
-	// signature, err := crypto.Sign(tx.Hash(), privKey)
-    // if err != nil {
-    //     logger.ErrorLogger.Println("Failed to sign transaction:", err)
-    //     return err
-    // }
-    // crypto.Signature = signature
-    return nil
+// Cosign adds the signature of privKey to input i, for outputs that need the keys
+// of several parties. The transaction must not change afterwards.
+func (tx *Transaction) Cosign(i int, privKey []byte) error {
+	pubKey, err := crypto.PublicKeyFromPrivate(privKey)
+	if err != nil {
+		return err
+	}
+	tx.ID = tx.Hash()
+	signature, err := crypto.Sign(tx.ID, privKey)
+	if err != nil {
+		return err
+	}
+	tx.Inputs[i].Cosigners = append(tx.Inputs[i].Cosigners, InputSignature{PublicKey: pubKey, Signature: signature})
+	return nil
 }
 
+// Verify checks the ID and every input signature
+// Whether each public key may spend the output it claims is checked against
+// the outputs being spent, in CheckInputs
 func (tx *Transaction) Verify() bool {
-	// Extract public key from address
-    // var pubKey []byte
-    // switch data := tx.Data.(type) {
-    // case *PurchaseTransactionData:
-    //     pubKey = data.BuyerAddress
-    // case *ReviewTransactionData:
-    //     pubKey = data.ReviewerAddress
-    // default:
-    //     logger.ErrorLogger.Println("Unknown transaction data type")
-    //     return false
-    // }
-
-    // valid := crypto.Verify(tx.Hash(), tx.Signature, pubKey)
-    // if !valid {
-    //     logger.ErrorLogger.Println("Transaction signature verification failed")
-    // }
-    // return valid
-    return false
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return false
+	}
+	for _, input := range tx.Inputs {
+		// Script inputs carry their signatures in the unlocking script
+		if len(input.PublicKey) == 0 && len(input.UnlockingScript) != 0 {
+			continue
+		}
+		if !crypto.Verify(tx.ID, input.Signature, input.PublicKey) {
+			return false
+		}
+		for _, cosigner := range input.Cosigners {
+			if !crypto.Verify(tx.ID, cosigner.Signature, cosigner.PublicKey) {
+				return false
+			}
+		}
+	}
+	if data, ok := tx.Data.(authoredData); ok {
+		address, publicKey, signature := data.author()
+		if !bytes.Equal(crypto.AddressFromPublicKey(publicKey), address) {
+			return false
+		}
+		return crypto.Verify(tx.ID, signature, publicKey)
+	}
+	return true
+}
+
+// SignedBy reports whether any input was signed, alone or with others, by the key
+// behind address
+func (tx *Transaction) SignedBy(address []byte) bool {
+	for _, input := range tx.Inputs {
+		for _, publicKey := range input.Signers() {
+			if bytes.Equal(crypto.AddressFromPublicKey(publicKey), address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CheckFormat validates the transaction on its own, without reference to chain state
+func (tx *Transaction) CheckFormat() error {
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return fmt.Errorf("%w: ID does not match transaction hash", ErrTransactionInvalid)
+	}
+	for _, output := range tx.Outputs {
+		if output.Amount <= 0 {
+			return fmt.Errorf("%w: non-positive output amount", ErrTransactionInvalid)
+		}
+		if output.LockHeight < 0 || output.LockTime < 0 {
+			return fmt.Errorf("%w: negative output lock", ErrTransactionInvalid)
+		}
+		if !crypto.ValidateAddress(output.Address) {
+			return fmt.Errorf("%w: output address %s", ErrTransactionInvalid, output.Address)
+		}
+		if output.Escrow != nil {
+			// Only purchases pay into escrow
+			if tx.Type != types.TransactionTypePurchase {
+				return fmt.Errorf("%w: escrow output outside a purchase", ErrTransactionInvalid)
+			}
+			if err := output.Escrow.check(output.Address); err != nil {
+				return err
+			}
+		}
+		if output.Multisig != nil {
+			if output.Escrow != nil {
+				return fmt.Errorf("%w: output both escrow and multisig", ErrTransactionInvalid)
+			}
+			if err := output.Multisig.check(output.Address); err != nil {
+				return err
+			}
+		}
+		if output.LockingScript != nil {
+			if output.Escrow != nil || output.Multisig != nil {
+				return fmt.Errorf("%w: script output with escrow or multisig terms", ErrTransactionInvalid)
+			}
+			if _, err := parseScript(output.LockingScript); err != nil {
+				return err
+			}
+			if !bytes.Equal(output.Address, crypto.ScriptAddress(output.LockingScript)) {
+				return fmt.Errorf("%w: output address %s does not commit to its script", ErrTransactionInvalid, output.Address)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for _, input := range tx.Inputs {
+		if input.RelativeHeight < 0 || input.RelativeTime < 0 {
+			return fmt.Errorf("%w: negative input lock", ErrTransactionInvalid)
+		}
+		key := input.PrevOut.String()
+		if seen[key] {
+			return fmt.Errorf("%w: input %s spent twice", ErrDoubleSpending, key)
+		}
+		seen[key] = true
+	}
+
+	switch data := tx.Data.(type) {
+	case *CoinbaseTransactionData:
+		if tx.Type != types.TransactionTypeCoinbase || len(tx.Inputs) != 0 {
+			return fmt.Errorf("%w: malformed coinbase", ErrTransactionInvalid)
+		}
+	case *PurchaseTransactionData:
+		if tx.Type != types.TransactionTypePurchase || len(tx.Inputs) == 0 {
+			return fmt.Errorf("%w: malformed purchase", ErrTransactionInvalid)
+		}
+		if data.Amount <= 0 || data.ProductID == "" {
+			return fmt.Errorf("%w: purchase without product or amount", ErrTransactionInvalid)
+		}
+		// Payments into escrow count when held for this buyer and seller
+		paid := 0
+		for _, output := range tx.Outputs {
+			if output.Escrow != nil {
+				if bytes.Equal(output.Escrow.BuyerAddress, data.BuyerAddress) && bytes.Equal(output.Escrow.SellerAddress, data.SellerAddress) {
+					paid += output.Amount
+				}
+			} else if bytes.Equal(output.Address, data.SellerAddress) {
+				paid += output.Amount
+			}
+		}
+		if paid < data.Amount {
+			return fmt.Errorf("%w: purchase pays seller %d of %d", ErrTransactionInvalid, paid, data.Amount)
+		}
+	case *ReviewTransactionData:
+		if tx.Type != types.TransactionTypeReview || len(tx.Inputs) != 0 || len(tx.Outputs) != 0 {
+			return fmt.Errorf("%w: malformed review", ErrTransactionInvalid)
+		}
+		if data.ProductID == "" {
+			return fmt.Errorf("%w: review without product", ErrTransactionInvalid)
+		}
+		return checkReview(data.Rating, data.Title, data.Body, data.ContentHash)
+	case *ReviewAmendTransactionData:
+		if tx.Type != types.TransactionTypeAmend || len(tx.Inputs) != 0 || len(tx.Outputs) != 0 {
+			return fmt.Errorf("%w: malformed review amendment", ErrTransactionInvalid)
+		}
+		if len(data.ReviewID) != sha256.Size {
+			return fmt.Errorf("%w: amendment without review", ErrTransactionInvalid)
+		}
+		return checkReview(data.Rating, data.Title, data.Body, data.ContentHash)
+	case *ReviewRetractTransactionData:
+		if tx.Type != types.TransactionTypeRetract || len(tx.Inputs) != 0 || len(tx.Outputs) != 0 {
+			return fmt.Errorf("%w: malformed review retraction", ErrTransactionInvalid)
+		}
+		if len(data.ReviewID) != sha256.Size {
+			return fmt.Errorf("%w: retraction without review", ErrTransactionInvalid)
+		}
+	case *ProductListingTransactionData:
+		if tx.Type != types.TransactionTypeListing || len(tx.Inputs) != 0 || len(tx.Outputs) != 0 {
+			return fmt.Errorf("%w: malformed product listing", ErrTransactionInvalid)
+		}
+		if err := checkProduct(data.ProductID, data.SellerAddress); err != nil {
+			return err
+		}
+		return checkListingTerms(data.MetadataHash, data.Price)
+	case *ProductUpdateTransactionData:
+		if tx.Type != types.TransactionTypeUpdate || len(tx.Inputs) != 0 || len(tx.Outputs) != 0 {
+			return fmt.Errorf("%w: malformed product update", ErrTransactionInvalid)
+		}
+		if err := checkProduct(data.ProductID, data.SellerAddress); err != nil {
+			return err
+		}
+		return checkListingTerms(data.MetadataHash, data.Price)
+	case *ProductDelistTransactionData:
+		if tx.Type != types.TransactionTypeDelist || len(tx.Inputs) != 0 || len(tx.Outputs) != 0 {
+			return fmt.Errorf("%w: malformed product delisting", ErrTransactionInvalid)
+		}
+		return checkProduct(data.ProductID, data.SellerAddress)
+	case *TransferTransactionData:
+		if tx.Type != types.TransactionTypeTransfer || len(tx.Inputs) == 0 {
+			return fmt.Errorf("%w: malformed transfer", ErrTransactionInvalid)
+		}
+		return checkMemo(data.Memo)
+	case *RefundTransactionData:
+		if tx.Type != types.TransactionTypeRefund || len(tx.Inputs) == 0 {
+			return fmt.Errorf("%w: malformed refund", ErrTransactionInvalid)
+		}
+		if len(data.PurchaseID) != sha256.Size || data.Amount <= 0 {
+			return fmt.Errorf("%w: refund without purchase or amount", ErrTransactionInvalid)
+		}
+		paid := 0
+		for _, output := range tx.Outputs {
+			if bytes.Equal(output.Address, data.BuyerAddress) {
+				paid += output.Amount
+			}
+		}
+		if paid < data.Amount {
+			return fmt.Errorf("%w: refund pays buyer %d of %d", ErrTransactionInvalid, paid, data.Amount)
+		}
+	case *DeliveryConfirmationTransactionData:
+		if tx.Type != types.TransactionTypeConfirm || len(tx.Inputs) != 0 || len(tx.Outputs) != 0 {
+			return fmt.Errorf("%w: malformed delivery confirmation", ErrTransactionInvalid)
+		}
+		if len(data.Escrow.TxID) != sha256.Size || data.Escrow.Index < 0 {
+			return fmt.Errorf("%w: confirmation without escrow", ErrTransactionInvalid)
+		}
+	case *EscrowReleaseTransactionData:
+		if tx.Type != types.TransactionTypeEscrowRelease {
+			return fmt.Errorf("%w: malformed escrow release", ErrTransactionInvalid)
+		}
+		return checkEscrowSpend(tx, data.Escrow)
+	case *EscrowRefundTransactionData:
+		if tx.Type != types.TransactionTypeEscrowRefund {
+			return fmt.Errorf("%w: malformed escrow refund", ErrTransactionInvalid)
+		}
+		return checkEscrowSpend(tx, data.Escrow)
+	default:
+		return fmt.Errorf("%w: unknown payload for type %q", ErrTransactionInvalid, tx.Type)
+	}
+	return nil
+}
+
+// checkReview applies the limits shared by reviews and their amendments
+func checkReview(rating int, title string, body string, contentHash []byte) error {
+	if rating < MinRating || rating > MaxRating {
+		return fmt.Errorf("%w: %d not in %d-%d", ErrInvalidRating, rating, MinRating, MaxRating)
+	}
+	if title == "" || !utf8.ValidString(title) || !utf8.ValidString(body) {
+		return fmt.Errorf("%w: review needs a UTF-8 title and body", ErrTransactionInvalid)
+	}
+	if len(title) > MaxReviewTitleLength || len(body) > MaxReviewBodyLength {
+		return fmt.Errorf("%w: title %d of %d bytes, body %d of %d bytes", ErrReviewTooLong,
+			len(title), MaxReviewTitleLength, len(body), MaxReviewBodyLength)
+	}
+	if len(contentHash) != 0 && len(contentHash) != sha256.Size {
+		return fmt.Errorf("%w: content hash of %d bytes", ErrTransactionInvalid, len(contentHash))
+	}
+	return nil
+}
+
+// checkProduct applies the limits shared by every product registry transaction
+func checkProduct(productID string, seller []byte) error {
+	if productID == "" || len(productID) > MaxProductIDLength || !utf8.ValidString(productID) {
+		return fmt.Errorf("%w: product ID must be 1-%d bytes of UTF-8", ErrTransactionInvalid, MaxProductIDLength)
+	}
+	if !crypto.ValidateAddress(seller) {
+		return fmt.Errorf("%w: seller address %s", ErrTransactionInvalid, seller)
+	}
+	return nil
+}
+
+// checkListingTerms applies the limits shared by product listings and updates
+func checkListingTerms(metadataHash []byte, price int) error {
+	if price <= 0 {
+		return fmt.Errorf("%w: non-positive price", ErrTransactionInvalid)
+	}
+	if len(metadataHash) != 0 && len(metadataHash) != sha256.Size {
+		return fmt.Errorf("%w: metadata hash of %d bytes", ErrTransactionInvalid, len(metadataHash))
+	}
+	return nil
+}
+
+// SpendContext is the chain state that the conditions and locks of the outputs
+// being spent are checked against
+type SpendContext struct {
+	// Height of the block the spending transaction is in, or would be mined in next
+	Height int
+	// MedianTime is the median time past of that block, see Blockchain.MedianTimePast
+	MedianTime int64
+	// MedianTimePast returns the median time past of the block at a height
+	MedianTimePast func(height int) int64
+	// CoinbaseMaturity is the number of blocks before coinbase outputs may be spent
+	CoinbaseMaturity int
+	// DeliveryConfirmed reports whether the buyer has confirmed delivery of an escrow on chain
+	DeliveryConfirmed func(escrow *UTXOTransactionID) bool
+}
+
+// CheckInputs validates the inputs against the outputs they spend, found through lookup,
+// and returns the fee: the amount by which the inputs exceed the outputs
+// A transaction that is valid except for a lock not yet reached returns its fee with
+// ErrTxNotFinal, so the mempool can hold it until it may be mined.
+func (tx *Transaction) CheckInputs(lookup func(id *UTXOTransactionID) (*UTXOTransaction, bool), ctx *SpendContext) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+	if !tx.Verify() {
+		return 0, ErrInvalidSignature
+	}
+
+	total := 0
+	for _, input := range tx.Inputs {
+		utxo, exists := lookup(&input.PrevOut)
+		if !exists {
+			return 0, fmt.Errorf("%w: %s", ErrUTXONotFound, input.PrevOut)
+		}
+		if !utxo.Mature(ctx.Height, ctx.CoinbaseMaturity) {
+			return 0, fmt.Errorf("%w: %s from height %d", ErrImmatureCoinbase, input.PrevOut, utxo.Height)
+		}
+		if utxo.LockingScript != nil {
+			if len(input.PublicKey) != 0 || len(input.Cosigners) != 0 {
+				return 0, fmt.Errorf("%w: script output %s spent with keys", ErrInvalidSignature, input.PrevOut)
+			}
+			// A lock in the script is reported with the others, by CheckFinal
+			if err := tx.checkScript(&input, utxo.LockingScript, ctx); err != nil && !errors.Is(err, ErrTxNotFinal) {
+				return 0, fmt.Errorf("%w: %s", err, input.PrevOut)
+			}
+		} else if len(input.UnlockingScript) != 0 {
+			return 0, fmt.Errorf("%w: unlocking script for %s, which has no locking script", ErrTransactionInvalid, input.PrevOut)
+		} else if utxo.Escrow != nil {
+			if err := utxo.Escrow.checkSpend(tx, &input, ctx); err != nil {
+				return 0, fmt.Errorf("%w: %s", err, input.PrevOut)
+			}
+		} else if utxo.Multisig != nil {
+			if err := utxo.Multisig.checkSpend(&input); err != nil {
+				return 0, fmt.Errorf("%w: %s", err, input.PrevOut)
+			}
+		} else if !bytes.Equal(crypto.AddressFromPublicKey(input.PublicKey), utxo.Address) || len(input.Cosigners) != 0 {
+			return 0, fmt.Errorf("%w: key does not own %s", ErrInvalidSignature, input.PrevOut)
+		}
+		total += utxo.Amount
+	}
+
+	fee := total - tx.OutputTotal()
+	if fee < 0 {
+		return 0, fmt.Errorf("%w: outputs exceed inputs by %d", ErrTransactionInvalid, -fee)
+	}
+	return fee, tx.CheckFinal(lookup, ctx)
+}
+
+// CheckFinal checks the locks on the outputs tx spends, including those in their
+// locking scripts, and the relative locks on its inputs, against the block
+// described by ctx
+// Relative locks count from the block confirming the spent output, so they are
+// never met while it is unconfirmed.
+func (tx *Transaction) CheckFinal(lookup func(id *UTXOTransactionID) (*UTXOTransaction, bool), ctx *SpendContext) error {
+	for _, input := range tx.Inputs {
+		utxo, exists := lookup(&input.PrevOut)
+		if !exists {
+			return fmt.Errorf("%w: %s", ErrUTXONotFound, input.PrevOut)
+		}
+		if utxo.LockHeight > ctx.Height {
+			return fmt.Errorf("%w: %s locked until height %d", ErrTxNotFinal, input.PrevOut, utxo.LockHeight)
+		}
+		if utxo.LockTime > ctx.MedianTime {
+			return fmt.Errorf("%w: %s locked until time %d", ErrTxNotFinal, input.PrevOut, utxo.LockTime)
+		}
+		if utxo.LockingScript != nil {
+			if err := tx.checkScript(&input, utxo.LockingScript, ctx); errors.Is(err, ErrTxNotFinal) {
+				return fmt.Errorf("%w: %s", err, input.PrevOut)
+			}
+		}
+		if input.RelativeHeight == 0 && input.RelativeTime == 0 {
+			continue
+		}
+		if utxo.Height < 0 {
+			return fmt.Errorf("%w: %s unconfirmed", ErrTxNotFinal, input.PrevOut)
+		}
+		if ctx.Height-utxo.Height < input.RelativeHeight {
+			return fmt.Errorf("%w: %s locked until height %d", ErrTxNotFinal, input.PrevOut, utxo.Height+input.RelativeHeight)
+		}
+		if confirmed := ctx.MedianTimePast(utxo.Height); ctx.MedianTime-confirmed < input.RelativeTime {
+			return fmt.Errorf("%w: %s locked until time %d", ErrTxNotFinal, input.PrevOut, confirmed+input.RelativeTime)
+		}
+	}
+	return nil
+}
+
+func (tx *Transaction) IsCoinbase() bool {
+	return tx.Type == types.TransactionTypeCoinbase
+}
+
+func (tx *Transaction) OutputTotal() int {
+	total := 0
+	for _, output := range tx.Outputs {
+		total += output.Amount
+	}
+	return total
+}
+
+// UTXOs lists the outputs of the transaction as they appear in the UTXO set once
+// confirmed, with Height -1 until then
+func (tx *Transaction) UTXOs() []*UTXOTransaction {
+	utxos := make([]*UTXOTransaction, len(tx.Outputs))
+	for i, output := range tx.Outputs {
+		utxos[i] = &UTXOTransaction{
+			ID:            UTXOTransactionID{TxID: tx.ID, Index: i},
+			Address:       output.Address,
+			Amount:        output.Amount,
+			Escrow:        output.Escrow,
+			Multisig:      output.Multisig,
+			LockingScript: output.LockingScript,
+			LockHeight:    output.LockHeight,
+			LockTime:      output.LockTime,
+			Coinbase:      tx.IsCoinbase(),
+			Height:        -1,
+		}
+	}
+	return utxos
 }
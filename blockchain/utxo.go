@@ -1,19 +1,45 @@
 package blockchain
 
 import (
+	"bytes"
 	"fmt"
+	"sync"
+	"trustify/logger"
 )
 
+// UTXOTransaction is a spendable transaction output together with the outpoint naming it
 type UTXOTransaction struct {
-	ID      UTXOTransactionID
-	Address []byte
-	Amount  int
-	Fee     int
+	ID       UTXOTransactionID
+	Address  []byte
+	Amount   int
+	Escrow   *EscrowTerms   // set for escrowed purchase payments, paid to a script address
+	Multisig *MultisigTerms // set for outputs locked to several keys, paid to a script address
+	// Set for outputs spent by running scripts, paid to the script address
+	LockingScript []byte
+	// Absolute locks of the output, see TxOutput
+	LockHeight int
+	LockTime   int64
+	// Height of the block that created the output, -1 while unconfirmed
+	Height int
+	// Set for mining and review rewards, which must mature before they are spent
+	Coinbase bool
 }
 
+// Mature reports whether the output may be spent in a block at height. Coinbase
+// outputs would vanish with their block in a reorg, so they wait maturity blocks;
+// the genesis allocations cannot be reorganized away and are spendable at once.
+func (utxo *UTXOTransaction) Mature(height int, maturity int) bool {
+	if !utxo.Coinbase || utxo.Height == 0 {
+		return true
+	}
+	return utxo.Height > 0 && height-utxo.Height >= maturity
+}
+
+// UTXOTransactionID names an output by the ID of the transaction that created it
+// and its index among that transaction's outputs
 type UTXOTransactionID struct {
-	BlockHash []byte
-	TxIndex   int
+	TxID  []byte
+	Index int
 }
 
 // The reason to use UTXOSet is for faster lookups
@@ -31,6 +57,7 @@ type UTXOTransactionID struct {
 
 type UTXOSet struct {
 	UTXOs map[string]*UTXOTransaction
+	Mutex sync.Mutex
 }
 
 func NewUTXOSet() *UTXOSet {
@@ -40,65 +67,118 @@ func NewUTXOSet() *UTXOSet {
 
 // Helper method to convert UTXOTransactionID to string
 func (id UTXOTransactionID) String() string {
-    return fmt.Sprintf("%x:%d", id.BlockHash, id.TxIndex)
+    return fmt.Sprintf("%x:%d", id.TxID, id.Index)
 }
 
-func (u *UTXOSet) Add(utxo *UTXOTransaction) {
+func (u *UTXOSet) Add(utxo *UTXOTransaction) bool {
 	// Add a UXTO transaction to the set
 	// Make sure the transaction is unique
 	// There cannot be duplocates in a set!
-	// Return a boolean indicating success or failure
-	// u.Mutex.Lock()
-    // defer u.Mutex.Unlock()
-    // key := utxo.ID.String()
-    // if _, exists := u.UTXOs[key]; exists {
-    //     logger.ErrorLogger.Println("UTXO already exists:", key)
-    //     return false
-    // }
-    // u.UTXOs[key] = &utxo
-    // logger.InfoLogger.Println("UTXO added:", key)
-    // return true
-}
-
-func (u *UTXOSet) Remove(id UTXOTransactionID) {
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+	key := utxo.ID.String()
+	if _, exists := u.UTXOs[key]; exists {
+		logger.ErrorLogger.Println("UTXO already exists:", key)
+		return false
+	}
+	u.UTXOs[key] = utxo
+	return true
+}
+
+func (u *UTXOSet) Remove(id UTXOTransactionID) bool {
 	// Remove the transaction from the set
-	// Return a boolean indicating success or failure
-	// u.Mutex.Lock()
-    // defer u.Mutex.Unlock()
-    // key := id.String()
-    // if _, exists := u.UTXOs[key]; !exists {
-    //     logger.ErrorLogger.Println("UTXO not found:", key)
-    //     return false
-    // }
-    // delete(u.UTXOs, key)
-    // logger.InfoLogger.Println("UTXO removed:", key)
-    // return true
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+	key := id.String()
+	if _, exists := u.UTXOs[key]; !exists {
+		logger.ErrorLogger.Println("UTXO not found:", key)
+		return false
+	}
+	delete(u.UTXOs, key)
+	return true
 }
 
 func (u *UTXOSet) Get(id *UTXOTransactionID) (*UTXOTransaction, bool) {
-	// Get the transaction
-	// u.Mutex.Lock()
-    // defer u.Mutex.Unlock()
-    // key := id.String()
-    // utxo, exists := u.UTXOs[key]
-    // if !exists {
-    //     logger.ErrorLogger.Println("UTXO not found:", key)
-    //     return nil, false
-    // }
-    // return utxo, true
-    return nil, false
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+	utxo, exists := u.UTXOs[id.String()]
+	return utxo, exists
 }
 
 func (u *UTXOSet) GetAllForAddress(address []byte) []*UTXOTransaction {
-	// // Get all transcations for the specified address
-	// u.Mutex.Lock()
-    // defer u.Mutex.Unlock()
-    // var utxos []*UTXOTransaction
-    // for _, utxo := range u.UTXOs {
-    //     if bytes.Equal(utxo.Address, address) {
-    //         utxos = append(utxos, utxo)
-    //     }
-    // }
-    // return utxos
-    return nil
-}
\ No newline at end of file
+	// Get all transcations for the specified address
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+	var utxos []*UTXOTransaction
+	for _, utxo := range u.UTXOs {
+		if bytes.Equal(utxo.Address, address) {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos
+}
+
+// GetEscrows returns the unspent escrow outputs in which address is buyer or seller
+func (u *UTXOSet) GetEscrows(address []byte) []*UTXOTransaction {
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+	var utxos []*UTXOTransaction
+	for _, utxo := range u.UTXOs {
+		if utxo.Escrow != nil && (bytes.Equal(utxo.Escrow.BuyerAddress, address) || bytes.Equal(utxo.Escrow.SellerAddress, address)) {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos
+}
+
+// GetMultisig returns the unspent multisig outputs that publicKey may sign for
+func (u *UTXOSet) GetMultisig(publicKey []byte) []*UTXOTransaction {
+	u.Mutex.Lock()
+	defer u.Mutex.Unlock()
+	var utxos []*UTXOTransaction
+	for _, utxo := range u.UTXOs {
+		if utxo.Multisig != nil && utxo.Multisig.Includes(publicKey) {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos
+}
+
+// utxoView overlays the outputs created and spent by a block's transactions on the
+// UTXO set while the block is validated, without modifying the set itself
+type utxoView struct {
+	base    *UTXOSet
+	height  int // of the block being validated
+	created map[string]*UTXOTransaction
+	spent   map[string]bool
+}
+
+func newUTXOView(base *UTXOSet, height int) *utxoView {
+	return &utxoView{
+		base:    base,
+		height:  height,
+		created: make(map[string]*UTXOTransaction),
+		spent:   make(map[string]bool),
+	}
+}
+
+func (v *utxoView) Get(id *UTXOTransactionID) (*UTXOTransaction, bool) {
+	key := id.String()
+	if v.spent[key] {
+		return nil, false
+	}
+	if utxo, exists := v.created[key]; exists {
+		return utxo, true
+	}
+	return v.base.Get(id)
+}
+
+func (v *utxoView) apply(tx *Transaction) {
+	for _, input := range tx.Inputs {
+		v.spent[input.PrevOut.String()] = true
+	}
+	for _, utxo := range tx.UTXOs() {
+		utxo.Height = v.height
+		v.created[utxo.ID.String()] = utxo
+	}
+}
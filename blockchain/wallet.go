@@ -1,57 +1,228 @@
 package blockchain
 
-// import ("trustery/logger")
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"trustify/config"
+	"trustify/crypto"
+	"trustify/logger"
+)
 
 type Wallet struct {
+	// The wallet's identity: the key it lists products with and signs for by default
 	BitcoinAddress []byte
 	PublicKey      []byte
 	PrivateKey     []byte
-	UTXOs          []*UTXOTransaction
+	// Every key of the wallet by address, the identity's included
+	Keys          map[string]*WalletKey
+	UTXOs         []*UTXOTransaction
+	CoinSelection CoinSelector
+	// Unused addresses derived ahead on each chain of an HD wallet
+	GapLimit int
+	// Held no private keys, see NewWatchOnlyWallet
+	WatchOnly bool
+	// Names of the wallet's addresses, and other notes kept in the wallet file
+	Labels   map[string]string
+	Metadata map[string]string
+	// Height of the chain tip the UTXOs are as of, and the blocks coinbase outputs
+	// take to mature there, which decide what the wallet can spend in the next block
+	Height           int
+	CoinbaseMaturity int
+	// Confirmations after which received coins count as confirmed balance
+	ConfirmationDepth int
+	Pending           func() []*Transaction // mempool transactions, whose inputs are not selected again; nil outside a node
+	Mutex             sync.RWMutex
+
+	history []*WalletTransaction          // confirmed transactions, oldest first
+	undo    map[string][]*UTXOTransaction // block hash -> wallet outputs the block spent
+	roles   map[string][]byte             // purchase, review or escrow -> wallet address acting in it
+	chains  [2]*hdChain                   // receive and change chains of an HD wallet
+	account *crypto.ExtendedKey           // public key of an HD wallet's account
+	scan    *rescanState                  // current or last rescan
+
+	mnemonic           string // of an HD wallet, kept for its file while unlocked
+	mnemonicPassphrase string
+	file               *walletFileState
+	locked             bool
+	lockTimer          *time.Timer
 }
 
 func NewWallet(privateKey []byte, publicKey []byte, bitcoinAddress []byte) *Wallet {
 	// The wallet is initialized with an empty list of UTXOs
 	// Other parameters are part of the configuration object
-	return &Wallet{
+	w := &Wallet{
 		BitcoinAddress: bitcoinAddress,
 		PublicKey:      publicKey,
 		PrivateKey:     privateKey,
+		Keys:           make(map[string]*WalletKey),
+		Labels:         make(map[string]string),
+		Metadata:       make(map[string]string),
 		UTXOs:          make([]*UTXOTransaction, 0),
+		CoinSelection:  LargestFirst,
+		undo:           make(map[string][]*UTXOTransaction),
+		roles:          make(map[string][]byte),
+	}
+	if bitcoinAddress != nil {
+		w.Keys[string(bitcoinAddress)] = &WalletKey{Address: bitcoinAddress, PublicKey: publicKey, PrivateKey: privateKey}
+	}
+	return w
+}
+
+// NewWalletFromConfig decodes the hex keys of a configured wallet and checks
+// that they belong together and to the configured address
+// A wallet configured with a mnemonic is an HD wallet instead, see NewHDWallet, and
+// one configured with a file is loaded from it, see LoadWalletFile. A watch-only
+// wallet watches the configured account key and addresses or public keys.
+func NewWalletFromConfig(cfg *config.ConfigWallet) (*Wallet, error) {
+	if cfg.File != "" {
+		passphrase, err := WalletPassphrase(cfg.PassphraseEnv)
+		if err != nil {
+			return nil, err
+		}
+		wallet, err := LoadWalletFile(cfg.File, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		wallet.scheduleLock(time.Duration(cfg.UnlockTimeout) * time.Second)
+		return wallet, wallet.setCoinSelection(cfg.CoinSelection)
+	}
+	if cfg.WatchOnly {
+		wallet, err := newWatchOnlyWalletFromConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return wallet, wallet.setCoinSelection(cfg.CoinSelection)
+	}
+	if cfg.Mnemonic != "" {
+		wallet, err := NewHDWallet(cfg.Mnemonic, cfg.Passphrase, cfg.GapLimit)
+		if err != nil {
+			return nil, err
+		}
+		return wallet, wallet.setCoinSelection(cfg.CoinSelection)
+	}
+	privateKey, err := hex.DecodeString(cfg.PrivateKey)
+	if err != nil {
+		return nil, crypto.ErrInvalidPrivateKey
 	}
+	publicKey, err := hex.DecodeString(cfg.PublicKey)
+	if err != nil {
+		return nil, crypto.ErrInvalidPublicKey
+	}
+	derived, err := crypto.PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(derived, publicKey) {
+		return nil, errors.New("public key does not match private key")
+	}
+	if !bytes.Equal(crypto.AddressFromPublicKey(publicKey), []byte(cfg.BitcoinAddress)) {
+		return nil, errors.New("bitcoin address does not match public key")
+	}
+	wallet := NewWallet(privateKey, publicKey, []byte(cfg.BitcoinAddress))
+	return wallet, wallet.setCoinSelection(cfg.CoinSelection)
 }
 
-func (w *Wallet) GetBalance() int {
-	// Calculate balance from UTXOs
-	// Calculate balance from a list of UTXO transactions
-	// balance := 0
-    // for _, utxo := range w.UTXOs {
-    //     balance += utxo.Amount
-    // }
-    // logger.InfoLogger.Println("Wallet balance calculated:", balance)
-    // return balance
-    return 0
-}
-
-func (w *Wallet) SignTransaction(tx *UTXOTransaction) {
-	// TODO
-	// return crypto.Sign(tx, w.PrivateKey)
-}
-
-func (w *Wallet) CreateInputs(amount int) ([]UTXOTransaction, int, error) {
-    // var inputs []UTXOTransaction
-    // total := 0
-    // for _, utxo := range w.UTXOs {
-    //     inputs = append(inputs, *utxo)
-    //     total += utxo.Amount
-    //     if total >= amount {
-    //         break
-    //     }
-    // }
-    // if total < amount {
-    //     logger.ErrorLogger.Println("Insufficient funds")
-    //     return nil, 0, ErrInsufficientFunds
-    // }
-    // change := total - amount
-    // return inputs, change, nil
-    return nil, 0, nil
-}
\ No newline at end of file
+func (w *Wallet) setCoinSelection(name string) error {
+	if name == "" {
+		return nil
+	}
+	selector, exists := CoinSelectors[name]
+	if !exists {
+		return fmt.Errorf("unknown coin selection strategy %q", name)
+	}
+	w.CoinSelection = selector
+	return nil
+}
+
+// GetBalance returns what the wallet can spend in the next block, and the immature
+// balance of rewards it cannot spend yet
+func (w *Wallet) GetBalance() (int, int) {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	spendable, immature := 0, 0
+	for _, utxo := range w.UTXOs {
+		if utxo.Mature(w.Height+1, w.CoinbaseMaturity) {
+			spendable += utxo.Amount
+		} else {
+			immature += utxo.Amount
+		}
+	}
+	return spendable, immature
+}
+
+// spendable lists the UTXOs the wallet may spend in the next block, see canSpend,
+// leaving out those pending transactions already spend
+func (w *Wallet) spendable() []*UTXOTransaction {
+	// Pending takes the mempool lock, so it is asked before taking the wallet's
+	spent := make(map[string]bool)
+	if w.Pending != nil {
+		for _, tx := range w.Pending() {
+			for _, input := range tx.Inputs {
+				spent[input.PrevOut.String()] = true
+			}
+		}
+	}
+
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	var utxos []*UTXOTransaction
+	for _, utxo := range w.UTXOs {
+		if !spent[utxo.ID.String()] && utxo.Mature(w.Height+1, w.CoinbaseMaturity) && w.canSpend(utxo.Address) {
+			utxos = append(utxos, utxo)
+		}
+	}
+	return utxos
+}
+
+// SignTransaction signs every input with the key of the wallet's output it spends,
+// and the inputs spending other outputs, such as escrows, with the identity key
+func (w *Wallet) SignTransaction(tx *Transaction) error {
+	for i, input := range tx.Inputs {
+		key, err := w.signingKey(w.ownerOf(input))
+		if err != nil {
+			return err
+		}
+		if err := tx.SignInput(i, key.PrivateKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateInputs selects mature UTXOs covering amount with the wallet's coin selection
+// strategy and returns them as unsigned inputs, along with the change left over
+func (w *Wallet) CreateInputs(amount int) ([]TxInput, int, error) {
+	return w.createInputs(amount, nil)
+}
+
+// createInputs selects inputs like CreateInputs, only from the UTXOs of address
+// when it is set
+func (w *Wallet) createInputs(amount int, address []byte) ([]TxInput, int, error) {
+	utxos := w.spendable()
+	if address != nil {
+		var from []*UTXOTransaction
+		for _, utxo := range utxos {
+			if bytes.Equal(utxo.Address, address) {
+				from = append(from, utxo)
+			}
+		}
+		utxos = from
+	}
+	selected, err := w.CoinSelection(utxos, amount)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to select inputs:", err)
+		return nil, 0, err
+	}
+
+	var inputs []TxInput
+	total := 0
+	for _, utxo := range selected {
+		inputs = append(inputs, TxInput{PrevOut: utxo.ID})
+		total += utxo.Amount
+	}
+	return inputs, total - amount, nil
+}
@@ -0,0 +1,491 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"trustify/crypto"
+	"trustify/logger"
+
+	"golang.org/x/term"
+)
+
+// A wallet file keeps the wallet's keys, labels and metadata encrypted on disk. The
+// passphrase is stretched with scrypt into an AES-256-GCM key that seals the
+// secrets; the scrypt parameters and salt are stored in the clear and authenticated
+// along with them.
+
+const walletFileVersion = 1
+
+// scrypt cost of new wallet files, about 32 MB and a fraction of a second
+const (
+	walletScryptN = 1 << 15
+	walletScryptR = 8
+	walletScryptP = 1
+)
+
+// Environment variable holding the wallet file passphrase, when not configured
+const DefaultPassphraseEnv = "TRUSTIFY_WALLET_PASSPHRASE"
+
+// walletFile is the envelope written to disk
+type walletFile struct {
+	Version int
+	N, R, P int
+	Salt    []byte
+	Nonce   []byte
+	Sealed  []byte
+}
+
+// walletSecrets is what a wallet file seals
+type walletSecrets struct {
+	Mnemonic   string
+	Passphrase string // of the mnemonic, see crypto.MnemonicSeed
+	AccountKey string // of a watch-only HD wallet
+	WatchOnly  bool
+	GapLimit   int
+	Next       [2]int      // next fresh index of the receive and change chains
+	Keys       []WalletKey // keys not derived from the mnemonic, the identity first
+	Labels     map[string]string
+	Metadata   map[string]string
+}
+
+// walletFileState ties a wallet to its file, with the key sealing it while unlocked
+type walletFileState struct {
+	path   string
+	header walletFile
+	key    []byte
+}
+
+// header is the part of the envelope authenticated with the secrets
+func (f *walletFile) header() []byte {
+	return []byte(fmt.Sprintf("trustify wallet %d %d %d %d %x", f.Version, f.N, f.R, f.P, f.Salt))
+}
+
+func (f *walletFile) deriveKey(passphrase string) ([]byte, error) {
+	return crypto.Scrypt([]byte(passphrase), f.Salt, f.N, f.R, f.P, 32)
+}
+
+func (f *walletFile) seal(key []byte, secrets *walletSecrets) error {
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(secrets); err != nil {
+		return err
+	}
+	aead, err := newWalletAEAD(key)
+	if err != nil {
+		return err
+	}
+	f.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return err
+	}
+	f.Sealed = aead.Seal(nil, f.Nonce, plaintext.Bytes(), f.header())
+	wipe(plaintext.Bytes())
+	return nil
+}
+
+func (f *walletFile) open(key []byte) (*walletSecrets, error) {
+	aead, err := newWalletAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, f.Nonce, f.Sealed, f.header())
+	if err != nil {
+		return nil, ErrWalletPassphrase
+	}
+	defer wipe(plaintext)
+	var secrets walletSecrets
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&secrets); err != nil {
+		return nil, fmt.Errorf("corrupt wallet file: %w", err)
+	}
+	return &secrets, nil
+}
+
+func newWalletAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func readWalletFile(path string) (*walletFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f walletFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&f); err != nil {
+		return nil, fmt.Errorf("corrupt wallet file %s: %w", path, err)
+	}
+	if f.Version != walletFileVersion {
+		return nil, fmt.Errorf("unsupported wallet file version %d", f.Version)
+	}
+	return &f, nil
+}
+
+// writeWalletFile replaces the file at path atomically, readable by its owner only
+func writeWalletFile(path string, f *walletFile) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := gob.NewEncoder(tmp).Encode(f); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Encrypt writes the wallet to a new encrypted file at path, sealed under
+// passphrase, which the wallet saves its labels and metadata to from then on
+func (w *Wallet) Encrypt(path string, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("empty wallet passphrase")
+	}
+	f := walletFile{Version: walletFileVersion, N: walletScryptN, R: walletScryptR, P: walletScryptP, Salt: make([]byte, 32)}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return err
+	}
+	key, err := f.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if w.locked {
+		return ErrWalletLocked
+	}
+	w.file = &walletFileState{path: path, header: f, key: key}
+	if err := w.save(); err != nil {
+		w.file = nil
+		return err
+	}
+	logger.InfoLogger.Printf("Wallet encrypted to %s\n", path)
+	return nil
+}
+
+// LoadWalletFile decrypts the wallet file at path with passphrase. The wallet is
+// unlocked until Lock is called.
+func LoadWalletFile(path string, passphrase string) (*Wallet, error) {
+	f, err := readWalletFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := f.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := f.open(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var w *Wallet
+	keys := secrets.Keys
+	switch {
+	case secrets.Mnemonic != "":
+		w, err = NewHDWallet(secrets.Mnemonic, secrets.Passphrase, secrets.GapLimit)
+	case secrets.AccountKey != "":
+		w, err = NewWatchOnlyHDWallet(secrets.AccountKey, secrets.GapLimit)
+	case secrets.WatchOnly:
+		w = NewWatchOnlyWallet()
+	default:
+		if len(keys) == 0 {
+			return nil, errors.New("wallet file holds no keys")
+		}
+		w = NewWallet(keys[0].PrivateKey, keys[0].PublicKey, keys[0].Address)
+		keys = keys[1:]
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w.IsHD() {
+		for chain, next := range secrets.Next {
+			if next > w.chains[chain].next {
+				w.chains[chain].next = next
+				if err := w.lookahead(chain, next-1); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	for i := range keys {
+		w.Keys[string(keys[i].Address)] = &keys[i]
+	}
+	if w.BitcoinAddress == nil && len(keys) > 0 {
+		w.BitcoinAddress, w.PublicKey = keys[0].Address, keys[0].PublicKey
+	}
+	for address, label := range secrets.Labels {
+		w.Labels[address] = label
+	}
+	for name, value := range secrets.Metadata {
+		w.Metadata[name] = value
+	}
+	w.file = &walletFileState{path: path, header: *f, key: key}
+	logger.InfoLogger.Printf("Wallet loaded from %s with %d keys\n", path, len(w.Keys))
+	return w, nil
+}
+
+// save seals the wallet's secrets to its file. The caller holds the wallet's mutex.
+func (w *Wallet) save() error {
+	if w.file == nil {
+		return nil
+	}
+	if w.locked {
+		return ErrWalletLocked
+	}
+	secrets := &walletSecrets{
+		Mnemonic:   w.mnemonic,
+		Passphrase: w.mnemonicPassphrase,
+		WatchOnly:  w.WatchOnly,
+		GapLimit:   w.GapLimit,
+		Labels:     w.Labels,
+		Metadata:   w.Metadata,
+	}
+	if identity, exists := w.Keys[string(w.BitcoinAddress)]; exists && !w.isDerived(identity) {
+		secrets.Keys = append(secrets.Keys, *identity)
+	}
+	for _, key := range w.Keys {
+		if !w.isDerived(key) && !bytes.Equal(key.Address, w.BitcoinAddress) {
+			secrets.Keys = append(secrets.Keys, *key)
+		}
+	}
+	for i, c := range w.chains {
+		if c != nil {
+			secrets.Next[i] = c.next
+		}
+	}
+	if w.WatchOnly && w.account != nil {
+		secrets.AccountKey = w.account.String()
+	}
+
+	f := w.file.header
+	if err := f.seal(w.file.key, secrets); err != nil {
+		return err
+	}
+	return writeWalletFile(w.file.path, &f)
+}
+
+// Save writes the wallet's labels and metadata to its file
+func (w *Wallet) Save() error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if w.file == nil {
+		return ErrWalletNotEncrypted
+	}
+	return w.save()
+}
+
+// SetLabel names one of the wallet's addresses, saving it to the wallet file
+func (w *Wallet) SetLabel(address []byte, label string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if _, exists := w.Keys[string(address)]; !exists {
+		return fmt.Errorf("%w: %s is not a wallet address", crypto.ErrInvalidAddress, address)
+	}
+	w.Labels[string(address)] = label
+	return w.save()
+}
+
+// SetMetadata stores a value under name in the wallet file
+func (w *Wallet) SetMetadata(name string, value string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	w.Metadata[name] = value
+	return w.save()
+}
+
+// IsLocked reports whether the wallet's private keys are out of memory
+func (w *Wallet) IsLocked() bool {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	return w.locked
+}
+
+// Lock wipes the private keys, the mnemonic and the file key from memory. The
+// wallet still tracks its outputs and hands out fresh addresses, but cannot sign
+// until unlocked again.
+func (w *Wallet) Lock() error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if w.file == nil {
+		return ErrWalletNotEncrypted
+	}
+	if w.lockTimer != nil {
+		w.lockTimer.Stop()
+		w.lockTimer = nil
+	}
+	if w.locked {
+		return nil
+	}
+	for _, key := range w.Keys {
+		wipe(key.PrivateKey)
+		key.PrivateKey = nil
+	}
+	w.PrivateKey = nil
+	for _, c := range w.chains {
+		if c != nil {
+			wipe(c.key.PrivateKey)
+			c.key = c.key.Neuter()
+		}
+	}
+	w.mnemonic, w.mnemonicPassphrase = "", ""
+	wipe(w.file.key)
+	w.file.key = nil
+	w.locked = true
+	logger.InfoLogger.Println("Wallet locked")
+	return nil
+}
+
+// Unlock restores the private keys from the wallet file with passphrase, for
+// timeout, or until Lock is called when timeout is 0
+func (w *Wallet) Unlock(passphrase string, timeout time.Duration) error {
+	w.Mutex.RLock()
+	state := w.file
+	w.Mutex.RUnlock()
+	if state == nil {
+		return ErrWalletNotEncrypted
+	}
+
+	f, err := readWalletFile(state.path)
+	if err != nil {
+		return err
+	}
+	key, err := f.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	secrets, err := f.open(key)
+	if err != nil {
+		return err
+	}
+	var account *crypto.ExtendedKey
+	if secrets.Mnemonic != "" {
+		if account, err = hdAccount(secrets.Mnemonic, secrets.Passphrase); err != nil {
+			return err
+		}
+	}
+
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if w.locked {
+		for i := range secrets.Keys {
+			if key, exists := w.Keys[string(secrets.Keys[i].Address)]; exists {
+				key.PrivateKey = secrets.Keys[i].PrivateKey
+			}
+		}
+		for i, c := range w.chains {
+			if c == nil || account == nil {
+				continue
+			}
+			chainKey, err := account.Child(uint32(i))
+			if err != nil {
+				return err
+			}
+			c.key = chainKey
+			for _, key := range c.keys {
+				child, err := chainKey.Child(uint32(key.Index))
+				if err != nil {
+					return err
+				}
+				key.PrivateKey = child.PrivateKey
+			}
+		}
+		if identity, exists := w.Keys[string(w.BitcoinAddress)]; exists {
+			w.PrivateKey = identity.PrivateKey
+		}
+		w.mnemonic, w.mnemonicPassphrase = secrets.Mnemonic, secrets.Passphrase
+		w.locked = false
+	}
+	w.file.header = *f
+	w.file.key = key
+	w.scheduleLock(timeout)
+	logger.InfoLogger.Println("Wallet unlocked")
+	return nil
+}
+
+// scheduleLock locks the wallet after timeout, replacing any earlier timeout. The
+// caller holds the wallet's mutex.
+func (w *Wallet) scheduleLock(timeout time.Duration) {
+	if w.lockTimer != nil {
+		w.lockTimer.Stop()
+		w.lockTimer = nil
+	}
+	if timeout <= 0 {
+		return
+	}
+	w.lockTimer = time.AfterFunc(timeout, func() {
+		if err := w.Lock(); err != nil {
+			logger.ErrorLogger.Println("Failed to lock wallet:", err)
+		}
+	})
+}
+
+// signingKey returns a copy of the wallet's key of address, or of the identity key
+// when the wallet has none, and fails for keys the wallet only watches or while it
+// is locked
+func (w *Wallet) signingKey(address []byte) (*WalletKey, error) {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	key, exists := w.Keys[string(address)]
+	if !exists {
+		key = w.Keys[string(w.BitcoinAddress)]
+	}
+	if w.WatchOnly || key == nil || key.Watch {
+		return nil, ErrWatchOnly
+	}
+	if w.locked || key.PrivateKey == nil {
+		return nil, ErrWalletLocked
+	}
+	copied := *key
+	return &copied, nil
+}
+
+// WalletPassphrase reads the wallet file passphrase from the environment variable
+// env, or DefaultPassphraseEnv, and prompts for it without echo when unset. It does
+// not read a passphrase from standard input that is not a terminal.
+func WalletPassphrase(env string) (string, error) {
+	if env == "" {
+		env = DefaultPassphraseEnv
+	}
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return passphrase, nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("no wallet passphrase in $%s and standard input is not a terminal", env)
+	}
+	fmt.Fprint(os.Stderr, "Wallet passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("no wallet passphrase in $%s or on the terminal", env)
+	}
+	return string(passphrase), nil
+}
+
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
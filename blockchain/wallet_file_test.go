@@ -0,0 +1,27 @@
+package blockchain
+
+import (
+	"os"
+	"testing"
+)
+
+func TestWalletPassphraseNeedsTerminal(t *testing.T) {
+	t.Setenv("TRUSTIFY_TEST_WALLET_PASSPHRASE", "")
+	stdin, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	saved := os.Stdin
+	os.Stdin = stdin
+	defer func() { os.Stdin = saved }()
+
+	if _, err := WalletPassphrase("TRUSTIFY_TEST_WALLET_PASSPHRASE"); err == nil {
+		t.Error("read a passphrase from standard input that is not a terminal")
+	}
+
+	t.Setenv("TRUSTIFY_TEST_WALLET_PASSPHRASE", "correct horse")
+	if passphrase, err := WalletPassphrase("TRUSTIFY_TEST_WALLET_PASSPHRASE"); err != nil || passphrase != "correct horse" {
+		t.Errorf("got %q, %v from the environment", passphrase, err)
+	}
+}
@@ -0,0 +1,201 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"trustify/types"
+)
+
+// WalletTransaction is an entry of the wallet's history: one transaction as it
+// touched one of the wallet's addresses
+type WalletTransaction struct {
+	TxID    []byte
+	Type    types.TransactionType
+	Address []byte
+	// Height of the confirming block, -1 while the transaction is in the mempool
+	Height        int
+	Confirmations int
+	Received      int // paid to the address
+	Sent          int // spent from the address
+}
+
+// WalletBalance splits the wallet's coins by how settled they are
+// Outputs spent by pending transactions still count as confirmed or unconfirmed
+// until those confirm; PendingOutgoing is what the pending transactions spend.
+type WalletBalance struct {
+	Confirmed       int // mature outputs with at least ConfirmationDepth confirmations
+	Unconfirmed     int // outputs with fewer confirmations, or paid by pending transactions
+	Immature        int // coinbase outputs that cannot be spent yet
+	PendingOutgoing int // wallet outputs spent by pending transactions
+}
+
+// owns reports whether address belongs to the wallet
+func (w *Wallet) owns(address []byte) bool {
+	_, exists := w.Keys[string(address)]
+	return exists
+}
+
+// ConnectBlock keeps the wallet's UTXOs and history in step with the chain, so a
+// registered wallet always reflects the tip
+// During a rescan, blocks past the next one the wallet lacks are left to it.
+func (w *Wallet) ConnectBlock(b *Block, height int) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if w.rescanning() && height != w.Height+1 {
+		return
+	}
+	w.Height = height
+
+	var spent []*UTXOTransaction
+	for _, tx := range b.Transactions {
+		byAddress := make(map[string]*WalletTransaction)
+		entry := func(address []byte) *WalletTransaction {
+			if byAddress[string(address)] == nil {
+				e := &WalletTransaction{TxID: tx.ID, Type: tx.Type, Address: address, Height: height}
+				byAddress[string(address)] = e
+				w.history = append(w.history, e)
+			}
+			return byAddress[string(address)]
+		}
+		if !tx.IsCoinbase() {
+			for _, input := range tx.Inputs {
+				if utxo := w.removeUTXO(input.PrevOut); utxo != nil {
+					spent = append(spent, utxo)
+					entry(utxo.Address).Sent += utxo.Amount
+				}
+			}
+		}
+		for _, utxo := range tx.UTXOs() {
+			if !w.owns(utxo.Address) {
+				continue
+			}
+			utxo.Height = height
+			w.UTXOs = append(w.UTXOs, utxo)
+			w.markUsed(utxo.Address)
+			entry(utxo.Address).Received += utxo.Amount
+		}
+		w.recordRoles(tx)
+	}
+	w.undo[hex.EncodeToString(b.Header.BlockHash)] = spent
+}
+
+// DisconnectBlock undoes ConnectBlock for the tip being disconnected
+func (w *Wallet) DisconnectBlock(b *Block, height int) {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if w.rescanning() && height > w.Height {
+		return
+	}
+	w.Height = height - 1
+
+	created := make(map[string]bool)
+	for _, tx := range b.Transactions {
+		created[string(tx.ID)] = true
+		for i := range tx.Outputs {
+			w.removeUTXO(UTXOTransactionID{TxID: tx.ID, Index: i})
+		}
+	}
+	// Outputs both created and spent in the block go with it
+	blockKey := hex.EncodeToString(b.Header.BlockHash)
+	for _, utxo := range w.undo[blockKey] {
+		if !created[string(utxo.ID.TxID)] {
+			w.UTXOs = append(w.UTXOs, utxo)
+		}
+	}
+	delete(w.undo, blockKey)
+
+	for len(w.history) > 0 && w.history[len(w.history)-1].Height == height {
+		w.history = w.history[:len(w.history)-1]
+	}
+}
+
+func (w *Wallet) removeUTXO(id UTXOTransactionID) *UTXOTransaction {
+	for i, utxo := range w.UTXOs {
+		if bytes.Equal(utxo.ID.TxID, id.TxID) && utxo.ID.Index == id.Index {
+			w.UTXOs = append(w.UTXOs[:i:i], w.UTXOs[i+1:]...)
+			return utxo
+		}
+	}
+	return nil
+}
+
+// Balances reports the wallet's balances, taking into account the pending
+// transactions of the mempool
+func (w *Wallet) Balances(pending []*Transaction) WalletBalance {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+
+	var balance WalletBalance
+	for _, utxo := range w.UTXOs {
+		switch {
+		case !utxo.Mature(w.Height+1, w.CoinbaseMaturity):
+			balance.Immature += utxo.Amount
+		case w.Height-utxo.Height+1 >= w.ConfirmationDepth:
+			balance.Confirmed += utxo.Amount
+		default:
+			balance.Unconfirmed += utxo.Amount
+		}
+	}
+	for _, entry := range w.pendingEntries(pending) {
+		balance.Unconfirmed += entry.Received
+		balance.PendingOutgoing += entry.Sent
+	}
+	return balance
+}
+
+// History lists the transactions that touched address, newest first, pending ones
+// from the mempool ahead of the confirmed
+func (w *Wallet) History(address []byte, pending []*Transaction) []WalletTransaction {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+
+	var history []WalletTransaction
+	entries := w.pendingEntries(pending)
+	for i := len(entries) - 1; i >= 0; i-- {
+		if bytes.Equal(entries[i].Address, address) {
+			history = append(history, *entries[i])
+		}
+	}
+	for i := len(w.history) - 1; i >= 0; i-- {
+		if bytes.Equal(w.history[i].Address, address) {
+			entry := *w.history[i]
+			entry.Confirmations = w.Height - entry.Height + 1
+			history = append(history, entry)
+		}
+	}
+	return history
+}
+
+// pendingEntries returns the history entries of the pending transactions, oldest
+// first, which may spend wallet outputs confirmed or created by earlier ones
+func (w *Wallet) pendingEntries(pending []*Transaction) []*WalletTransaction {
+	outputs := make(map[string]*UTXOTransaction)
+	for _, utxo := range w.UTXOs {
+		outputs[utxo.ID.String()] = utxo
+	}
+
+	var entries []*WalletTransaction
+	for _, tx := range pending {
+		byAddress := make(map[string]*WalletTransaction)
+		entry := func(address []byte) *WalletTransaction {
+			if byAddress[string(address)] == nil {
+				e := &WalletTransaction{TxID: tx.ID, Type: tx.Type, Address: address, Height: -1}
+				byAddress[string(address)] = e
+				entries = append(entries, e)
+			}
+			return byAddress[string(address)]
+		}
+		for _, input := range tx.Inputs {
+			if utxo, exists := outputs[input.PrevOut.String()]; exists {
+				entry(utxo.Address).Sent += utxo.Amount
+			}
+		}
+		for _, utxo := range tx.UTXOs() {
+			if w.owns(utxo.Address) {
+				outputs[utxo.ID.String()] = utxo
+				entry(utxo.Address).Received += utxo.Amount
+			}
+		}
+	}
+	return entries
+}
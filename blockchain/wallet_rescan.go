@@ -0,0 +1,141 @@
+package blockchain
+
+import (
+	"time"
+	"trustify/logger"
+)
+
+// A rescan rebuilds the wallet's outputs and history from a height on, finding
+// what imported keys and addresses received before the wallet knew them, and what
+// a restored HD wallet used. The wallet is taken back to the height at once and
+// then connects the blocks up to the tip again in the background, a batch at a
+// time, so the chain goes on connecting blocks meanwhile. Until the rescan catches
+// up, blocks the chain connects past it are left for the rescan to connect.
+
+// Blocks connected per hold of the chain's lock
+const rescanBatch = 100
+
+// RescanProgress reports on the wallet's current or last rescan
+type RescanProgress struct {
+	Running  bool
+	From     int // first block rescanned
+	Height   int // last block rescanned so far
+	Tip      int // height of the chain tip when last checked
+	Started  time.Time
+	Finished time.Time // zero while running
+}
+
+type rescanState struct {
+	progress RescanProgress
+	done     chan struct{} // closed when the rescan catches up with the tip
+}
+
+// StartRescan rescans the chain from height in the background; the wallet's
+// outputs and history below height are kept. The wallet must follow bc, see
+// Blockchain.RegisterIndex, unless height is 0, which rebuilds everything.
+func (w *Wallet) StartRescan(bc *Blockchain, height int) error {
+	_, err := w.startRescan(bc, height)
+	return err
+}
+
+// RescanFrom rescans like StartRescan and waits until the wallet has caught up
+// with the tip
+func (w *Wallet) RescanFrom(bc *Blockchain, height int) error {
+	scan, err := w.startRescan(bc, height)
+	if err != nil {
+		return err
+	}
+	<-scan.done
+	return nil
+}
+
+// Rescan rebuilds the wallet's outputs and history from the chain, deriving keys
+// as they turn out to be used. It recovers the balance of a restored HD wallet
+// that was not registered with bc from the start.
+func (w *Wallet) Rescan(bc *Blockchain) error {
+	return w.RescanFrom(bc, 0)
+}
+
+// RescanProgress reports on the current or last rescan, and whether there was one
+func (w *Wallet) RescanProgress() (RescanProgress, bool) {
+	w.Mutex.RLock()
+	defer w.Mutex.RUnlock()
+	if w.scan == nil {
+		return RescanProgress{}, false
+	}
+	return w.scan.progress, true
+}
+
+func (w *Wallet) startRescan(bc *Blockchain, height int) (*rescanState, error) {
+	bc.Mutex.RLock()
+	defer bc.Mutex.RUnlock()
+
+	w.Mutex.Lock()
+	if w.rescanning() {
+		w.Mutex.Unlock()
+		return nil, ErrRescanInProgress
+	}
+	if height < 0 {
+		height = 0
+	}
+	scan := &rescanState{
+		progress: RescanProgress{Running: true, From: height, Height: height - 1, Tip: len(bc.Ledger) - 1, Started: time.Now()},
+		done:     make(chan struct{}),
+	}
+	w.scan = scan
+	if height == 0 {
+		w.UTXOs = make([]*UTXOTransaction, 0)
+		w.history = nil
+		w.undo = make(map[string][]*UTXOTransaction)
+		w.Height = -1
+	}
+	tip := w.Height
+	w.Mutex.Unlock()
+
+	// Blocks are taken off the wallet's view of the chain down to height, which
+	// restores the outputs they spent
+	for h := min(tip, len(bc.Ledger)-1); h >= height; h-- {
+		w.DisconnectBlock(bc.Ledger[h], h)
+	}
+	logger.InfoLogger.Printf("Wallet rescan started at block %d of %d\n", height, len(bc.Ledger)-1)
+	go w.runRescan(bc, scan)
+	return scan, nil
+}
+
+// runRescan connects the blocks past the wallet's height until it reaches the tip
+func (w *Wallet) runRescan(bc *Blockchain, scan *rescanState) {
+	defer close(scan.done)
+	for {
+		bc.Mutex.RLock()
+		tip := len(bc.Ledger) - 1
+		w.Mutex.RLock()
+		next := w.Height + 1
+		w.Mutex.RUnlock()
+		for end := min(next+rescanBatch, tip+1); next < end; next++ {
+			w.ConnectBlock(bc.Ledger[next], next)
+		}
+
+		w.Mutex.Lock()
+		scan.progress.Height, scan.progress.Tip = next-1, tip
+		caughtUp := next > tip
+		if caughtUp {
+			scan.progress.Running = false
+			scan.progress.Finished = time.Now()
+		}
+		progress := scan.progress
+		w.Mutex.Unlock()
+		bc.Mutex.RUnlock()
+
+		if caughtUp {
+			logger.InfoLogger.Printf("Wallet rescanned blocks %d to %d in %v, %d keys\n", progress.From, progress.Tip, progress.Finished.Sub(progress.Started), len(w.Addresses()))
+			return
+		}
+		logger.InfoLogger.Printf("Wallet rescan at block %d of %d\n", progress.Height, progress.Tip)
+	}
+}
+
+// rescanning reports whether a rescan is catching up with the tip. The caller
+// holds the wallet's mutex.
+func (w *Wallet) rescanning() bool {
+	return w.scan != nil && w.scan.progress.Running
+}
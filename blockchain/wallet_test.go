@@ -0,0 +1,36 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+	"trustify/config"
+)
+
+func TestCreateInputsSkipsPendingSpends(t *testing.T) {
+	w := newTestWallet(t)
+	for i, amount := range []int{100, 60} {
+		w.UTXOs = append(w.UTXOs, &UTXOTransaction{ID: UTXOTransactionID{TxID: []byte{byte(i + 1)}, Index: 0}, Address: w.BitcoinAddress, Amount: amount})
+	}
+	mp := NewMempool(&config.ConfigMempool{})
+	w.Pending = mp.Pending
+
+	first, err := NewTransferTransaction(w, []TxOutput{{Address: []byte("1BoatSLRHtKNngkdXEeobR76b53LETtpyT"), Amount: 50}}, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.AddTransaction(first, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second transfer, made before the first confirms, spends the other output
+	inputs, change, err := w.CreateInputs(51)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) != 1 || inputs[0].PrevOut.String() == first.Inputs[0].PrevOut.String() || change != 9 {
+		t.Fatalf("selected %v with change %d, spent by %x", inputs, change, first.ID)
+	}
+	if _, _, err := w.CreateInputs(61); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("got %v selecting more than the outputs not pending", err)
+	}
+}
@@ -0,0 +1,114 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"fmt"
+	"trustify/config"
+	"trustify/crypto"
+	"trustify/logger"
+)
+
+// A watch-only wallet tracks the outputs and history of addresses whose private
+// keys it does not hold. It builds unsigned transactions spending them, to be
+// signed elsewhere, and refuses to sign with ErrWatchOnly. Any wallet may also
+// watch imported addresses alongside its own keys, without spending from them.
+
+// NewWatchOnlyWallet returns a wallet without keys, tracking the addresses and
+// public keys imported to it. The first one imported is its identity.
+func NewWatchOnlyWallet() *Wallet {
+	w := NewWallet(nil, nil, nil)
+	w.WatchOnly = true
+	return w
+}
+
+// NewWatchOnlyHDWallet tracks the receive and change addresses of the HD wallet
+// whose account has the public extended key accountKey, see Wallet.AccountKey
+func NewWatchOnlyHDWallet(accountKey string, gapLimit int) (*Wallet, error) {
+	account, err := crypto.ParseExtendedKey(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	if account.IsPrivate() {
+		return nil, fmt.Errorf("%w: a watch-only wallet takes a public extended key", crypto.ErrInvalidExtendedKey)
+	}
+	w, err := newHDWallet(account, gapLimit)
+	if err != nil {
+		return nil, err
+	}
+	w.WatchOnly = true
+	logger.InfoLogger.Printf("Watch-only HD wallet created with identity %s\n", w.BitcoinAddress)
+	return w, nil
+}
+
+func newWatchOnlyWalletFromConfig(cfg *config.ConfigWallet) (*Wallet, error) {
+	w := NewWatchOnlyWallet()
+	if cfg.AccountKey != "" {
+		var err error
+		if w, err = NewWatchOnlyHDWallet(cfg.AccountKey, cfg.GapLimit); err != nil {
+			return nil, err
+		}
+	}
+	for _, watched := range cfg.Watch {
+		if crypto.ValidateAddress([]byte(watched)) {
+			if err := w.ImportAddress([]byte(watched), ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		publicKey, err := hex.DecodeString(watched)
+		if err != nil {
+			return nil, fmt.Errorf("watched %q is neither an address nor a public key", watched)
+		}
+		if err := w.ImportPublicKey(publicKey, ""); err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// ImportAddress watches address. Outputs it received before the import are found
+// by rescanning, see StartRescan.
+func (w *Wallet) ImportAddress(address []byte, label string) error {
+	if !crypto.ValidateAddress(address) {
+		return fmt.Errorf("%w: %s", crypto.ErrInvalidAddress, address)
+	}
+	return w.importKey(&WalletKey{Address: address, Watch: true}, label)
+}
+
+// ImportPublicKey watches the address of publicKey, whose inputs the wallet can
+// then describe fully in unsigned transactions
+func (w *Wallet) ImportPublicKey(publicKey []byte, label string) error {
+	if !crypto.ValidatePublicKey(publicKey) {
+		return fmt.Errorf("%w: %x", crypto.ErrInvalidPublicKey, publicKey)
+	}
+	return w.importKey(&WalletKey{Address: crypto.AddressFromPublicKey(publicKey), PublicKey: publicKey, Watch: true}, label)
+}
+
+func (w *Wallet) importKey(key *WalletKey, label string) error {
+	w.Mutex.Lock()
+	defer w.Mutex.Unlock()
+	if existing, exists := w.Keys[string(key.Address)]; exists {
+		if existing.PublicKey == nil {
+			existing.PublicKey = key.PublicKey
+		}
+	} else {
+		w.Keys[string(key.Address)] = key
+	}
+	if w.BitcoinAddress == nil {
+		w.BitcoinAddress, w.PublicKey = key.Address, key.PublicKey
+	}
+	if label != "" {
+		w.Labels[string(key.Address)] = label
+	}
+	logger.InfoLogger.Printf("Wallet watching %s\n", key.Address)
+	return w.save()
+}
+
+// canSpend reports whether the wallet may select outputs of address as inputs.
+// A watch-only wallet spends all of its addresses in unsigned transactions; other
+// wallets leave the addresses they only watch alone. The caller holds the wallet's
+// mutex.
+func (w *Wallet) canSpend(address []byte) bool {
+	key, exists := w.Keys[string(address)]
+	return w.WatchOnly || !exists || !key.Watch
+}
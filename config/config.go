@@ -13,19 +13,53 @@ type Config struct {
 	BlockchainSettings ConfigBlockchainSettings `yaml:"blockchain_settings"`
 	GenesisBlock       ConfigGenesisBlock       `yaml:"genesis_block"`
 	Nodes              map[string]ConfigNode    `yaml:"nodes"`
+	API                ConfigAPI                `yaml:"api"`
+}
+
+type ConfigAPI struct {
+	Listen   string `yaml:"listen"`              // address of the HTTP query API, empty to disable it
+	TokenEnv string `yaml:"token_env,omitempty"` // variable holding the bearer token for POST routes, which are disabled without one
 }
 
 type ConfigBlockchainSettings struct {
 	BlockSize              int            `yaml:"block_size"`
 	TargetHash             string         `yaml:"target_hash"`
 	BlockConfirmationDepth int            `yaml:"block_confirmation_depth"`
+	CoinbaseMaturity       int            `yaml:"coinbase_maturity"` // blocks before rewards can be spent, 0 for block_confirmation_depth
 	MiningReward           int            `yaml:"mining_reward"`
 	ReviewReward           int            `yaml:"review_reward"`
 	RewardHalfTime         int            `yaml:"reward_half_time"`
 	MiningTimeout          int            `yaml:"mining_timeout"`
+	ReputationModel        string         `yaml:"reputation_model,omitempty"`
+	Mempool                ConfigMempool  `yaml:"mempool"`
+	ContentStore           ConfigContent  `yaml:"content_store"`
+	Sybil                  ConfigSybil    `yaml:"sybil"`
 	Protocols              ConfigProtocol `yaml:"protocols"`
 }
 
+type ConfigMempool struct {
+	MaxSize         int    `yaml:"max_size"`         // bytes, 0 for no limit
+	MinRelayFee     int    `yaml:"min_relay_fee"`    // fee per 1000 bytes
+	Expiry          int    `yaml:"expiry"`           // seconds, 0 to never expire
+	MaxReplacements int    `yaml:"max_replacements"` // transactions a replacement may evict
+	MaxFreePending  int    `yaml:"max_free_pending"` // transactions spending nothing, such as reviews, one author may have pending, 0 for no limit
+	PersistFile     string `yaml:"persist_file"`     // empty to keep the mempool in memory only
+	PersistInterval int    `yaml:"persist_interval"` // seconds between dumps, 0 to dump only on shutdown
+}
+
+type ConfigContent struct {
+	Dir     string `yaml:"dir"`      // directory holding review content, one file per hash
+	MaxSize int    `yaml:"max_size"` // bytes per blob, 0 for no limit
+}
+
+type ConfigSybil struct {
+	FundingHops    int  `yaml:"funding_hops"`    // longest seller-to-reviewer funding path flagged, 0 to disable
+	AncestryDepth  int  `yaml:"ancestry_depth"`  // transactions followed back from each purchase, 0 to disable
+	BurstWindow    int  `yaml:"burst_window"`    // blocks, 0 to disable burst detection
+	BurstSize      int  `yaml:"burst_size"`      // reviews of one product within the window flagged as a burst
+	ExcludeFlagged bool `yaml:"exclude_flagged"` // leave flagged reviews out of weighted product scores
+}
+
 type ConfigProtocol struct {
 	GetBlocks ConfigGetBlocksProtocol `yaml:"get_blocks"`
 }
@@ -43,6 +77,19 @@ type ConfigWallet struct {
 	BitcoinAddress string `yaml:"bitcoin_address"`
 	PublicKey      string `yaml:"public_key"`
 	PrivateKey     string `yaml:"private_key"`
+	CoinSelection  string `yaml:"coin_selection,omitempty"`
+	// An HD wallet is restored from its mnemonic instead of the keys above
+	Mnemonic   string `yaml:"mnemonic,omitempty"`
+	Passphrase string `yaml:"passphrase,omitempty"`
+	GapLimit   int    `yaml:"gap_limit,omitempty"`
+	// A watch-only wallet tracks an HD account and addresses or hex public keys without their private keys
+	WatchOnly  bool     `yaml:"watch_only,omitempty"`
+	AccountKey string   `yaml:"account_key,omitempty"`
+	Watch      []string `yaml:"watch,omitempty"`
+	// An encrypted wallet file replaces all of the above
+	File          string `yaml:"file,omitempty"`
+	PassphraseEnv string `yaml:"passphrase_env,omitempty"` // variable holding the file passphrase, prompted for when unset
+	UnlockTimeout int    `yaml:"unlock_timeout,omitempty"` // seconds the wallet stays unlocked after startup, 0 for no limit
 }
 
 type ConfigTransaction struct {
@@ -55,6 +102,8 @@ type ConfigTransaction struct {
 	ReviewerAddress string `yaml:"reviewer_address,omitempty"`
 	Rating          int    `yaml:"rating,omitempty"`
 	Amount          int    `yaml:"amount,omitempty"`
+	Price           int    `yaml:"price,omitempty"`
+	MetadataHash    string `yaml:"metadata_hash,omitempty"`
 }
 
 type ConfigGenesisBlock struct {
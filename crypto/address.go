@@ -0,0 +1,132 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// Addresses follow the Bitcoin pay-to-pubkey-hash layout: Base58Check of a version
+// byte and the RIPEMD-160 of the SHA-256 of the public key.
+
+const AddressVersion = 0x00
+
+// Outputs locked by spending conditions rather than a single key pay to a
+// script address, the 20 byte hash of the encoded conditions under this version,
+// like Bitcoin's pay-to-script-hash
+const ScriptAddressVersion = 0x05
+
+var ErrInvalidAddress = errors.New("invalid address")
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// PublicKeyHash is the 20 byte hash an address commits to
+func PublicKeyHash(publicKey []byte) []byte {
+	return hash160(publicKey)
+}
+
+// AddressFromPublicKey returns the Base58Check address of publicKey
+func AddressFromPublicKey(publicKey []byte) []byte {
+	return EncodeAddress(AddressVersion, PublicKeyHash(publicKey))
+}
+
+// ScriptAddress returns the Base58Check address of the encoded spending conditions script
+func ScriptAddress(script []byte) []byte {
+	return EncodeAddress(ScriptAddressVersion, hash160(script))
+}
+
+// MultisigScript encodes the condition that threshold of publicKeys sign, in order:
+// the threshold, the number of keys, then each key prefixed with its length
+func MultisigScript(threshold int, publicKeys [][]byte) []byte {
+	script := []byte{byte(threshold), byte(len(publicKeys))}
+	for _, publicKey := range publicKeys {
+		script = append(script, byte(len(publicKey)))
+		script = append(script, publicKey...)
+	}
+	return script
+}
+
+// MultisigAddress returns the script address of a threshold of publicKeys
+func MultisigAddress(threshold int, publicKeys [][]byte) []byte {
+	return ScriptAddress(MultisigScript(threshold, publicKeys))
+}
+
+func hash160(data []byte) []byte {
+	h := ripemd160.New()
+	h.Write(HashData(data))
+	return h.Sum(nil)
+}
+
+// EncodeAddress builds a Base58Check address from a version byte and payload
+func EncodeAddress(version byte, payload []byte) []byte {
+	data := append([]byte{version}, payload...)
+	return []byte(Base58Encode(append(data, checksum(data)...)))
+}
+
+// DecodeAddress returns the version and payload of an address after checking its checksum
+func DecodeAddress(address []byte) (byte, []byte, error) {
+	data, err := Base58Decode(string(address))
+	if err != nil || len(data) < 5 {
+		return 0, nil, ErrInvalidAddress
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if !bytes.Equal(checksum(body), sum) {
+		return 0, nil, ErrInvalidAddress
+	}
+	return body[0], body[1:], nil
+}
+
+func ValidateAddress(address []byte) bool {
+	_, _, err := DecodeAddress(address)
+	return err == nil
+}
+
+func checksum(data []byte) []byte {
+	return HashData(HashData(data))[:4]
+}
+
+func Base58Encode(data []byte) string {
+	num := new(big.Int).SetBytes(data)
+	base := big.NewInt(int64(len(base58Alphabet)))
+	mod := new(big.Int)
+
+	var encoded []byte
+	for num.Sign() > 0 {
+		num.DivMod(num, base, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+	// Leading zero bytes are kept as leading '1's
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
+
+func Base58Decode(encoded string) ([]byte, error) {
+	num := new(big.Int)
+	base := big.NewInt(int64(len(base58Alphabet)))
+	for _, c := range []byte(encoded) {
+		digit := bytes.IndexByte([]byte(base58Alphabet), c)
+		if digit < 0 {
+			return nil, ErrInvalidAddress
+		}
+		num.Mul(num, base)
+		num.Add(num, big.NewInt(int64(digit)))
+	}
+
+	decoded := num.Bytes()
+	zeros := 0
+	for zeros < len(encoded) && encoded[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), decoded...), nil
+}
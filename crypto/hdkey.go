@@ -0,0 +1,251 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Hierarchical deterministic keys follow SLIP-0010, BIP-32 for the NIST P-256 curve:
+// every key carries a chain code, and a parent key with its chain code derives any
+// number of child keys. Hardened children need the parent's private key; the other
+// children's public keys can also be derived from the parent's public key alone.
+
+var ErrInvalidExtendedKey = errors.New("invalid extended key")
+
+// Child indexes from HardenedOffset on derive hardened keys, written with a ' in paths
+const HardenedOffset uint32 = 1 << 31
+
+// Versions of serialized extended keys, as in BIP-32, which make them read xprv and xpub
+const (
+	extendedPrivateVersion uint32 = 0x0488ade4
+	extendedPublicVersion  uint32 = 0x0488b21e
+)
+
+// Length of a serialized extended key, before its checksum
+const extendedKeySize = 78
+
+// ExtendedKey is a key with the chain code its children are derived with
+type ExtendedKey struct {
+	PrivateKey []byte // nil for a public extended key
+	PublicKey  []byte
+	ChainCode  []byte
+	Depth      int
+	Index      uint32
+	// First four bytes of the public key hash of the parent, 0 for a master key
+	ParentFingerprint uint32
+}
+
+// NewMasterKey derives the root of the key tree from a seed
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, fmt.Errorf("%w: seed of %d bytes", ErrInvalidExtendedKey, len(seed))
+	}
+	mac := hmac.New(sha512.New, []byte("Nist256p1 seed"))
+	data := seed
+	for {
+		mac.Reset()
+		mac.Write(data)
+		sum := mac.Sum(nil)
+		if k := new(big.Int).SetBytes(sum[:32]); k.Sign() != 0 && k.Cmp(curveOrder()) < 0 {
+			return newPrivateExtendedKey(sum[:32], sum[32:], 0, 0)
+		}
+		data = sum
+	}
+}
+
+func newPrivateExtendedKey(privateKey []byte, chainCode []byte, depth int, index uint32) (*ExtendedKey, error) {
+	publicKey, err := PublicKeyFromPrivate(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &ExtendedKey{PrivateKey: privateKey, PublicKey: publicKey, ChainCode: chainCode, Depth: depth, Index: index}, nil
+}
+
+// IsPrivate reports whether the key can derive private and hardened children
+func (k *ExtendedKey) IsPrivate() bool {
+	return k.PrivateKey != nil
+}
+
+// Neuter returns the public extended key, which derives only the public keys of
+// non-hardened children
+func (k *ExtendedKey) Neuter() *ExtendedKey {
+	return &ExtendedKey{PublicKey: k.PublicKey, ChainCode: k.ChainCode, Depth: k.Depth, Index: k.Index, ParentFingerprint: k.ParentFingerprint}
+}
+
+// Fingerprint identifies the key to its children, as in BIP-32: the first four
+// bytes of the hash of its compressed public key
+func (k *ExtendedKey) Fingerprint() uint32 {
+	return binary.BigEndian.Uint32(hash160(compressPublicKey(k.PublicKey)))
+}
+
+// String serializes the key as in BIP-32, Base58Check encoded
+func (k *ExtendedKey) String() string {
+	version, keyData := extendedPublicVersion, compressPublicKey(k.PublicKey)
+	if k.IsPrivate() {
+		version, keyData = extendedPrivateVersion, append([]byte{0}, k.PrivateKey...)
+	}
+	data := binary.BigEndian.AppendUint32(nil, version)
+	data = append(data, byte(k.Depth))
+	data = binary.BigEndian.AppendUint32(data, k.ParentFingerprint)
+	data = binary.BigEndian.AppendUint32(data, k.Index)
+	data = append(data, k.ChainCode...)
+	data = append(data, keyData...)
+	return Base58Encode(append(data, checksum(data)...))
+}
+
+// ParseExtendedKey reads a key serialized by String
+func ParseExtendedKey(encoded string) (*ExtendedKey, error) {
+	data, err := Base58Decode(encoded)
+	if err != nil || len(data) != extendedKeySize+4 {
+		return nil, ErrInvalidExtendedKey
+	}
+	body, sum := data[:extendedKeySize], data[extendedKeySize:]
+	if !bytes.Equal(checksum(body), sum) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidExtendedKey)
+	}
+
+	depth := int(body[4])
+	parent := binary.BigEndian.Uint32(body[5:9])
+	index := binary.BigEndian.Uint32(body[9:13])
+	chainCode, keyData := body[13:45], body[45:]
+	switch binary.BigEndian.Uint32(body[:4]) {
+	case extendedPrivateVersion:
+		if keyData[0] != 0 {
+			return nil, ErrInvalidExtendedKey
+		}
+		k, err := newPrivateExtendedKey(keyData[1:], chainCode, depth, index)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidExtendedKey, err)
+		}
+		k.ParentFingerprint = parent
+		return k, nil
+	case extendedPublicVersion:
+		x, y := elliptic.UnmarshalCompressed(elliptic.P256(), keyData)
+		if x == nil {
+			return nil, fmt.Errorf("%w: public key not on the curve", ErrInvalidExtendedKey)
+		}
+		publicKey := make([]byte, publicKeySize)
+		x.FillBytes(publicKey[:publicKeySize/2])
+		y.FillBytes(publicKey[publicKeySize/2:])
+		return &ExtendedKey{PublicKey: publicKey, ChainCode: chainCode, Depth: depth, Index: index, ParentFingerprint: parent}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown version", ErrInvalidExtendedKey)
+}
+
+// Child derives the child key at index
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	hardened := index >= HardenedOffset
+	if hardened && !k.IsPrivate() {
+		return nil, fmt.Errorf("%w: hardened child of a public key", ErrInvalidExtendedKey)
+	}
+
+	var data []byte
+	if hardened {
+		data = append([]byte{0}, k.PrivateKey...)
+	} else {
+		data = compressPublicKey(k.PublicKey)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	curve := elliptic.P256()
+	mac := hmac.New(sha512.New, k.ChainCode)
+	for {
+		mac.Reset()
+		mac.Write(data)
+		sum := mac.Sum(nil)
+		tweak, chainCode := sum[:32], sum[32:]
+
+		// A tweak outside the curve order, or a zero key, skips to the next candidate
+		retry := func() {
+			data = binary.BigEndian.AppendUint32(append([]byte{1}, chainCode...), index)
+		}
+		t := new(big.Int).SetBytes(tweak)
+		if t.Cmp(curveOrder()) >= 0 {
+			retry()
+			continue
+		}
+
+		if k.IsPrivate() {
+			child := t.Add(t, new(big.Int).SetBytes(k.PrivateKey))
+			child.Mod(child, curveOrder())
+			if child.Sign() == 0 {
+				retry()
+				continue
+			}
+			key, err := newPrivateExtendedKey(child.FillBytes(make([]byte, privateKeySize)), chainCode, k.Depth+1, index)
+			if err != nil {
+				return nil, err
+			}
+			key.ParentFingerprint = k.Fingerprint()
+			return key, nil
+		}
+
+		parent, err := decodePublicKey(k.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		tx, ty := curve.ScalarBaseMult(tweak)
+		x, y := curve.Add(tx, ty, parent.X, parent.Y)
+		if x.Sign() == 0 && y.Sign() == 0 {
+			retry()
+			continue
+		}
+		publicKey := make([]byte, publicKeySize)
+		x.FillBytes(publicKey[:publicKeySize/2])
+		y.FillBytes(publicKey[publicKeySize/2:])
+		return &ExtendedKey{PublicKey: publicKey, ChainCode: chainCode, Depth: k.Depth + 1, Index: index, ParentFingerprint: k.Fingerprint()}, nil
+	}
+}
+
+// Derive follows path, a list of child indexes, from k
+func (k *ExtendedKey) Derive(path []uint32) (*ExtendedKey, error) {
+	key := k
+	for _, index := range path {
+		child, err := key.Child(index)
+		if err != nil {
+			return nil, err
+		}
+		key = child
+	}
+	return key, nil
+}
+
+// ParsePath reads a derivation path such as m/44'/0'/0'/1/5
+func ParsePath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if parts[0] != "m" {
+		return nil, fmt.Errorf("%w: path %q does not start at m", ErrInvalidExtendedKey, path)
+	}
+	var indexes []uint32
+	for _, part := range parts[1:] {
+		offset := uint32(0)
+		if strings.HasSuffix(part, "'") {
+			part, offset = strings.TrimSuffix(part, "'"), HardenedOffset
+		}
+		index, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("%w: path %q", ErrInvalidExtendedKey, path)
+		}
+		indexes = append(indexes, uint32(index)+offset)
+	}
+	return indexes, nil
+}
+
+func curveOrder() *big.Int {
+	return elliptic.P256().Params().N
+}
+
+// compressPublicKey encodes a 64 byte public key as its X coordinate with a prefix
+// for the parity of Y
+func compressPublicKey(publicKey []byte) []byte {
+	prefix := byte(2) | publicKey[publicKeySize-1]&1
+	return append([]byte{prefix}, publicKey[:publicKeySize/2]...)
+}
@@ -0,0 +1,124 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Mnemonics are BIP-39 seed phrases: the entropy behind a wallet and a checksum of
+// it, written as words from the English list. Any phrase from another BIP-39
+// wallet is accepted, although the keys derived from its seed differ, see hdkey.go.
+
+var ErrInvalidMnemonic = errors.New("invalid mnemonic")
+
+//go:embed wordlist_english.txt
+var englishWords string
+
+var (
+	wordlist    = strings.Fields(englishWords)
+	wordIndexes = func() map[string]int {
+		indexes := make(map[string]int, len(wordlist))
+		for i, word := range wordlist {
+			indexes[word] = i
+		}
+		return indexes
+	}()
+)
+
+// PBKDF2 rounds stretching a mnemonic into its seed
+const mnemonicRounds = 2048
+
+// NewMnemonic returns a random phrase of bits of entropy: a multiple of 32 from
+// 128, for 12 words, to 256, for 24
+func NewMnemonic(bits int) (string, error) {
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", fmt.Errorf("%w: %d bits of entropy", ErrInvalidMnemonic, bits)
+	}
+	entropy := make([]byte, bits/8)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	return EntropyToMnemonic(entropy)
+}
+
+// EntropyToMnemonic encodes entropy with its checksum as words, 11 bits each
+func EntropyToMnemonic(entropy []byte) (string, error) {
+	bits := len(entropy) * 8
+	if bits < 128 || bits > 256 || bits%32 != 0 {
+		return "", fmt.Errorf("%w: %d bits of entropy", ErrInvalidMnemonic, bits)
+	}
+	checksum := sha256.Sum256(entropy)
+	data := append(append([]byte(nil), entropy...), checksum[0])
+
+	words := make([]string, (bits+bits/32)/11)
+	for i := range words {
+		words[i] = wordlist[readBits(data, i*11, 11)]
+	}
+	return strings.Join(words, " "), nil
+}
+
+// MnemonicToEntropy decodes a phrase, checking its words and checksum
+func MnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, fmt.Errorf("%w: %d words", ErrInvalidMnemonic, len(words))
+	}
+	data := make([]byte, (len(words)*11+7)/8)
+	for i, word := range words {
+		index, exists := wordIndexes[word]
+		if !exists {
+			return nil, fmt.Errorf("%w: unknown word %q", ErrInvalidMnemonic, word)
+		}
+		writeBits(data, i*11, 11, index)
+	}
+
+	checksumBits := len(words) * 11 / 33
+	entropy := data[:checksumBits*4]
+	checksum := sha256.Sum256(entropy)
+	if readBits(data, len(entropy)*8, checksumBits) != readBits(checksum[:], 0, checksumBits) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrInvalidMnemonic)
+	}
+	return entropy, nil
+}
+
+// ValidateMnemonic reports whether mnemonic is a well formed phrase
+func ValidateMnemonic(mnemonic string) bool {
+	_, err := MnemonicToEntropy(mnemonic)
+	return err == nil
+}
+
+// MnemonicSeed stretches a phrase and an optional passphrase into the 64 byte seed
+// keys are derived from. Each passphrase gives a different, equally valid seed.
+func MnemonicSeed(mnemonic string, passphrase string) ([]byte, error) {
+	if _, err := MnemonicToEntropy(mnemonic); err != nil {
+		return nil, err
+	}
+	normalized := strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key([]byte(normalized), []byte("mnemonic"+passphrase), mnemonicRounds, 64, sha512.New), nil
+}
+
+// readBits reads n bits of data from bit offset, most significant first
+func readBits(data []byte, offset int, n int) int {
+	value := 0
+	for i := offset; i < offset+n; i++ {
+		value = value<<1 | int(data[i/8]>>(7-i%8)&1)
+	}
+	return value
+}
+
+// writeBits writes the low n bits of value into data from bit offset
+func writeBits(data []byte, offset int, n int, value int) {
+	for i := 0; i < n; i++ {
+		if value>>(n-1-i)&1 == 1 {
+			bit := offset + i
+			data[bit/8] |= 1 << (7 - bit%8)
+		}
+	}
+}
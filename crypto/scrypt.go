@@ -0,0 +1,10 @@
+package crypto
+
+import "golang.org/x/crypto/scrypt"
+
+// Scrypt derives keyLen bytes from password and salt as in RFC 7914. N, a power of
+// two, sets the CPU and memory cost, r the block size and p the parallelization;
+// the memory used is 128*N*r bytes.
+func Scrypt(password []byte, salt []byte, N int, r int, p int, keyLen int) ([]byte, error) {
+	return scrypt.Key(password, salt, N, r, p, keyLen)
+}
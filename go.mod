@@ -1,7 +1,12 @@
 module trustify
 
-go 1.23
+go 1.23.0
+
+require gopkg.in/yaml.v2 v2.4.0
 
 require (
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	golang.org/x/crypto v0.41.0
+	golang.org/x/term v0.34.0
 )
+
+require golang.org/x/sys v0.35.0 // indirect
@@ -1,7 +1,15 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"trustify/api"
+	"trustify/blockchain"
 	"trustify/config"
 	"trustify/network"
 )
@@ -13,28 +21,193 @@ func main() {
 	// Handle errors gracefully if node initialization fails.
 	// Call the Start method on the node to begin operations like networking, transaction processing, and mining.
 	// Maintain an infinite loop to keep the program alive, allowing the node to operate continuously.
+	encryptWallet := flag.String("encrypt-wallet", "", "write this node's configured wallet to an encrypted wallet file at `path` and exit")
+	keysFile := flag.String("keys", "", "with -encrypt-wallet, take the wallet from the keys file at `path` instead of config.yml")
+	nodeName := flag.String("node", "", "with -encrypt-wallet, write the wallet of node `name` instead of this host's")
+	signPSBT := flag.String("sign-psbt", "", "sign the partial transaction in the file at `path` with this node's configured wallet, write it back and exit")
+	maxFee := flag.Int("max-fee", -1, "with -sign-psbt, refuse to sign a partial transaction paying a fee above `amount`")
+	combinePSBT := flag.String("combine-psbt", "", "merge into the partial transaction at `path` the signatures of those in the files given as arguments and exit")
+	rescanFrom := flag.Int("rescan-from", -1, "rescan the chain from `height` for the outputs of the wallet's keys once the node has started")
+	flag.Parse()
+
 	cfg, err := config.LoadConfig("config.yml")
 	if err != nil {
 		log.Fatalf("Failed to load configuration: %v\n", err)
 	}
 
+	if *encryptWallet != "" {
+		keys := cfg
+		if *keysFile != "" {
+			if keys, err = config.LoadConfig(*keysFile); err != nil {
+				log.Fatalf("Failed to load keys: %v\n", err)
+			}
+		}
+		if err := writeWalletFile(keys, *nodeName, *encryptWallet); err != nil {
+			log.Fatalf("Failed to encrypt wallet: %v\n", err)
+		}
+		fmt.Println("Wallet written to", *encryptWallet, "- set wallet.file to it in config.yml")
+		return
+	}
+
+	if *signPSBT != "" {
+		if *maxFee < 0 {
+			log.Fatalln("-sign-psbt needs -max-fee")
+		}
+		signed, err := signPSBTFile(cfg, *signPSBT, *maxFee)
+		if err != nil {
+			log.Fatalf("Failed to sign partial transaction: %v\n", err)
+		}
+		fmt.Println("Added", signed, "signatures to", *signPSBT)
+		return
+	}
+
+	if *combinePSBT != "" {
+		if err := combinePSBTFiles(*combinePSBT, flag.Args()); err != nil {
+			log.Fatalf("Failed to combine partial transactions: %v\n", err)
+		}
+		fmt.Println("Signatures combined into", *combinePSBT)
+		return
+	}
+
 	// // Proceed with initializing the node using cfg
 	node := network.NewNode(cfg)
-	
-	node.Start()
+	if node == nil {
+		log.Fatalf("Failed to initialize node\n")
+	}
+
+	go node.Start()
+
+	if *rescanFrom >= 0 {
+		if err := node.RescanWallet(*rescanFrom); err != nil {
+			log.Printf("Failed to rescan wallet: %v\n", err)
+		}
+	}
+
+	var server *api.Server
+	if cfg.API.Listen != "" {
+		server = api.NewServer(node, &cfg.API)
+		go server.Start()
+	}
+
+	// Set up graceful shutdown handling.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	// Block until a termination signal is received.
+	<-stop
+
+	fmt.Println("Shutting down the node...")
+	if server != nil {
+		if err := server.Stop(); err != nil {
+			log.Printf("Error stopping the API: %v\n", err)
+		}
+	}
+	if err := node.Stop(); err != nil {
+		log.Printf("Error during node shutdown: %v\n", err)
+	}
+	fmt.Println("Node has been successfully stopped.")
+}
+
+// writeWalletFile encrypts the wallet configured for node, or this host when empty,
+// with the passphrase from the environment or the terminal
+func writeWalletFile(cfg *config.Config, node string, path string) error {
+	me := node
+	if me == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		me = hostname
+	}
+	cfgNode, exists := cfg.Nodes[me]
+	if !exists {
+		return fmt.Errorf("no wallet configured for %s", me)
+	}
+	cfgWallet := cfgNode.Wallet
+	if cfgWallet.File != "" {
+		return fmt.Errorf("wallet of %s is already in %s", me, cfgWallet.File)
+	}
+	wallet, err := blockchain.NewWalletFromConfig(&cfgWallet)
+	if err != nil {
+		return err
+	}
+	passphrase, err := blockchain.WalletPassphrase(cfgWallet.PassphraseEnv)
+	if err != nil {
+		return err
+	}
+	return wallet.Encrypt(path, passphrase)
+}
 
-	// // Step 4: Set up graceful shutdown handling.
-	// stop := make(chan os.Signal, 1)
-	// signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+// signPSBTFile signs the partial transaction at path with the wallet configured for
+// this host, which need not be connected to the network, keeping its encoding. It
+// refuses to sign a fee above maxFee.
+func signPSBTFile(cfg *config.Config, path string, maxFee int) (int, error) {
+	me, err := os.Hostname()
+	if err != nil {
+		return 0, err
+	}
+	cfgWallet := cfg.Nodes[me].Wallet
+	wallet, err := blockchain.NewWalletFromConfig(&cfgWallet)
+	if err != nil {
+		return 0, err
+	}
+	p, binary, err := readPSBTFile(path)
+	if err != nil {
+		return 0, err
+	}
+	fmt.Printf("Partial transaction %x: %d inputs, %d outputs, fee %d\n", p.Tx.ID, len(p.Tx.Inputs), len(p.Tx.Outputs), p.Fee())
+	signed, err := wallet.SignPartial(p, maxFee)
+	if err != nil {
+		return signed, err
+	}
+	return signed, writePSBTFile(path, binary, p)
+}
 
-	// fmt.Println("Node is running. Press Ctrl+C to exit.")
+// combinePSBTFiles merges the signatures of the partial transactions at others into
+// the one at path
+func combinePSBTFiles(path string, others []string) error {
+	p, binary, err := readPSBTFile(path)
+	if err != nil {
+		return err
+	}
+	parts := make([]*blockchain.PartialTransaction, 0, len(others))
+	for _, other := range others {
+		part, _, err := readPSBTFile(other)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, part)
+	}
+	if err := p.Combine(parts...); err != nil {
+		return err
+	}
+	return writePSBTFile(path, binary, p)
+}
 
-	// // Step 5: Block until a termination signal is received.
-	// <-stop
+// readPSBTFile reads a partial transaction in either encoding and reports whether
+// it was binary
+func readPSBTFile(path string) (*blockchain.PartialTransaction, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	p, err := blockchain.ParsePartialTransaction(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %w", path, err)
+	}
+	return p, !json.Valid(data), nil
+}
 
-	// // fmt.Println("Shutting down the node...")
-	// // if err := node.Stop(); err != nil {
-	// // 	log.Printf("Error during node shutdown: %v\n", err)
-	// // }
-	// fmt.Println("Node has been successfully stopped.")
+func writePSBTFile(path string, binary bool, p *blockchain.PartialTransaction) error {
+	var data []byte
+	var err error
+	if binary {
+		data, err = p.Serialize()
+	} else {
+		data, err = json.MarshalIndent(p, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
 }
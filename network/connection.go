@@ -1,11 +1,17 @@
 package network
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"sync"
 )
 
+// Frames larger than this are treated as a protocol error rather than allocated
+const maxFrameSize = 32 << 20
+
 type InboundMessage struct {
 	Data   []byte
 	Sender net.Addr
@@ -31,15 +37,15 @@ type ConnectionPool struct {
 }
 
 func (cp *ConnectionPool) Add(addr net.Addr, conn interface{}) {
-	cp.Connections.Store(addr, conn)
+	cp.Connections.Store(addr.String(), conn)
 }
 
 func (cp *ConnectionPool) Remove(addr net.Addr) {
-	cp.Connections.Delete(addr)
+	cp.Connections.Delete(addr.String())
 }
 
 func (cp *ConnectionPool) Get(addr net.Addr) (interface{}, error) {
-	conn, exists := cp.Connections.Load(addr)
+	conn, exists := cp.Connections.Load(addr.String())
 	if !exists && cp.ConnectionType == Outgoing {
 		var err error
 		conn, err = cp.GetNewConnection(addr, cp.Port)
@@ -62,9 +68,35 @@ func NewTCPConnectionPool(Port int, ConnectionType ConnectionType) *ConnectionPo
 }
 
 func GetTCPConnection(addr net.Addr, port int) (net.Conn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", addr.(*net.TCPAddr).IP.String(), port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(addr.(*net.TCPAddr).IP.String(), strconv.Itoa(port)))
 	if err != nil {
 		return nil, err
 	}
 	return conn, nil
-}
\ No newline at end of file
+}
+
+// Messages are written to a connection as a 4 byte big-endian length followed by the message
+func WriteFrame(w io.Writer, data []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	if _, err := w.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFrameSize {
+		return nil, fmt.Errorf("frame of %d bytes exceeds limit", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
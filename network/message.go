@@ -0,0 +1,65 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+type MessageType int
+
+const (
+	MessageTransaction MessageType = iota
+	MessageBlock
+	MessageReject
+	MessageGetContent
+	MessageContent
+)
+
+// Every message on the wire is a gob encoded Message, whose Payload holds
+// the gob encoding of the object named by Type
+type Message struct {
+	Type    MessageType
+	Payload []byte
+}
+
+// RejectMessage tells the sender of a transaction why it was not accepted
+type RejectMessage struct {
+	TxID   string
+	Reason string
+}
+
+// ContentRequest asks a peer for the review content stored under Hash
+type ContentRequest struct {
+	Hash []byte
+}
+
+// ContentMessage carries review content, which the receiver checks against Hash
+type ContentMessage struct {
+	Hash    []byte
+	Content []byte
+}
+
+func EncodeMessage(msgType MessageType, payload interface{}) ([]byte, error) {
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(payload); err != nil {
+		return nil, err
+	}
+
+	var buff bytes.Buffer
+	if err := gob.NewEncoder(&buff).Encode(Message{Type: msgType, Payload: data.Bytes()}); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+func DecodeMessage(data []byte) (*Message, error) {
+	var msg Message
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (msg *Message) DecodePayload(v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(msg.Payload)).Decode(v)
+}
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"time"
+	"errors"
 )
 
 type Node struct {
@@ -18,6 +19,7 @@ type Node struct {
 	Blockchain *blockchain.Blockchain
 	Mempool    *blockchain.Mempool
 	UTXOSet    *blockchain.UTXOSet
+	Content    *blockchain.ContentStore
 	Miner      *blockchain.Miner
 	Peers      []string
 	TCPEgress  *ConnectionPool
@@ -45,22 +47,31 @@ func NewNode(cfg *config.Config) *Node {
 		return nil
 	}
 	cfgNode := cfg.Nodes[me]
-	wallet := blockchain.NewWallet([]byte(cfgNode.Wallet.PrivateKey), []byte(cfgNode.Wallet.PublicKey), []byte(cfgNode.Wallet.BitcoinAddress)) // Need to get self private key
+	wallet, err := blockchain.NewWalletFromConfig(&cfgNode.Wallet)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to initialize wallet:", err)
+		return nil
+	}
 	chain, err := blockchain.NewBlockchain(&cfg.GenesisBlock, &cfg.BlockchainSettings)
 	if err != nil {
 		logger.ErrorLogger.Println("Failed to initialize blockchain:", err)
 		return nil
 	}
 
-	mempool := blockchain.NewMempool()
-	utxoSet := blockchain.NewUTXOSet()
-
-	// Initialize UTXOSet with genesis block's transactions
-	for _, tx := range chain.Ledger[0].Transactions {
-		utxoSet.Add(tx) // TODO: create a copy of tx
-		if bytes.Equal(tx.Address, wallet.BitcoinAddress) {
-			wallet.UTXOs = append(wallet.UTXOs, tx)
-		}
+	mempool := blockchain.NewMempool(&cfg.BlockchainSettings.Mempool)
+	// The chain keeps the UTXOSet current as blocks connect and disconnect
+	utxoSet := chain.UTXOSet
+	// The wallet follows the chain from genesis, tracking its outputs and history
+	wallet.CoinbaseMaturity = chain.CoinbaseMaturity
+	wallet.ConfirmationDepth = chain.ConfirmationDepth
+	chain.RegisterIndex(wallet)
+	// Coins spent by the wallet's transactions still in the mempool are not selected again
+	wallet.Pending = mempool.Pending
+
+	content, err := blockchain.NewContentStore(&cfg.BlockchainSettings.ContentStore)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to initialize content store:", err)
+		return nil
 	}
 
 	miner := blockchain.NewMiner(chain, mempool)
@@ -79,6 +90,7 @@ func NewNode(cfg *config.Config) *Node {
 		Blockchain: chain,
 		Mempool:    mempool,
 		UTXOSet:    utxoSet,
+		Content:    content,
 		Miner:      miner,
 		Peers:      peers,
 		TCPEgress: NewTCPConnectionPool(8080, Outgoing),
@@ -86,6 +98,12 @@ func NewNode(cfg *config.Config) *Node {
 		WriteChannel: make(chan OutboundMessage),
 	}
 
+	if path := cfg.BlockchainSettings.Mempool.PersistFile; path != "" {
+		if _, err := mempool.Load(path, node.validateTransaction); err != nil {
+			logger.ErrorLogger.Println("Failed to restore mempool:", err)
+		}
+	}
+
 	logger.InfoLogger.Printf("Node initialized: %+v\n", node)
 
 	// logger.InfoLogger.Println("Node initialized with address:", wallet.BitcoinAddress)
@@ -101,14 +119,11 @@ func (n *Node) Start() {
 
 	// Start networking, transaction processing, mining
 	go n.ListenForTCPConnections()
+	go n.expireMempool()
+	go n.persistMempool()
 
 	time.Sleep(5 * time.Second)
 
-	// TEST
-	for _, peer := range n.Peers {
-		go n.SendMessageToHost(peer, []byte("hello"))
-	}
-
 	n.HandleMessages()
 
 	// go n.mineBlocks()
@@ -137,10 +152,9 @@ func (n *Node) ListenForTCPConnections() {
 
 func (node *Node) HandleTCPConnection(conn net.Conn) {
 	defer conn.Close()
-	buffer := make([]byte, 1024)
 
 	for {
-		n, err := conn.Read(buffer)
+		data, err := ReadFrame(conn)
 		if err != nil {
 			if err != io.EOF {
 				fmt.Println("Error reading from TCP connection:", err)
@@ -148,7 +162,7 @@ func (node *Node) HandleTCPConnection(conn net.Conn) {
 			break
 		}
 		node.ReadChannel <- InboundMessage{
-			Data:   buffer[:n],
+			Data:   data,
 			Sender: conn.RemoteAddr(),
 		}
 	}
@@ -182,27 +196,217 @@ func (n *Node) HandleMessages() {
 	for {
 		select {
 		case inboundMessage := <-n.ReadChannel:
-			// Handle incoming message
-			fmt.Println("Received message:", string(inboundMessage.Data))
+			n.handleInboundMessage(inboundMessage)
 		case outboundMessage := <-n.WriteChannel:
-			conn, _ := n.TCPEgress.Get(outboundMessage.Recipient)
-			tcpConn := conn.(net.Conn)
-			tcpConn.Write(outboundMessage.Data)
+			conn, err := n.TCPEgress.Get(outboundMessage.Recipient)
+			if err != nil {
+				logger.ErrorLogger.Printf("Failed to connect to %v: %v\n", outboundMessage.Recipient, err)
+				continue
+			}
+			if err := WriteFrame(conn.(net.Conn), outboundMessage.Data); err != nil {
+				logger.ErrorLogger.Printf("Failed to send message to %v: %v\n", outboundMessage.Recipient, err)
+				n.TCPEgress.Remove(outboundMessage.Recipient)
+			}
+		}
+	}
+}
+
+func (n *Node) handleInboundMessage(inboundMessage InboundMessage) {
+	msg, err := DecodeMessage(inboundMessage.Data)
+	if err != nil {
+		logger.ErrorLogger.Printf("Failed to decode message from %v: %v\n", inboundMessage.Sender, err)
+		return
+	}
+
+	switch msg.Type {
+	case MessageTransaction:
+		var tx blockchain.Transaction
+		if err := msg.DecodePayload(&tx); err != nil {
+			logger.ErrorLogger.Printf("Failed to decode transaction from %v: %v\n", inboundMessage.Sender, err)
+			return
+		}
+		// Transactions are relayed on first acceptance only, so a transaction
+		// coming back around the network stops at ErrTxInMempool
+		if err := n.HandleIncomingTransaction(tx); err != nil {
+			if !errors.Is(err, blockchain.ErrTxInMempool) {
+				n.sendReject(inboundMessage.Sender, &tx, err)
+			}
+			return
+		}
+		n.BroadcastTransaction(tx)
+	case MessageGetContent:
+		var request ContentRequest
+		if err := msg.DecodePayload(&request); err != nil {
+			logger.ErrorLogger.Printf("Failed to decode content request from %v: %v\n", inboundMessage.Sender, err)
+			return
+		}
+		n.sendContent(inboundMessage.Sender, request.Hash)
+	case MessageContent:
+		var content ContentMessage
+		if err := msg.DecodePayload(&content); err != nil {
+			logger.ErrorLogger.Printf("Failed to decode content from %v: %v\n", inboundMessage.Sender, err)
+			return
+		}
+		if err := n.HandleIncomingContent(content.Hash, content.Content); err != nil {
+			logger.ErrorLogger.Printf("Content %x from %v refused: %v\n", content.Hash, inboundMessage.Sender, err)
+		}
+	case MessageReject:
+		var reject RejectMessage
+		if err := msg.DecodePayload(&reject); err != nil {
+			logger.ErrorLogger.Printf("Failed to decode reject from %v: %v\n", inboundMessage.Sender, err)
+			return
+		}
+		logger.ErrorLogger.Printf("Transaction %s rejected by %v: %s\n", reject.TxID, inboundMessage.Sender, reject.Reason)
+	default:
+		logger.ErrorLogger.Printf("Unhandled message type %d from %v\n", msg.Type, inboundMessage.Sender)
+	}
+}
+
+// Replies go to the listening port of the sender rather than the port it connected from
+func (n *Node) sendReject(sender net.Addr, tx *blockchain.Transaction, reason error) {
+	data, err := EncodeMessage(MessageReject, RejectMessage{
+		TxID:   fmt.Sprintf("%x", tx.ID),
+		Reason: reason.Error(),
+	})
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to encode reject message:", err)
+		return
+	}
+	tcpAddr, ok := sender.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	go func() {
+		n.WriteChannel <- OutboundMessage{
+			Data:      data,
+			Recipient: &net.TCPAddr{IP: tcpAddr.IP},
+		}
+	}()
+}
+
+// sendContent answers a content request, staying silent when the content is not stored here
+func (n *Node) sendContent(sender net.Addr, hash []byte) {
+	content, err := n.Content.Get(hash)
+	if err != nil {
+		return
+	}
+	data, err := EncodeMessage(MessageContent, ContentMessage{Hash: hash, Content: content})
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to encode content message:", err)
+		return
+	}
+	tcpAddr, ok := sender.(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	go func() {
+		n.WriteChannel <- OutboundMessage{
+			Data:      data,
+			Recipient: &net.TCPAddr{IP: tcpAddr.IP},
+		}
+	}()
+}
+
+// RequestContent asks every peer for the review content stored under hash
+// Peers holding it reply with a MessageContent, handled by HandleIncomingContent
+func (n *Node) RequestContent(hash []byte) {
+	data, err := EncodeMessage(MessageGetContent, ContentRequest{Hash: hash})
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to encode content request:", err)
+		return
+	}
+	for _, peer := range n.Peers {
+		go n.SendMessageToHost(peer, data)
+	}
+}
+
+// HandleIncomingContent stores content received from a peer if it matches its hash
+// and a confirmed review commits to that hash, so peers cannot fill the store with
+// arbitrary data
+func (n *Node) HandleIncomingContent(hash []byte, content []byte) error {
+	if !bytes.Equal(blockchain.ContentHash(content), hash) {
+		return fmt.Errorf("%w: %x", blockchain.ErrContentMismatch, hash)
+	}
+	if !n.Blockchain.Reviews.ReferencesContent(hash) {
+		return fmt.Errorf("%w: no confirmed review commits to %x", blockchain.ErrContentNotFound, hash)
+	}
+	_, err := n.Content.Put(content)
+	return err
+}
+
+// SubmitReview stores the off-chain content of a review or amendment locally, where
+// peers can fetch it from, then submits the transaction itself
+func (n *Node) SubmitReview(tx *blockchain.Transaction, content []byte) error {
+	var verify func(content []byte) error
+	switch data := tx.Data.(type) {
+	case *blockchain.ReviewTransactionData:
+		verify = data.VerifyContent
+	case *blockchain.ReviewAmendTransactionData:
+		verify = data.VerifyContent
+	default:
+		return fmt.Errorf("%w: not a review", blockchain.ErrTransactionInvalid)
+	}
+	if content != nil {
+		if err := verify(content); err != nil {
+			return err
+		}
+		if _, err := n.Content.Put(content); err != nil {
+			return err
 		}
 	}
+	return n.SubmitTransaction(tx)
 }
 
-func (n *Node) BroadcastTransaction(tx blockchain.UTXOTransaction) {
+// ReviewContent returns the off-chain content of a confirmed review or amendment,
+// checked against the hash it commits to
+// Content missing locally is requested from peers and ErrContentNotFound returned,
+// so the caller can try again once a peer has answered
+func (n *Node) ReviewContent(txID []byte) ([]byte, error) {
+	tx, _, found := n.Blockchain.GetTransaction(txID)
+	if !found {
+		return nil, fmt.Errorf("%w: no confirmed review %x", blockchain.ErrContentNotFound, txID)
+	}
+	var hash []byte
+	switch data := tx.Data.(type) {
+	case *blockchain.ReviewTransactionData:
+		hash = data.ContentHash
+	case *blockchain.ReviewAmendTransactionData:
+		hash = data.ContentHash
+	}
+	if len(hash) == 0 {
+		return nil, fmt.Errorf("%w: %x has no review content", blockchain.ErrContentNotFound, txID)
+	}
+	content, err := n.Content.Get(hash)
+	if errors.Is(err, blockchain.ErrContentNotFound) || errors.Is(err, blockchain.ErrContentMismatch) {
+		n.RequestContent(hash)
+	}
+	return content, err
+}
+
+func (n *Node) BroadcastTransaction(tx blockchain.Transaction) {
 	// Broadcast transaction to the network
 	// Broadcast the transaction data over the network to all the peers
 	// do not use peer to peer multicasting instead use broadcasting
+	data, err := EncodeMessage(MessageTransaction, tx)
+	if err != nil {
+		logger.ErrorLogger.Println("Failed to encode transaction:", err)
+		return
+	}
+	for _, peer := range n.Peers {
+		go n.SendMessageToHost(peer, data)
+	}
+	logger.InfoLogger.Printf("Transaction broadcasted: %x\n", tx.ID)
+}
 
-	// Serialize and broadcast the transaction to peers
-    // data := utils.SerializeTransaction(tx)
-    // for _, peer := range n.Peers {
-    //     go n.sendDataToPeer(peer, data)
-    // }
-    // logger.InfoLogger.Println("Transaction broadcasted:", tx.ID)
+// SubmitTransaction is the entry point for transactions created on this node
+// The returned error carries the mempool's reason for rejecting the transaction
+func (n *Node) SubmitTransaction(tx *blockchain.Transaction) error {
+	if err := n.HandleIncomingTransaction(*tx); err != nil {
+		logger.ErrorLogger.Printf("Transaction %x rejected: %v\n", tx.ID, err)
+		return err
+	}
+	n.BroadcastTransaction(*tx)
+	return nil
 }
 
 func (n *Node) BroadcastBlock(block blockchain.Block) {
@@ -218,7 +422,7 @@ func (n *Node) BroadcastBlock(block blockchain.Block) {
     // logger.InfoLogger.Println("Block broadcasted:", block.Header.BlockHash)
 }
 
-func (n *Node) HandleIncomingTransaction(tx blockchain.UTXOTransaction) error {
+func (n *Node) HandleIncomingTransaction(tx blockchain.Transaction) error {
 	// Handle incoming transaction
 	// The peers are responsible for validating these transactions.
 	// They verify if the sender bitcoin address is valid and if the transaction is signed by the sender.
@@ -233,21 +437,134 @@ func (n *Node) HandleIncomingTransaction(tx blockchain.UTXOTransaction) error {
 	// If all the checks pass, the transaction is added to the memory pool.
 	// Add additional methods or files as needed maintaining separation of concerns
 
-	// // Validate and add to mempool
-    // if !tx.Verify() {
-    //     logger.ErrorLogger.Println("Invalid transaction signature:", tx.ID)
-    //     return ErrInvalidSignature
-    // }
+	fee, err := n.validateTransaction(&tx)
+	if err != nil {
+		return err
+	}
 
-    // // Additional validation
-    // if err := n.validateTransaction(tx); err != nil {
-    //     logger.ErrorLogger.Println("Transaction validation failed:", err)
-    //     return err
-    // }
+	// The mempool enforces size, fee and conflict policy and reports why a transaction was refused
+	return n.Mempool.AddTransaction(&tx, fee)
+}
 
-    // n.Mempool.AddTransaction(tx)
-    // logger.InfoLogger.Println("Transaction added to mempool:", tx.ID)
-    return nil
+// validateTransaction checks tx against the current chain state and returns its fee
+// Inputs may spend confirmed outputs or outputs of transactions still in the mempool.
+// A transaction that is still time locked is valid: the mempool holds it until
+// it can be mined.
+func (n *Node) validateTransaction(tx *blockchain.Transaction) (int, error) {
+	fee, err := n.Blockchain.ValidateTransaction(tx, n.lookupOutput)
+	if errors.Is(err, blockchain.ErrTxNotFinal) {
+		logger.InfoLogger.Printf("Transaction %x held until final: %v\n", tx.ID, err)
+		return fee, nil
+	}
+	return fee, err
+}
+
+// lookupOutput finds an output among the confirmed UTXOs or the mempool
+func (n *Node) lookupOutput(id *blockchain.UTXOTransactionID) (*blockchain.UTXOTransaction, bool) {
+	if utxo, exists := n.UTXOSet.Get(id); exists {
+		return utxo, true
+	}
+	return n.Mempool.GetOutput(id)
+}
+
+// IsFinal reports whether tx may go into the next block, as opposed to being held
+// in the mempool by a time lock
+func (n *Node) IsFinal(tx *blockchain.Transaction) bool {
+	return n.Blockchain.CheckFinal(tx, n.lookupOutput) == nil
+}
+
+// WalletBalance reports the balances of the node's wallet, including the mempool
+func (n *Node) WalletBalance() blockchain.WalletBalance {
+	return n.Wallet.Balances(n.Mempool.Pending())
+}
+
+// WalletHistory lists the transactions of the node's wallet touching address,
+// newest first and including the mempool
+func (n *Node) WalletHistory(address []byte) []blockchain.WalletTransaction {
+	return n.Wallet.History(address, n.Mempool.Pending())
+}
+
+// NewPartialTransfer builds a transfer of outputs from the node's wallet, plus fee,
+// as a partial transaction for the wallet's keys to sign, wherever they are kept
+func (n *Node) NewPartialTransfer(outputs []blockchain.TxOutput, fee int, memo string) (*blockchain.PartialTransaction, error) {
+	return blockchain.NewPartialTransferTransaction(n.Wallet, outputs, fee, memo, n.previousTransaction)
+}
+
+// previousTransaction finds a transaction spent by a partial transaction, in the
+// chain or the mempool, for the signer to check the amounts of its inputs against
+func (n *Node) previousTransaction(txID []byte) (*blockchain.Transaction, bool) {
+	if tx, _, exists := n.Blockchain.GetTransaction(txID); exists {
+		return tx, true
+	}
+	return n.Mempool.GetTransaction(txID)
+}
+
+// SubmitPartial finalizes a fully signed partial transaction and submits it
+func (n *Node) SubmitPartial(p *blockchain.PartialTransaction) (*blockchain.Transaction, error) {
+	tx, err := p.Finalize()
+	if err != nil {
+		return nil, err
+	}
+	if err := n.SubmitTransaction(tx); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+// WatchAddress makes the node's wallet watch address, or the address of publicKey
+// when it is set, and starts a rescan of the chain from height for what it
+// received. ErrRescanInProgress leaves the address watched, to be rescanned for later.
+func (n *Node) WatchAddress(address []byte, publicKey []byte, label string, height int) error {
+	var err error
+	if publicKey != nil {
+		err = n.Wallet.ImportPublicKey(publicKey, label)
+	} else {
+		err = n.Wallet.ImportAddress(address, label)
+	}
+	if err != nil {
+		return err
+	}
+	return n.Wallet.StartRescan(n.Blockchain, height)
+}
+
+// RescanWallet rebuilds the outputs and history of the node's wallet from height
+// on, in the background, see WalletRescanProgress
+func (n *Node) RescanWallet(height int) error {
+	return n.Wallet.StartRescan(n.Blockchain, height)
+}
+
+// WalletRescanProgress reports on the wallet's current or last rescan
+func (n *Node) WalletRescanProgress() (blockchain.RescanProgress, bool) {
+	return n.Wallet.RescanProgress()
+}
+
+// ProductRatings aggregates the ratings of productID, confirmed and including the mempool
+func (n *Node) ProductRatings(productID string) blockchain.RatingAggregate {
+	return n.Blockchain.Ratings.ProductRatings(productID, n.Mempool.Pending())
+}
+
+// SellerRatings aggregates the ratings of every product sold by seller, confirmed and
+// including the mempool
+func (n *Node) SellerRatings(seller []byte) blockchain.RatingAggregate {
+	return n.Blockchain.Ratings.SellerRatings(seller, n.Mempool.Pending())
+}
+
+// ProductScore rates productID weighing each review by its reviewer's reputation
+// Reviews flagged by the sybil analysis are left out if excludeFlagged is set
+func (n *Node) ProductScore(productID string, excludeFlagged bool) blockchain.WeightedScore {
+	return n.Blockchain.ProductScore(productID, excludeFlagged)
+}
+
+// SybilReport lists suspicious review patterns on productID, or on every product
+// when productID is empty
+func (n *Node) SybilReport(productID string) []blockchain.SybilFlag {
+	return n.Blockchain.SybilReport(productID)
+}
+
+// Reputation returns the stats of reviewer and the weight the reputation model gives them
+func (n *Node) Reputation(reviewer []byte) (blockchain.ReviewerStats, int) {
+	stats := n.Blockchain.ReviewerStats(reviewer)
+	return stats, n.Blockchain.ReputationModel(stats)
 }
 
 func (n *Node) HandleIncomingBlock(block blockchain.Block) error {
@@ -283,4 +600,35 @@ func (n *Node) mineBlocks() {
     //     }
     //     // Wait or check for new transactions before attempting next block
     // }
-}
\ No newline at end of file
+}
+
+func (n *Node) expireMempool() {
+	for range time.Tick(time.Minute) {
+		if expired := n.Mempool.Expire(); expired > 0 {
+			logger.InfoLogger.Printf("Expired %d transactions from mempool\n", expired)
+		}
+	}
+}
+
+func (n *Node) persistMempool() {
+	settings := n.Config.BlockchainSettings.Mempool
+	if settings.PersistFile == "" || settings.PersistInterval <= 0 {
+		return
+	}
+	for range time.Tick(time.Duration(settings.PersistInterval) * time.Second) {
+		if err := n.Mempool.Save(settings.PersistFile); err != nil {
+			logger.ErrorLogger.Println("Failed to save mempool:", err)
+		}
+	}
+}
+
+// Stop saves state that must survive a restart
+func (n *Node) Stop() error {
+	if path := n.Config.BlockchainSettings.Mempool.PersistFile; path != "" {
+		if err := n.Mempool.Save(path); err != nil {
+			return fmt.Errorf("failed to save mempool: %w", err)
+		}
+	}
+	logger.InfoLogger.Println("Node stopped")
+	return nil
+}
@@ -1,11 +1,20 @@
 package types
 
-// NOT IN USE YET
-
 type TransactionType string
 
 const (
 	TransactionTypeCoinbase TransactionType = "coinbase"
 	TransactionTypePurchase TransactionType = "purchase"
 	TransactionTypeReview   TransactionType = "review"
+	TransactionTypeAmend    TransactionType = "amend"
+	TransactionTypeRetract  TransactionType = "retract"
+	TransactionTypeListing  TransactionType = "listing"
+	TransactionTypeUpdate   TransactionType = "update"
+	TransactionTypeDelist   TransactionType = "delist"
+	TransactionTypeRefund   TransactionType = "refund"
+	TransactionTypeTransfer TransactionType = "transfer"
+	TransactionTypeConfirm  TransactionType = "confirm"
+
+	TransactionTypeEscrowRelease TransactionType = "escrow_release"
+	TransactionTypeEscrowRefund  TransactionType = "escrow_refund"
 )